@@ -1,10 +1,61 @@
 package bbolt
 
 import (
+	"io"
 	"syscall"
+	"unsafe"
 )
 
+// iovMax is the maximum number of buffers passed to a single pwritev call.
+const iovMax = 1024
+
 // fdatasync flushes written data to a file descriptor.
-func fdatasync(db *DB) error {
-	return syscall.Fdatasync(int(db.file.Fd()))
+func fdatasync(f *osFile) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// WritevAt writes bufs to consecutive offsets starting at off with pwritev,
+// in as many calls as it takes to write at most iovMax buffers at a time and
+// to finish partial writes.
+func (f *osFile) WritevAt(bufs [][]byte, off int64) (n, calls int, err error) {
+	const longBits = int(unsafe.Sizeof(uintptr(0))) * 8
+	bufs = append([][]byte(nil), bufs...)
+	iovs := make([]syscall.Iovec, 0, iovMax)
+	for len(bufs) > 0 {
+		iovs = iovs[:0]
+		for _, b := range bufs {
+			if len(iovs) == iovMax {
+				break
+			}
+			iov := syscall.Iovec{Base: &b[0]}
+			iov.SetLen(len(b))
+			iovs = append(iovs, iov)
+		}
+
+		// The kernel takes the offset split into two longs.
+		lo, hi := uintptr(off), uintptr(uint64(off)>>(longBits/2)>>(longBits/2))
+		r, _, errno := syscall.Syscall6(syscall.SYS_PWRITEV, f.Fd(), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)), lo, hi, 0)
+		calls++
+		if errno == syscall.EINTR {
+			continue
+		} else if errno != 0 {
+			return n, calls, errno
+		} else if r == 0 {
+			return n, calls, io.ErrShortWrite
+		}
+
+		// Skip past what was written, which may end part way through a buffer.
+		written := int(r)
+		n += written
+		off += int64(written)
+		for written > 0 {
+			if written < len(bufs[0]) {
+				bufs[0] = bufs[0][written:]
+				break
+			}
+			written -= len(bufs[0])
+			bufs = bufs[1:]
+		}
+	}
+	return n, calls, nil
 }
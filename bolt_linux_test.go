@@ -0,0 +1,40 @@
+package bbolt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Ensure that WritevAt writes runs of more than iovMax buffers, counting the
+// pwritev calls it takes.
+func TestOSFile_WritevAt(t *testing.T) {
+	f, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var bufs [][]byte
+	var want []byte
+	for i := 0; i < 2*iovMax+1; i++ {
+		b := []byte{byte(i), byte(i >> 8)}
+		bufs = append(bufs, b)
+		want = append(want, b...)
+	}
+	n, calls, err := (&osFile{File: f, writable: true}).WritevAt(bufs, 16)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != len(want) || calls != 3 {
+		t.Fatalf("unexpected bytes and calls: %d, %d", n, calls)
+	}
+
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got[16:], want) {
+		t.Fatal("unexpected file contents")
+	}
+}
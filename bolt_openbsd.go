@@ -11,17 +11,17 @@ const (
 	msInvalidate             // invalidate cached data
 )
 
-func msync(db *DB) error {
-	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(db.data)), uintptr(db.datasz), msInvalidate)
+func msync(b []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), msInvalidate)
 	if errno != 0 {
 		return errno
 	}
 	return nil
 }
 
-func fdatasync(db *DB) error {
-	if db.data != nil {
-		return msync(db)
+func fdatasync(f *osFile) error {
+	if f.data != nil {
+		return msync(f.data)
 	}
-	return db.file.Sync()
+	return f.File.Sync()
 }
@@ -41,12 +41,12 @@ func unlockFileEx(h syscall.Handle, reserved, locklow, lockhigh uint32, ol *sysc
 }
 
 // fdatasync flushes written data to a file descriptor.
-func fdatasync(db *DB) error {
-	return db.file.Sync()
+func fdatasync(f *osFile) error {
+	return f.File.Sync()
 }
 
 // flock acquires an advisory lock on a file descriptor.
-func flock(db *DB, exclusive bool, timeout time.Duration) error {
+func flock(f *osFile, exclusive bool, timeout time.Duration) error {
 	var t time.Time
 	if timeout != 0 {
 		t = time.Now()
@@ -59,7 +59,7 @@ func flock(db *DB, exclusive bool, timeout time.Duration) error {
 		// Fix for https://github.com/etcd-io/bbolt/issues/121. Use byte-range
 		// -1..0 as the lock on the database file.
 		var m1 uint32 = (1 << 32) - 1 // -1 in a uint32
-		err := lockFileEx(syscall.Handle(db.file.Fd()), flag, 0, 1, 0, &syscall.Overlapped{
+		err := lockFileEx(syscall.Handle(f.Fd()), flag, 0, 1, 0, &syscall.Overlapped{
 			Offset:     m1,
 			OffsetHigh: m1,
 		})
@@ -81,61 +81,58 @@ func flock(db *DB, exclusive bool, timeout time.Duration) error {
 }
 
 // funlock releases an advisory lock on a file descriptor.
-func funlock(db *DB) error {
+func funlock(f *osFile) error {
 	var m1 uint32 = (1 << 32) - 1 // -1 in a uint32
-	err := unlockFileEx(syscall.Handle(db.file.Fd()), 0, 1, 0, &syscall.Overlapped{
+	err := unlockFileEx(syscall.Handle(f.Fd()), 0, 1, 0, &syscall.Overlapped{
 		Offset:     m1,
 		OffsetHigh: m1,
 	})
 	return err
 }
 
-// mmap memory maps a DB's data file.
+// mmap memory maps a data file.
 // Based on: https://github.com/edsrzf/mmap-go
-func mmap(db *DB, sz int) error {
-	if !db.readOnly {
+func mmap(f *osFile, sz int, flags int) ([]byte, error) {
+	if f.writable {
 		// Truncate the database to the size of the mmap.
-		if err := db.file.Truncate(int64(sz)); err != nil {
-			return fmt.Errorf("truncate: %s", err)
+		if err := f.Truncate(int64(sz)); err != nil {
+			return nil, fmt.Errorf("truncate: %s", err)
 		}
 	}
 
 	// Open a file mapping handle.
 	sizelo := uint32(sz >> 32)
 	sizehi := uint32(sz) & 0xffffffff
-	h, errno := syscall.CreateFileMapping(syscall.Handle(db.file.Fd()), nil, syscall.PAGE_READONLY, sizelo, sizehi, nil)
+	h, errno := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, sizelo, sizehi, nil)
 	if h == 0 {
-		return os.NewSyscallError("CreateFileMapping", errno)
+		return nil, os.NewSyscallError("CreateFileMapping", errno)
 	}
 
 	// Create the memory map.
 	addr, errno := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ, 0, 0, uintptr(sz))
 	if addr == 0 {
-		return os.NewSyscallError("MapViewOfFile", errno)
+		return nil, os.NewSyscallError("MapViewOfFile", errno)
 	}
 
 	// Close mapping handle.
 	if err := syscall.CloseHandle(syscall.Handle(h)); err != nil {
-		return os.NewSyscallError("CloseHandle", err)
+		return nil, os.NewSyscallError("CloseHandle", err)
 	}
 
-	// Convert to a byte array.
-	db.data = ((*[maxMapSize]byte)(unsafe.Pointer(addr)))
-	db.datasz = sz
-
-	return nil
+	// Convert to a byte slice.
+	return ((*[maxMapSize]byte)(unsafe.Pointer(addr)))[:sz:sz], nil
 }
 
 // munmap unmaps a pointer from a file.
 // Based on: https://github.com/edsrzf/mmap-go
-func munmap(db *DB) error {
-	if db.data == nil {
-		return nil
-	}
-
-	addr := (uintptr)(unsafe.Pointer(&db.data[0]))
+func munmap(b []byte) error {
+	addr := (uintptr)(unsafe.Pointer(&b[0]))
 	if err := syscall.UnmapViewOfFile(addr); err != nil {
 		return os.NewSyscallError("UnmapViewOfFile", err)
 	}
 	return nil
 }
+
+// mapsExclusively marks files as exclusiveMapper, since their views must be
+// unmapped before they are mapped, and grown, again.
+func (f *osFile) mapsExclusively() {}
@@ -3,6 +3,6 @@
 package bbolt
 
 // fdatasync flushes written data to a file descriptor.
-func fdatasync(db *DB) error {
-	return db.file.Sync()
+func fdatasync(f *osFile) error {
+	return f.File.Sync()
 }
@@ -20,6 +20,7 @@ import (
 	"unsafe"
 
 	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/format"
 )
 
 var (
@@ -60,10 +61,14 @@ var (
 
 	// ErrKeyNotFound is returned when a key is not found.
 	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrDatabaseLocked is returned when a database is in use by another
+	// process.
+	ErrDatabaseLocked = errors.New("database is locked")
 )
 
 // PageHeaderSize represents the size of the bolt.page header.
-const PageHeaderSize = 16
+const PageHeaderSize = format.PageHeaderSize
 
 func main() {
 	m := NewMain()
@@ -112,8 +117,12 @@ func (m *Main) Run(args ...string) error {
 		return newCheckCommand(m).Run(args[1:]...)
 	case "compact":
 		return newCompactCommand(m).Run(args[1:]...)
+	case "convert-endian":
+		return newConvertEndianCommand(m).Run(args[1:]...)
 	case "dump":
 		return newDumpCommand(m).Run(args[1:]...)
+	case "freelist":
+		return newFreelistCommand(m).Run(args[1:]...)
 	case "page-item":
 		return newPageItemCommand(m).Run(args[1:]...)
 	case "get":
@@ -126,8 +135,16 @@ func (m *Main) Run(args ...string) error {
 		return newPageCommand(m).Run(args[1:]...)
 	case "pages":
 		return newPagesCommand(m).Run(args[1:]...)
+	case "recover":
+		return newRecoverCommand(m).Run(args[1:]...)
+	case "revert-meta":
+		return newRevertMetaCommand(m).Run(args[1:]...)
 	case "stats":
 		return newStatsCommand(m).Run(args[1:]...)
+	case "surgery":
+		return newSurgeryCommand(m).Run(args[1:]...)
+	case "upgrade":
+		return newUpgradeCommand(m).Run(args[1:]...)
 	default:
 		return ErrUnknownCommand
 	}
@@ -148,7 +165,10 @@ The commands are:
     buckets     print a list of buckets
     check       verifies integrity of bolt database
     compact     copies a bolt database, compacting it in the process
+    convert-endian
+                copies a bolt database, converting it to the other byte order
     dump        print a hexadecimal dump of a single page
+    freelist    rebuild or convert the freelist
     get         print the value of a key in a bucket
     info        print basic info
     keys        print a list of keys in a bucket
@@ -156,7 +176,11 @@ The commands are:
     page        print one or more pages in human readable format
     pages       print list of pages with their types
     page-item   print the key and value of a page item.
+    recover     copies what can be read of a damaged bolt database
+    revert-meta rolls back the last committed transaction
     stats       iterate over all pages and generate usage stats
+    surgery     repair pages of a copy of a bolt database
+    upgrade     upgrades a bolt database to the current file format
 
 Use "bolt [command] -h" for more information about a command.
 `, "\n")
@@ -425,6 +449,97 @@ Dump prints a hexadecimal dump of one or more pages.
 `, "\n")
 }
 
+// FreelistCommand represents the "freelist" command execution.
+type FreelistCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// newFreelistCommand returns a FreelistCommand.
+func newFreelistCommand(m *Main) *FreelistCommand {
+	return &FreelistCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *FreelistCommand) Run(args ...string) error {
+	// Require a subcommand.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "rebuild":
+		return cmd.runRebuild(args[1:]...)
+	default:
+		return ErrUnknownCommand
+	}
+}
+
+// runRebuild executes the "freelist rebuild" subcommand.
+func (cmd *FreelistCommand) runRebuild(args ...string) error {
+	// Parse flags.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	help := fs.Bool("h", false, "")
+	noSync := fs.Bool("no-sync", false, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	// Require database path.
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	// Open the database without syncing the freelist so that opening it
+	// doesn't convert the file before we do.
+	db, err := bolt.Open(path, 0666, &bolt.Options{NoFreelistSync: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.SetFreelistSync(!*noSync); err != nil {
+		return err
+	}
+
+	if *noSync {
+		fmt.Fprintln(cmd.Stdout, "freelist removed")
+	} else {
+		fmt.Fprintf(cmd.Stdout, "freelist rebuilt: %d free pages\n", db.Stats().FreePageN)
+	}
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *FreelistCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt freelist rebuild [options] PATH
+
+Rebuild recomputes the freelist of the database at PATH from the pages that
+are reachable from its buckets and writes it out in a normal commit. This
+converts a database written with NoFreelistSync into one with a synced
+freelist, and repairs a freelist that has leaked pages.
+
+Additional options include:
+
+	-no-sync
+		Remove the freelist from the file instead, converting it into a
+		database that rebuilds its freelist when opened (NoFreelistSync).
+`, "\n")
+}
+
 // PageItemCommand represents the "page-item" command execution.
 type PageItemCommand struct {
 	Stdin  io.Reader
@@ -517,15 +632,15 @@ func (cmd *PageItemCommand) Run(args ...string) error {
 }
 
 // leafPageElement retrieves a leaf page element.
-func (cmd *PageItemCommand) leafPageElement(pageBytes []byte, index uint16) (*leafPageElement, error) {
-	p := (*page)(unsafe.Pointer(&pageBytes[0]))
-	if index >= p.count {
-		return nil, fmt.Errorf("leafPageElement: expected item index less than %d, but got %d.", p.count, index)
+func (cmd *PageItemCommand) leafPageElement(pageBytes []byte, index uint16) (*format.LeafPageElement, error) {
+	p := (*format.Page)(unsafe.Pointer(&pageBytes[0]))
+	if index >= p.Count {
+		return nil, fmt.Errorf("leafPageElement: expected item index less than %d, but got %d.", p.Count, index)
 	}
 	if p.Type() != "leaf" {
 		return nil, fmt.Errorf("leafPageElement: expected page type of 'leaf', but got '%s'", p.Type())
 	}
-	return p.leafPageElement(index), nil
+	return p.LeafPageElement(index), nil
 }
 
 // writeBytes writes the byte to the writer. Supported formats: ascii-encoded, hex, bytes.
@@ -559,7 +674,7 @@ func (cmd *PageItemCommand) PrintLeafItemKey(w io.Writer, pageBytes []byte, inde
 	if err != nil {
 		return err
 	}
-	return cmd.writeBytes(w, e.key(), format)
+	return cmd.writeBytes(w, e.Key(), format)
 }
 
 // PrintLeafItemKey writes the bytes of a leaf element's value.
@@ -568,7 +683,7 @@ func (cmd *PageItemCommand) PrintLeafItemValue(w io.Writer, pageBytes []byte, in
 	if err != nil {
 		return err
 	}
-	return cmd.writeBytes(w, e.value(), format)
+	return cmd.writeBytes(w, e.Value(), format)
 }
 
 // Usage returns the help message.
@@ -654,7 +769,7 @@ func (cmd *PageCommand) Run(args ...string) error {
 		}
 
 		// Print basic page info.
-		fmt.Fprintf(cmd.Stdout, "Page ID:    %d\n", p.id)
+		fmt.Fprintf(cmd.Stdout, "Page ID:    %d\n", p.ID)
 		fmt.Fprintf(cmd.Stdout, "Page Type:  %s\n", p.Type())
 		fmt.Fprintf(cmd.Stdout, "Total Size: %d bytes\n", len(buf))
 
@@ -668,6 +783,10 @@ func (cmd *PageCommand) Run(args ...string) error {
 			err = cmd.PrintBranch(cmd.Stdout, buf)
 		case "freelist":
 			err = cmd.PrintFreelist(cmd.Stdout, buf)
+		case "freelist-delta":
+			err = cmd.PrintFreelistDelta(cmd.Stdout, buf)
+		case "freelist-hint":
+			err = cmd.PrintFreelistHint(cmd.Stdout, buf)
 		}
 		if err != nil {
 			return err
@@ -679,48 +798,48 @@ func (cmd *PageCommand) Run(args ...string) error {
 
 // PrintMeta prints the data from the meta page.
 func (cmd *PageCommand) PrintMeta(w io.Writer, buf []byte) error {
-	m := (*meta)(unsafe.Pointer(&buf[PageHeaderSize]))
-	fmt.Fprintf(w, "Version:    %d\n", m.version)
-	fmt.Fprintf(w, "Page Size:  %d bytes\n", m.pageSize)
-	fmt.Fprintf(w, "Flags:      %08x\n", m.flags)
-	fmt.Fprintf(w, "Root:       <pgid=%d>\n", m.root.root)
-	fmt.Fprintf(w, "Freelist:   <pgid=%d>\n", m.freelist)
-	fmt.Fprintf(w, "HWM:        <pgid=%d>\n", m.pgid)
-	fmt.Fprintf(w, "Txn ID:     %d\n", m.txid)
-	fmt.Fprintf(w, "Checksum:   %016x\n", m.checksum)
+	m := (*format.Meta)(unsafe.Pointer(&buf[PageHeaderSize]))
+	fmt.Fprintf(w, "Version:    %d\n", m.FormatVersion())
+	fmt.Fprintf(w, "Page Size:  %d bytes\n", m.PageSize)
+	fmt.Fprintf(w, "Flags:      %08x\n", m.Flags)
+	fmt.Fprintf(w, "Root:       <pgid=%d>\n", m.Root.Root)
+	fmt.Fprintf(w, "Freelist:   <pgid=%d>\n", m.Freelist)
+	fmt.Fprintf(w, "HWM:        <pgid=%d>\n", m.Pgid)
+	fmt.Fprintf(w, "Txn ID:     %d\n", m.Txid)
+	fmt.Fprintf(w, "Checksum:   %016x\n", m.Checksum)
 	fmt.Fprintf(w, "\n")
 	return nil
 }
 
 // PrintLeaf prints the data for a leaf page.
 func (cmd *PageCommand) PrintLeaf(w io.Writer, buf []byte) error {
-	p := (*page)(unsafe.Pointer(&buf[0]))
+	p := (*format.Page)(unsafe.Pointer(&buf[0]))
 
 	// Print number of items.
-	fmt.Fprintf(w, "Item Count: %d\n", p.count)
+	fmt.Fprintf(w, "Item Count: %d\n", p.Count)
 	fmt.Fprintf(w, "\n")
 
 	// Print each key/value.
-	for i := uint16(0); i < p.count; i++ {
-		e := p.leafPageElement(i)
+	for i := uint16(0); i < p.Count; i++ {
+		e := p.LeafPageElement(i)
 
 		// Format key as string.
 		var k string
-		if isPrintable(string(e.key())) {
-			k = fmt.Sprintf("%q", string(e.key()))
+		if isPrintable(string(e.Key())) {
+			k = fmt.Sprintf("%q", string(e.Key()))
 		} else {
-			k = fmt.Sprintf("%x", string(e.key()))
+			k = fmt.Sprintf("%x", string(e.Key()))
 		}
 
 		// Format value as string.
 		var v string
-		if (e.flags & uint32(bucketLeafFlag)) != 0 {
-			b := (*bucket)(unsafe.Pointer(&e.value()[0]))
-			v = fmt.Sprintf("<pgid=%d,seq=%d>", b.root, b.sequence)
-		} else if isPrintable(string(e.value())) {
-			v = fmt.Sprintf("%q", string(e.value()))
+		if (e.Flags & uint32(format.BucketLeafFlag)) != 0 {
+			b := (*format.Bucket)(unsafe.Pointer(&e.Value()[0]))
+			v = fmt.Sprintf("<pgid=%d,seq=%d>", b.Root, b.Sequence)
+		} else if isPrintable(string(e.Value())) {
+			v = fmt.Sprintf("%q", string(e.Value()))
 		} else {
-			v = fmt.Sprintf("%x", string(e.value()))
+			v = fmt.Sprintf("%x", string(e.Value()))
 		}
 
 		fmt.Fprintf(w, "%s: %s\n", k, v)
@@ -731,25 +850,25 @@ func (cmd *PageCommand) PrintLeaf(w io.Writer, buf []byte) error {
 
 // PrintBranch prints the data for a leaf page.
 func (cmd *PageCommand) PrintBranch(w io.Writer, buf []byte) error {
-	p := (*page)(unsafe.Pointer(&buf[0]))
+	p := (*format.Page)(unsafe.Pointer(&buf[0]))
 
 	// Print number of items.
-	fmt.Fprintf(w, "Item Count: %d\n", p.count)
+	fmt.Fprintf(w, "Item Count: %d\n", p.Count)
 	fmt.Fprintf(w, "\n")
 
 	// Print each key/value.
-	for i := uint16(0); i < p.count; i++ {
-		e := p.branchPageElement(i)
+	for i := uint16(0); i < p.Count; i++ {
+		e := p.BranchPageElement(i)
 
 		// Format key as string.
 		var k string
-		if isPrintable(string(e.key())) {
-			k = fmt.Sprintf("%q", string(e.key()))
+		if isPrintable(string(e.Key())) {
+			k = fmt.Sprintf("%q", string(e.Key()))
 		} else {
-			k = fmt.Sprintf("%x", string(e.key()))
+			k = fmt.Sprintf("%x", string(e.Key()))
 		}
 
-		fmt.Fprintf(w, "%s: <pgid=%d>\n", k, e.pgid)
+		fmt.Fprintf(w, "%s: <pgid=%d>\n", k, e.Pgid)
 	}
 	fmt.Fprintf(w, "\n")
 	return nil
@@ -757,25 +876,77 @@ func (cmd *PageCommand) PrintBranch(w io.Writer, buf []byte) error {
 
 // PrintFreelist prints the data for a freelist page.
 func (cmd *PageCommand) PrintFreelist(w io.Writer, buf []byte) error {
-	p := (*page)(unsafe.Pointer(&buf[0]))
-
-	// Check for overflow and, if present, adjust starting index and actual element count.
-	idx, count := 0, int(p.count)
-	if p.count == 0xFFFF {
-		idx = 1
-		count = int(((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[0])
+	p := (*format.Page)(unsafe.Pointer(&buf[0]))
+	if size := p.FreelistSize(); size > len(buf) {
+		return fmt.Errorf("page %d: freelist needs %d of %d bytes", p.ID, size, len(buf))
 	}
+	ids := p.FreelistIDs()
 
 	// Print number of items.
-	fmt.Fprintf(w, "Item Count: %d\n", count)
-	fmt.Fprintf(w, "Overflow: %d\n", p.overflow)
+	fmt.Fprintf(w, "Item Count: %d\n", len(ids))
+	fmt.Fprintf(w, "Overflow: %d\n", p.Overflow)
 
 	fmt.Fprintf(w, "\n")
 
 	// Print each page in the freelist.
-	ids := (*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr))
-	for i := idx; i < count; i++ {
-		fmt.Fprintf(w, "%d\n", ids[i])
+	for _, id := range ids {
+		fmt.Fprintf(w, "%d\n", id)
+	}
+	fmt.Fprintf(w, "\n")
+	return nil
+}
+
+// PrintFreelistDelta prints the data for a freelist delta page.
+func (cmd *PageCommand) PrintFreelistDelta(w io.Writer, buf []byte) error {
+	p := (*format.Page)(unsafe.Pointer(&buf[0]))
+	if size := p.FreelistSize(); size > len(buf) {
+		return fmt.Errorf("page %d: freelist delta needs %d of %d bytes", p.ID, size, len(buf))
+	}
+	d := p.FreelistDelta()
+	alloc, free := d.IDs()
+
+	fmt.Fprintf(w, "Previous:   <pgid=%d>\n", d.Prev)
+	fmt.Fprintf(w, "Txn ID:     %d\n", d.Txid)
+	fmt.Fprintf(w, "Depth:      %d\n", d.Depth)
+	fmt.Fprintf(w, "Overflow: %d\n", p.Overflow)
+	fmt.Fprintf(w, "\n")
+
+	// Print the pages taken off and added to the freelist.
+	fmt.Fprintf(w, "Allocated: %d\n", len(alloc))
+	for _, id := range alloc {
+		fmt.Fprintf(w, "%d\n", id)
+	}
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Freed: %d\n", len(free))
+	for _, id := range free {
+		fmt.Fprintf(w, "%d\n", id)
+	}
+	fmt.Fprintf(w, "\n")
+	return nil
+}
+
+// PrintFreelistHint prints the data for a freelist hint page.
+func (cmd *PageCommand) PrintFreelistHint(w io.Writer, buf []byte) error {
+	p := (*format.Page)(unsafe.Pointer(&buf[0]))
+	if size := p.FreelistSize(); size > len(buf) {
+		return fmt.Errorf("page %d: freelist hint needs %d of %d bytes", p.ID, size, len(buf))
+	}
+	h := p.FreelistHint()
+	ids := h.IDs()
+
+	fmt.Fprintf(w, "Txn ID:     %d\n", h.Txid)
+	fmt.Fprintf(w, "Checksum:   %016x", h.Checksum)
+	if h.Checksum != h.Sum64(ids) {
+		fmt.Fprintf(w, " (invalid)")
+	}
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Item Count: %d\n", len(ids))
+	fmt.Fprintf(w, "Overflow: %d\n", p.Overflow)
+	fmt.Fprintf(w, "\n")
+
+	// Print each page in the hint.
+	for _, id := range ids {
+		fmt.Fprintf(w, "%d\n", id)
 	}
 	fmt.Fprintf(w, "\n")
 	return nil
@@ -1749,13 +1920,7 @@ func isPrintable(s string) bool {
 
 // ReadPage reads page info & full page data from a path.
 // This is not transactionally safe.
-func ReadPage(path string, pageID int) (*page, []byte, error) {
-	// Find page size.
-	pageSize, err := ReadPageSize(path)
-	if err != nil {
-		return nil, nil, fmt.Errorf("read page size: %s", err)
-	}
-
+func ReadPage(path string, pageID int) (*format.Page, []byte, error) {
 	// Open database file.
 	f, err := os.Open(path)
 	if err != nil {
@@ -1763,28 +1928,12 @@ func ReadPage(path string, pageID int) (*page, []byte, error) {
 	}
 	defer f.Close()
 
-	// Read one block into buffer.
-	buf := make([]byte, pageSize)
-	if n, err := f.ReadAt(buf, int64(pageID*pageSize)); err != nil {
-		return nil, nil, err
-	} else if n != len(buf) {
-		return nil, nil, io.ErrUnexpectedEOF
-	}
-
-	// Determine total number of blocks.
-	p := (*page)(unsafe.Pointer(&buf[0]))
-	overflowN := p.overflow
-
-	// Re-read entire page (with overflow) into buffer.
-	buf = make([]byte, (int(overflowN)+1)*pageSize)
-	if n, err := f.ReadAt(buf, int64(pageID*pageSize)); err != nil {
-		return nil, nil, err
-	} else if n != len(buf) {
-		return nil, nil, io.ErrUnexpectedEOF
+	// Find page size.
+	pageSize, err := format.ReadPageSize(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read page size: %s", err)
 	}
-	p = (*page)(unsafe.Pointer(&buf[0]))
-
-	return p, buf, nil
+	return format.ReadPage(f, pageSize, format.Pgid(pageID))
 }
 
 // ReadPageSize reads page size a path.
@@ -1797,15 +1946,7 @@ func ReadPageSize(path string) (int, error) {
 	}
 	defer f.Close()
 
-	// Read 4KB chunk.
-	buf := make([]byte, 4096)
-	if _, err := io.ReadFull(f, buf); err != nil {
-		return 0, err
-	}
-
-	// Read page size from metadata.
-	m := (*meta)(unsafe.Pointer(&buf[PageHeaderSize]))
-	return int(m.pageSize), nil
+	return format.ReadPageSize(f)
 }
 
 // atois parses a slice of strings into integers.
@@ -1821,112 +1962,6 @@ func atois(strs []string) ([]int, error) {
 	return a, nil
 }
 
-// DO NOT EDIT. Copied from the "bolt" package.
-const maxAllocSize = 0xFFFFFFF
-
-// DO NOT EDIT. Copied from the "bolt" package.
-const (
-	branchPageFlag   = 0x01
-	leafPageFlag     = 0x02
-	metaPageFlag     = 0x04
-	freelistPageFlag = 0x10
-)
-
-// DO NOT EDIT. Copied from the "bolt" package.
-const bucketLeafFlag = 0x01
-
-// DO NOT EDIT. Copied from the "bolt" package.
-type pgid uint64
-
-// DO NOT EDIT. Copied from the "bolt" package.
-type txid uint64
-
-// DO NOT EDIT. Copied from the "bolt" package.
-type meta struct {
-	magic    uint32
-	version  uint32
-	pageSize uint32
-	flags    uint32
-	root     bucket
-	freelist pgid
-	pgid     pgid
-	txid     txid
-	checksum uint64
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-type bucket struct {
-	root     pgid
-	sequence uint64
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-type page struct {
-	id       pgid
-	flags    uint16
-	count    uint16
-	overflow uint32
-	ptr      uintptr
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-func (p *page) Type() string {
-	if (p.flags & branchPageFlag) != 0 {
-		return "branch"
-	} else if (p.flags & leafPageFlag) != 0 {
-		return "leaf"
-	} else if (p.flags & metaPageFlag) != 0 {
-		return "meta"
-	} else if (p.flags & freelistPageFlag) != 0 {
-		return "freelist"
-	}
-	return fmt.Sprintf("unknown<%02x>", p.flags)
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-func (p *page) leafPageElement(index uint16) *leafPageElement {
-	n := &((*[0x7FFFFFF]leafPageElement)(unsafe.Pointer(&p.ptr)))[index]
-	return n
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-func (p *page) branchPageElement(index uint16) *branchPageElement {
-	return &((*[0x7FFFFFF]branchPageElement)(unsafe.Pointer(&p.ptr)))[index]
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-type branchPageElement struct {
-	pos   uint32
-	ksize uint32
-	pgid  pgid
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-func (n *branchPageElement) key() []byte {
-	buf := (*[maxAllocSize]byte)(unsafe.Pointer(n))
-	return buf[n.pos : n.pos+n.ksize]
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-type leafPageElement struct {
-	flags uint32
-	pos   uint32
-	ksize uint32
-	vsize uint32
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-func (n *leafPageElement) key() []byte {
-	buf := (*[maxAllocSize]byte)(unsafe.Pointer(n))
-	return buf[n.pos : n.pos+n.ksize]
-}
-
-// DO NOT EDIT. Copied from the "bolt" package.
-func (n *leafPageElement) value() []byte {
-	buf := (*[maxAllocSize]byte)(unsafe.Pointer(n))
-	return buf[n.pos+n.ksize : n.pos+n.ksize+n.vsize]
-}
-
 // CompactCommand represents the "compact" command execution.
 type CompactCommand struct {
 	Stdin  io.Reader
@@ -1936,6 +1971,7 @@ type CompactCommand struct {
 	SrcPath   string
 	DstPath   string
 	TxMaxSize int64
+	PageSize  int
 }
 
 // newCompactCommand returns a CompactCommand.
@@ -1954,6 +1990,7 @@ func (cmd *CompactCommand) Run(args ...string) (err error) {
 	fs.SetOutput(ioutil.Discard)
 	fs.StringVar(&cmd.DstPath, "o", "", "")
 	fs.Int64Var(&cmd.TxMaxSize, "tx-max-size", 65536, "")
+	fs.IntVar(&cmd.PageSize, "page-size", 0, "")
 	if err := fs.Parse(args); err == flag.ErrHelp {
 		fmt.Fprintln(cmd.Stderr, cmd.Usage())
 		return ErrUsage
@@ -1986,14 +2023,19 @@ func (cmd *CompactCommand) Run(args ...string) (err error) {
 	defer src.Close()
 
 	// Open destination database.
-	dst, err := bolt.Open(cmd.DstPath, fi.Mode(), nil)
+	dst, err := bolt.Open(cmd.DstPath, fi.Mode(), &bolt.Options{PageSize: cmd.PageSize})
 	if err != nil {
 		return err
 	}
 	defer dst.Close()
 
-	// Run compaction.
-	if err := cmd.compact(dst, src); err != nil {
+	// Run compaction. Pages are filled completely, unless the page size is
+	// changed, in which case buckets keep their fill.
+	options := &bolt.CompactOptions{TxMaxSize: cmd.TxMaxSize, FillPercent: 1.0}
+	if cmd.PageSize != 0 {
+		options.FillPercent = 0
+	}
+	if err := bolt.Compact(dst, src, options); err != nil {
 		return err
 	}
 
@@ -2009,128 +2051,837 @@ func (cmd *CompactCommand) Run(args ...string) (err error) {
 	return nil
 }
 
-func (cmd *CompactCommand) compact(dst, src *bolt.DB) error {
-	// commit regularly, or we'll run out of memory for large datasets if using one transaction.
-	var size int64
-	tx, err := dst.Begin(true)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+// Usage returns the help message.
+func (cmd *CompactCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt compact [options] -o DST SRC
 
-	if err := cmd.walk(src, func(keys [][]byte, k, v []byte, seq uint64) error {
-		// On each key/value, check if we have exceeded tx size.
-		sz := int64(len(k) + len(v))
-		if size+sz > cmd.TxMaxSize && cmd.TxMaxSize != 0 {
-			// Commit previous transaction.
-			if err := tx.Commit(); err != nil {
-				return err
-			}
+Compact opens a database at SRC path and walks it recursively, copying keys
+as they are found from all buckets, to a newly created database at DST path.
+DST is then checked for consistency.
 
-			// Start new transaction.
-			tx, err = dst.Begin(true)
-			if err != nil {
-				return err
-			}
-			size = 0
-		}
-		size += sz
+The original database is left untouched.
 
-		// Create bucket on the root transaction if this is the first level.
-		nk := len(keys)
-		if nk == 0 {
-			bkt, err := tx.CreateBucket(k)
-			if err != nil {
-				return err
-			}
-			if err := bkt.SetSequence(seq); err != nil {
-				return err
-			}
-			return nil
-		}
+Additional options include:
 
-		// Create buckets on subsequent levels, if necessary.
-		b := tx.Bucket(keys[0])
-		if nk > 1 {
-			for _, k := range keys[1:] {
-				b = b.Bucket(k)
-			}
-		}
+	-tx-max-size NUM
+		Specifies the maximum size of individual transactions.
+		Defaults to 64KB.
 
-		// Fill the entire page for best compaction.
-		b.FillPercent = 1.0
+	-page-size NUM
+		Specifies the page size of DST. Buckets are filled as much as
+		they are in SRC, rather than completely.
+		Defaults to the operating system's page size.
+`, "\n")
+}
 
-		// If there is no value then this is a bucket call.
-		if v == nil {
-			bkt, err := b.CreateBucket(k)
-			if err != nil {
-				return err
-			}
-			if err := bkt.SetSequence(seq); err != nil {
-				return err
-			}
-			return nil
-		}
+// ConvertEndianCommand represents the "convert-endian" command execution.
+type ConvertEndianCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
 
-		// Otherwise treat it as a key/value pair.
-		return b.Put(k, v)
-	}); err != nil {
-		return err
+// newConvertEndianCommand returns a ConvertEndianCommand.
+func newConvertEndianCommand(m *Main) *ConvertEndianCommand {
+	return &ConvertEndianCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
 	}
-
-	return tx.Commit()
 }
 
-// walkFunc is the type of the function called for keys (buckets and "normal"
-// values) discovered by Walk. keys is the list of keys to descend to the bucket
-// owning the discovered key/value pair k/v.
-type walkFunc func(keys [][]byte, k, v []byte, seq uint64) error
-
-// walk walks recursively the bolt database db, calling walkFn for each key it finds.
-func (cmd *CompactCommand) walk(db *bolt.DB, walkFn walkFunc) error {
-	return db.View(func(tx *bolt.Tx) error {
-		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
-			return cmd.walkBucket(b, nil, name, nil, b.Sequence(), walkFn)
-		})
-	})
-}
+// Run executes the command.
+func (cmd *ConvertEndianCommand) Run(args ...string) error {
+	// Parse flags. The path may come before or after them.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	dstPath := fs.String("o", "", "")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	}
+	srcPath := fs.Arg(0)
+	if fs.NArg() > 1 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
 
-func (cmd *CompactCommand) walkBucket(b *bolt.Bucket, keypath [][]byte, k, v []byte, seq uint64, fn walkFunc) error {
-	// Execute callback.
-	if err := fn(keypath, k, v, seq); err != nil {
+	// Require a source database that exists and an output file that doesn't.
+	if srcPath == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if err != nil {
 		return err
 	}
+	if *dstPath == "" {
+		return fmt.Errorf("output file required")
+	} else if _, err := os.Stat(*dstPath); err == nil {
+		return fmt.Errorf("output file already exists")
+	}
 
-	// If this is not a bucket then stop.
-	if v != nil {
-		return nil
+	if err := copyFile(srcPath, *dstPath); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*dstPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	to, err := format.ConvertEndian(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	} else if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
 	}
 
-	// Iterate over each child key/value.
-	keypath = append(keypath, k)
-	return b.ForEach(func(k, v []byte) error {
-		if v == nil {
-			bkt := b.Bucket(k)
-			return cmd.walkBucket(bkt, keypath, k, nil, bkt.Sequence(), fn)
-		}
-		return cmd.walkBucket(b, keypath, k, v, b.Sequence(), fn)
-	})
+	if to == binary.BigEndian {
+		fmt.Fprintln(cmd.Stdout, "converted to big-endian")
+	} else {
+		fmt.Fprintln(cmd.Stdout, "converted to little-endian")
+	}
+	return nil
 }
 
 // Usage returns the help message.
-func (cmd *CompactCommand) Usage() string {
+func (cmd *ConvertEndianCommand) Usage() string {
 	return strings.TrimLeft(`
-usage: bolt compact [options] -o DST SRC
+usage: bolt convert-endian SRC -o DST
 
-Compact opens a database at SRC path and walks it recursively, copying keys
-as they are found from all buckets, to a newly created database at DST path.
+Convert-endian copies the database at SRC to a newly created database at DST
+path, converted to the other byte order: every page header, element and
+freelist reachable from the newest meta page is rewritten. Databases are
+written in the byte order of the host, and can only be opened on hosts with
+the same byte order.
 
-The original database is left untouched.
+The database at SRC must not be open by another process. The byte order the
+copy was converted to is printed.
+`, "\n")
+}
 
-Additional options include:
+// RecoverCommand represents the "recover" command execution.
+type RecoverCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
 
-	-tx-max-size NUM
-		Specifies the maximum size of individual transactions.
-		Defaults to 64KB.
-`, "\n")
+// newRecoverCommand returns a RecoverCommand.
+func newRecoverCommand(m *Main) *RecoverCommand {
+	return &RecoverCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *RecoverCommand) Run(args ...string) error {
+	// Parse flags. The source path may come before or after them.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	dstPath := fs.String("o", "", "")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	}
+	srcPath := fs.Arg(0)
+	if fs.NArg() > 1 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+	if *dstPath == "" {
+		return fmt.Errorf("output file required")
+	}
+
+	// Require a source database that exists and an output file that doesn't.
+	if srcPath == "" {
+		return ErrPathRequired
+	}
+	fi, err := os.Stat(srcPath)
+	if os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(*dstPath); err == nil {
+		return fmt.Errorf("output file already exists")
+	}
+
+	// Copy what can be read into the new database.
+	dst, err := bolt.Open(*dstPath, fi.Mode(), nil)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	report, err := bolt.Salvage(srcPath, dst, nil)
+	if err != nil {
+		return err
+	}
+
+	// Print what was lost along with a summary.
+	for _, e := range report.Lost {
+		fmt.Fprintln(cmd.Stdout, e)
+	}
+	if report.Txid == 0 {
+		fmt.Fprintln(cmd.Stdout, "no valid meta page")
+	}
+	if report.OrphanPageN > 0 {
+		fmt.Fprintf(cmd.Stdout, "copied %d unreached pages to %s\n", report.OrphanPageN, bolt.SalvageLostFound)
+	}
+	fmt.Fprintf(cmd.Stdout, "recovered %d buckets and %d keys from txid %d, %d errors\n",
+		report.BucketN, report.KeyN, report.Txid, len(report.Lost))
+	return dst.Close()
+}
+
+// Usage returns the help message.
+func (cmd *RecoverCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt recover SRC -o DST
+
+Recover reads the pages of a damaged database at SRC path directly, without
+opening it, and copies every bucket and key/value pair that can be read to a
+newly created database at DST path. Damaged pages and elements are skipped,
+and each is printed along with the bucket it belonged to.
+
+The newest valid meta page is used. If anything is damaged, leaf pages that
+can't be reached from it, or from either meta page if both are damaged, are
+copied to the "lost+found" bucket of DST, in a bucket per page named by its
+page id. The original database is left untouched.
+`, "\n")
+}
+
+// RevertMetaCommand represents the "revert-meta" command execution.
+type RevertMetaCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// newRevertMetaCommand returns a RevertMetaCommand.
+func newRevertMetaCommand(m *Main) *RevertMetaCommand {
+	return &RevertMetaCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *RevertMetaCommand) Run(args ...string) error {
+	// Parse flags.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	help := fs.Bool("h", false, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	// Require database path.
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	// Read the txid of the older meta page, ensuring it can be opened.
+	db, err := bolt.Open(path, 0666, &bolt.Options{UseOlderMeta: true})
+	if err != nil {
+		return err
+	}
+	var id int
+	_ = db.View(func(tx *bolt.Tx) error {
+		id = tx.ID()
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	if err := bolt.RevertMeta(path, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "reverted to txid %d\n", id)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *RevertMetaCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt revert-meta PATH
+
+Revert-meta rolls the database back to the state before its last committed
+transaction, by making the older of its two meta pages authoritative. The
+older state is only intact if nothing has been committed since; it can be
+inspected first by opening the database with Options.UseOlderMeta.
+
+Running revert-meta again, before anything else is committed, restores the
+rolled back transaction.
+`, "\n")
+}
+
+// UpgradeCommand represents the "upgrade" command execution.
+type UpgradeCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// newUpgradeCommand returns an UpgradeCommand.
+func newUpgradeCommand(m *Main) *UpgradeCommand {
+	return &UpgradeCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *UpgradeCommand) Run(args ...string) error {
+	// Parse flags. The path may come before or after them.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	dstPath := fs.String("o", "", "")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	}
+	path := fs.Arg(0)
+	if fs.NArg() > 1 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+
+	// Require database path.
+	if path == "" {
+		return ErrPathRequired
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Upgrade a copy instead of the database if requested.
+	if *dstPath != "" {
+		if _, err := os.Stat(*dstPath); err == nil {
+			return fmt.Errorf("output file already exists")
+		}
+		db, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		err = db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(*dstPath, fi.Mode())
+		})
+		_ = db.Close()
+		if err != nil {
+			return err
+		}
+		path = *dstPath
+	}
+
+	db, err := bolt.Open(path, 0666, &bolt.Options{Upgrade: true})
+	if err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	// Report the version now recorded in the file.
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pageSize, err := format.ReadPageSize(f)
+	if err != nil {
+		return err
+	}
+	m, err := format.ReadNewestMeta(f, pageSize)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "%s: version %d\n", path, m.FormatVersion())
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *UpgradeCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt upgrade PATH [-o DST]
+
+Upgrade upgrades a database written with an older version of the file format
+to the current version, in place. Databases of an older version can be read
+by the current version but not written until they are upgraded.
+
+If DST is given, the database is copied to a newly created database at DST
+path and the copy is upgraded instead, leaving the original untouched.
+
+The version the database ends up at is printed.
+`, "\n")
+}
+
+// SurgeryCommand represents the "surgery" command execution.
+type SurgeryCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// newSurgeryCommand returns a SurgeryCommand.
+func newSurgeryCommand(m *Main) *SurgeryCommand {
+	return &SurgeryCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *SurgeryCommand) Run(args ...string) error {
+	// Require a subcommand.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "copy-page":
+		return cmd.runCopyPage(args[1:]...)
+	case "clear-page-elements":
+		return cmd.runClearPageElements(args[1:]...)
+	case "free-page":
+		return cmd.runFreePage(args[1:]...)
+	case "set-bucket-root":
+		return cmd.runSetBucketRoot(args[1:]...)
+	default:
+		return ErrUnknownCommand
+	}
+}
+
+// parse parses the flags of a subcommand, which have been added to fs along
+// with the common ones. It returns the source and destination paths.
+func (cmd *SurgeryCommand) parse(fs *flag.FlagSet, args []string) (src, dst string, err error) {
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&dst, "o", "", "")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return "", "", ErrUsage
+	} else if err != nil {
+		return "", "", err
+	} else if dst == "" {
+		return "", "", fmt.Errorf("output file required")
+	}
+
+	// Require a source database that exists and an output file that doesn't.
+	if src = fs.Arg(0); src == "" {
+		return "", "", ErrPathRequired
+	} else if _, err := os.Stat(src); os.IsNotExist(err) {
+		return "", "", ErrFileNotFound
+	} else if err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return "", "", fmt.Errorf("output file already exists")
+	}
+	return src, dst, nil
+}
+
+// copyFile copies the database at src to dst, which is then operated on. The
+// database must not be locked by another process.
+func copyFile(src, dst string) error {
+	f, err := bolt.OSStorage{}.Open(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Lock(true, time.Nanosecond); err == bolt.ErrTimeout {
+		return ErrDatabaseLocked
+	} else if err != nil {
+		return err
+	}
+	defer func() { _ = f.Unlock() }()
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(f, 0, fi.Size())); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// check runs the "check" command on the operated on database.
+func (cmd *SurgeryCommand) check(path string) error {
+	return (&CheckCommand{Stdin: cmd.Stdin, Stdout: cmd.Stdout, Stderr: cmd.Stderr}).Run(path)
+}
+
+// runCopyPage executes the "surgery copy-page" subcommand.
+func (cmd *SurgeryCommand) runCopyPage(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	from := fs.Int("from-page", -1, "")
+	to := fs.Int("to-page", -1, "")
+	src, dst, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	} else if *from < 0 || *to < 0 {
+		return ErrPageIDRequired
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	f, err := openSurgeryFile(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p, buf, err := f.readPage(format.Pgid(*from))
+	if err != nil {
+		return err
+	} else if format.Pgid(*to) < 2 || format.Pgid(*to)+format.Pgid(p.Overflow) >= f.meta.Pgid {
+		return fmt.Errorf("page %d: out of bounds: %d", *to, f.meta.Pgid)
+	}
+	p.ID = format.Pgid(*to)
+	if err := f.writePage(buf); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "page %d copied to page %d\n", *from, *to)
+	return cmd.check(dst)
+}
+
+// runClearPageElements executes the "surgery clear-page-elements" subcommand.
+func (cmd *SurgeryCommand) runClearPageElements(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	id := fs.Int("page", -1, "")
+	from := fs.Int("from-index", 0, "")
+	to := fs.Int("to-index", -1, "")
+	src, dst, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	} else if *id < 0 {
+		return ErrPageIDRequired
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	f, err := openSurgeryFile(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p, buf, err := f.readPage(format.Pgid(*id))
+	if err != nil {
+		return err
+	} else if (p.Flags&format.BranchPageFlag) == 0 && (p.Flags&format.LeafPageFlag) == 0 {
+		return fmt.Errorf("page %d: invalid type: %s", *id, p.Type())
+	}
+	if *to < 0 {
+		*to = int(p.Count)
+	}
+	if *from < 0 || *from >= *to || *to > int(p.Count) {
+		return fmt.Errorf("invalid element range [%d, %d) of %d elements", *from, *to, p.Count)
+	}
+
+	// Rewrite the page with the remaining elements. Branch and leaf elements
+	// are the same size.
+	const elemSize = format.LeafPageElementSize
+	if _, e := p.CheckElements(len(buf)); e != nil {
+		return fmt.Errorf("page %d: %s", *id, e)
+	}
+	out := make([]byte, len(buf))
+	copy(out, buf[:PageHeaderSize])
+	np := (*format.Page)(unsafe.Pointer(&out[0]))
+	np.Count = p.Count - uint16(*to-*from)
+	off := PageHeaderSize + int(np.Count)*elemSize
+	for i, j := 0, 0; i < int(p.Count); i++ {
+		if i >= *from && i < *to {
+			continue
+		}
+		pos := uint32(off - (PageHeaderSize + j*elemSize))
+		if (p.Flags & format.BranchPageFlag) != 0 {
+			e, ne := p.BranchPageElement(uint16(i)), np.BranchPageElement(uint16(j))
+			*ne = *e
+			ne.Pos = pos
+			off += copy(out[off:], e.Key())
+		} else {
+			e, ne := p.LeafPageElement(uint16(i)), np.LeafPageElement(uint16(j))
+			*ne = *e
+			ne.Pos = pos
+			off += copy(out[off:], e.Key())
+			off += copy(out[off:], e.Value())
+		}
+		j++
+	}
+	if err := f.writePage(out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "elements [%d, %d) cleared from page %d\n", *from, *to, *id)
+	return cmd.check(dst)
+}
+
+// runFreePage executes the "surgery free-page" subcommand.
+func (cmd *SurgeryCommand) runFreePage(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	id := fs.Int("page", -1, "")
+	src, dst, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	} else if *id < 0 {
+		return ErrPageIDRequired
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	f, err := openSurgeryFile(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Free the page's overflow too.
+	freed, _, err := f.readPage(format.Pgid(*id))
+	if err != nil {
+		return err
+	} else if f.meta.Freelist == format.PgidNoFreelist {
+		return fmt.Errorf("freelist is not synced")
+	}
+	p, buf, err := f.readPage(f.meta.Freelist)
+	if err != nil {
+		return err
+	} else if p.Flags != format.FreelistPageFlag {
+		return fmt.Errorf("page %d: not a full freelist: %s; run \"bolt freelist rebuild\" first", p.ID, p.Type())
+	}
+
+	// Insert the page in order.
+	if size := p.FreelistSize(); size > len(buf) {
+		return fmt.Errorf("page %d: freelist needs %d of %d bytes", p.ID, size, len(buf))
+	}
+	ids := p.FreelistIDs()
+	i := 0
+	for i < len(ids) && ids[i] < format.Pgid(*id) {
+		i++
+	}
+	var add []format.Pgid
+	for n := format.Pgid(*id); n <= format.Pgid(*id)+format.Pgid(freed.Overflow); n++ {
+		if i+len(add) < len(ids) && ids[i+len(add)] == n {
+			return fmt.Errorf("page %d: already freed", n)
+		}
+		add = append(add, n)
+	}
+	ids = append(append(append([]format.Pgid{}, ids[:i]...), add...), ids[i:]...)
+	if !p.SetFreelistIDs(ids, len(buf)) {
+		return fmt.Errorf("no room in freelist; run \"bolt freelist rebuild\" instead")
+	}
+	if err := f.writePage(buf); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "%d pages freed from page %d\n", len(add), *id)
+	return cmd.check(dst)
+}
+
+// runSetBucketRoot executes the "surgery set-bucket-root" subcommand.
+func (cmd *SurgeryCommand) runSetBucketRoot(args ...string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	root := fs.Int("root", -1, "")
+	src, dst, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	} else if *root < 0 {
+		return ErrPageIDRequired
+	} else if fs.NArg() < 2 {
+		return ErrBucketRequired
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	f, err := openSurgeryFile(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if format.Pgid(*root) < 2 || format.Pgid(*root) >= f.meta.Pgid {
+		return fmt.Errorf("page %d: out of bounds: %d", *root, f.meta.Pgid)
+	}
+
+	// Find the leaf element holding the bucket, through its parents.
+	var buf []byte
+	var b *format.Bucket
+	id := f.meta.Root.Root
+	for _, name := range fs.Args()[1:] {
+		if b != nil && b.Root == 0 {
+			return fmt.Errorf("bucket is inline and has no subbuckets")
+		}
+		var p *format.Page
+		var i int
+		if p, buf, i, err = f.seek(id, []byte(name)); err != nil {
+			return err
+		}
+		e := p.LeafPageElement(uint16(i))
+		if (e.Flags&format.BucketLeafFlag) == 0 || e.Vsize < uint32(unsafe.Sizeof(format.Bucket{})) {
+			return ErrBucketNotFound
+		}
+		b = (*format.Bucket)(unsafe.Pointer(&e.Value()[0]))
+		id = b.Root
+	}
+	b.Root = format.Pgid(*root)
+	if err := f.writePage(buf); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "bucket root set to page %d\n", *root)
+	return cmd.check(dst)
+}
+
+// Usage returns the help message.
+func (cmd *SurgeryCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt surgery COMMAND [options] -o DST SRC [args]
+
+Surgery copies the database at SRC path to a newly created file at DST path,
+changes pages of the copy directly, then runs "bolt check" on it. The
+database at SRC is left untouched, and must not be open in another process.
+The newest meta page of the copy is used.
+
+These are low-level tools for repairing damaged databases. The changes are
+not checked beforehand and can damage the copy further.
+
+The commands are:
+
+    copy-page -from-page ID -to-page ID
+        Copy a page, along with its overflow, over another page.
+
+    clear-page-elements -page ID [-from-index N] [-to-index M]
+        Remove the elements from index N up to but not including index M
+        of a branch or leaf page. The indexes default to the whole page.
+
+    free-page -page ID
+        Add a page, along with its overflow, to the freelist. The freelist
+        must be synced and not be made of deltas.
+
+    set-bucket-root -root ID BUCKET [BUCKET...]
+        Set the root page of the bucket at the given path of bucket names.
+`, "\n")
+}
+
+// surgeryFile is a database file being changed by the surgery command.
+type surgeryFile struct {
+	*os.File
+	pageSize int
+	meta     *format.Meta // newest valid meta page
+}
+
+// openSurgeryFile opens the database file at path and reads its meta pages.
+func openSurgeryFile(path string) (*surgeryFile, error) {
+	pageSize, err := ReadPageSize(path)
+	if err != nil {
+		return nil, fmt.Errorf("read page size: %s", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, err := format.ReadNewestMeta(f, pageSize)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("no valid meta page: %s", err)
+	}
+	sf := &surgeryFile{File: f, pageSize: pageSize, meta: m}
+	return sf, nil
+}
+
+// readPage reads a page below the high water mark, along with its overflow.
+func (f *surgeryFile) readPage(id format.Pgid) (*format.Page, []byte, error) {
+	if id < 2 || id >= f.meta.Pgid {
+		return nil, nil, fmt.Errorf("page %d: out of bounds: %d", id, f.meta.Pgid)
+	}
+	p, buf, err := format.ReadPage(f, f.pageSize, id)
+	if err != nil {
+		return nil, nil, err
+	} else if id+format.Pgid(p.Overflow) >= f.meta.Pgid {
+		return nil, nil, fmt.Errorf("page %d: overflow out of bounds: %d", id, p.Overflow)
+	}
+	return p, buf, nil
+}
+
+// writePage writes a page at the id in its header and syncs it.
+func (f *surgeryFile) writePage(buf []byte) error {
+	p := (*format.Page)(unsafe.Pointer(&buf[0]))
+	if _, err := f.WriteAt(buf, int64(p.ID)*int64(f.pageSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// seek finds key in the tree rooted at page id. It returns the leaf page
+// holding it and the index of its element.
+func (f *surgeryFile) seek(id format.Pgid, key []byte) (*format.Page, []byte, int, error) {
+	for {
+		p, buf, err := f.readPage(id)
+		if err != nil {
+			return nil, nil, 0, err
+		} else if (p.Flags&format.BranchPageFlag) == 0 && (p.Flags&format.LeafPageFlag) == 0 {
+			return nil, nil, 0, fmt.Errorf("page %d: invalid type: %s", id, p.Type())
+		} else if _, e := p.CheckElements(len(buf)); e != nil {
+			return nil, nil, 0, fmt.Errorf("page %d: %s", id, e)
+		}
+
+		if (p.Flags & format.BranchPageFlag) != 0 {
+			if p.Count == 0 {
+				return nil, nil, 0, fmt.Errorf("page %d: empty branch page", id)
+			}
+			next := p.BranchPageElement(0).Pgid
+			for i := 1; i < int(p.Count); i++ {
+				e := p.BranchPageElement(uint16(i))
+				if bytes.Compare(e.Key(), key) > 0 {
+					break
+				}
+				next = e.Pgid
+			}
+			id = next
+			continue
+		}
+
+		for i := 0; i < int(p.Count); i++ {
+			if bytes.Equal(p.LeafPageElement(uint16(i)).Key(), key) {
+				return p, buf, i, nil
+			}
+		}
+		return nil, nil, 0, ErrBucketNotFound
+	}
 }
@@ -0,0 +1,188 @@
+package bbolt
+
+import "fmt"
+
+// CompactOptions represents the options that can be set when copying a
+// database with Compact.
+type CompactOptions struct {
+	// TxMaxSize is the number of bytes of keys and values written to the
+	// destination in each transaction. If zero, everything is written in a
+	// single transaction.
+	TxMaxSize int64
+
+	// FillPercent is the FillPercent of every bucket written to the
+	// destination. If zero, each bucket is filled like its leaf pages in the
+	// source are, as a fraction of their size.
+	FillPercent float64
+}
+
+// Compact copies every bucket, with its sequence, and every key/value pair of
+// src into dst. dst is usually a new database, and may have been opened with
+// a different Options.PageSize to rewrite src with another page size. With
+// the default options, buckets keep the fill of src whatever the page size.
+//
+// dst is checked with Tx.Check once everything is copied, and the first error
+// it reports is returned, along with how many more there are. Keys are
+// written in batches of normal transactions, so dst holds whatever was copied
+// if an error is returned part way.
+func Compact(dst, src *DB, options *CompactOptions) error {
+	if options == nil {
+		options = &CompactOptions{}
+	}
+	c := &compactor{dst: dst, options: options}
+
+	var err error
+	if c.tx, err = dst.Begin(true); err != nil {
+		return err
+	}
+	defer func() {
+		if c.tx != nil {
+			_ = c.tx.Rollback()
+		}
+	}()
+
+	if err := src.View(func(tx *Tx) error {
+		return tx.ForEach(func(name []byte, b *Bucket) error {
+			return c.bucket(b, nil, name)
+		})
+	}); err != nil {
+		return err
+	}
+	err = c.tx.Commit()
+	c.tx = nil
+	if err != nil {
+		return err
+	}
+
+	return dst.View(func(tx *Tx) error {
+		// Every error is read, so that the check has finished before the
+		// transaction closes.
+		var first error
+		var count int
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+			count++
+		}
+		if count > 1 {
+			return fmt.Errorf("%s (and %d more errors)", first, count-1)
+		}
+		return first
+	})
+}
+
+// compactor holds the state of a Compact call.
+type compactor struct {
+	dst     *DB
+	tx      *Tx
+	size    int64 // bytes written by tx
+	options *CompactOptions
+}
+
+// bucket copies the bucket src, named name, into the bucket at path in the
+// destination.
+func (c *compactor) bucket(src *Bucket, path [][]byte, name []byte) error {
+	parent, err := c.bucketAt(path)
+	if err != nil {
+		return err
+	}
+	var b *Bucket
+	if parent == nil {
+		b, err = c.tx.CreateBucket(name)
+	} else {
+		b, err = parent.CreateBucket(name)
+	}
+	if err != nil {
+		return err
+	} else if err := b.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	fillPercent := c.options.FillPercent
+	if fillPercent == 0 {
+		fillPercent = bucketFillPercent(src)
+	}
+	path = append(path[:len(path):len(path)], name)
+	b.FillPercent = fillPercent
+
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return c.bucket(src.Bucket(k), path, k)
+		}
+
+		// The bucket is looked up again once the transaction it was
+		// created in, or a sub-bucket, has been committed.
+		if b.tx != c.tx {
+			if b, err = c.bucketAt(path); err != nil {
+				return err
+			}
+			b.FillPercent = fillPercent
+		}
+		if err := b.Put(k, v); err != nil {
+			return err
+		}
+		return c.written(len(k) + len(v))
+	})
+}
+
+// bucketAt returns the bucket at path in the destination, or nil for the
+// root.
+func (c *compactor) bucketAt(path [][]byte) (*Bucket, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	b := c.tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			break
+		}
+		b = b.Bucket(name)
+	}
+	if b == nil {
+		return nil, ErrBucketNotFound
+	}
+	return b, nil
+}
+
+// written records that size bytes have been written to the destination,
+// committing the transaction once it has written TxMaxSize bytes.
+func (c *compactor) written(size int) error {
+	if c.size += int64(size); c.options.TxMaxSize == 0 || c.size < c.options.TxMaxSize {
+		return nil
+	}
+	if err := c.tx.Commit(); err != nil {
+		c.tx = nil
+		return err
+	}
+	c.size = 0
+	var err error
+	c.tx, err = c.dst.Begin(true)
+	return err
+}
+
+// bucketFillPercent returns the fraction of its leaf pages b uses, not
+// counting its sub-buckets, or DefaultFillPercent if it is inline or empty.
+func bucketFillPercent(b *Bucket) float64 {
+	if b.root == 0 {
+		return DefaultFillPercent
+	}
+	var used, size int
+	b.forEachPage(func(p *page, depth int) {
+		if (p.flags&leafPageFlag) == 0 || p.overflow != 0 {
+			return
+		}
+		size += b.tx.db.pageSize
+		used += pageHeaderSize
+		if p.count != 0 {
+			// As in Stats, the end of the last element's key/value covers
+			// the element headers, keys and values before it.
+			last := p.leafPageElement(p.count - 1)
+			used += leafPageElementSize*int(p.count-1) + int(last.pos+last.ksize+last.vsize)
+		}
+	})
+	if size == 0 {
+		return DefaultFillPercent
+	}
+	return float64(used) / float64(size)
+}
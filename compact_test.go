@@ -0,0 +1,129 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Ensure that a database can be copied into one with another page size,
+// keeping its bucket sequences and fill.
+func TestCompact_PageSize(t *testing.T) {
+	src := MustOpenWithOption(&bolt.Options{PageSize: 4096})
+	defer src.MustClose()
+	if err := src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.SetSequence(42); err != nil {
+			return err
+		}
+		for i := 0; i < 10000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 50)); err != nil {
+				return err
+			}
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		if err := sub.SetSequence(7); err != nil {
+			return err
+		}
+		return sub.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fillPercent := range []float64{0, 1} {
+		t.Run(fmt.Sprint(fillPercent), func(t *testing.T) {
+			dst := MustOpenWithOption(&bolt.Options{PageSize: 16384})
+			defer dst.MustClose()
+			if err := bolt.Compact(dst.DB, src.DB, &bolt.CompactOptions{TxMaxSize: 65536, FillPercent: fillPercent}); err != nil {
+				t.Fatal(err)
+			}
+			if dst.Info().PageSize != 16384 {
+				t.Fatalf("unexpected page size: %d", dst.Info().PageSize)
+			}
+
+			if err := dst.View(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				if b.Sequence() != 42 {
+					t.Fatalf("unexpected sequence: %d", b.Sequence())
+				} else if sub := b.Bucket([]byte("sub")); sub.Sequence() != 7 {
+					t.Fatalf("unexpected sub-bucket sequence: %d", sub.Sequence())
+				} else if v := sub.Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+					t.Fatalf("unexpected value: %q", v)
+				}
+				return src.View(func(srcTx *bolt.Tx) error {
+					srcFill, fill := leafFill(srcTx.Bucket([]byte("widgets"))), leafFill(b)
+					want := srcFill
+					if fillPercent != 0 {
+						want = fillPercent
+					}
+					if math.Abs(fill-want) > 0.1 {
+						t.Fatalf("unexpected fill: %.2f, source %.2f", fill, srcFill)
+					}
+					return nil
+				})
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Ensure that every error in a corrupted destination is reported once the
+// copy is checked.
+func TestCompact_CorruptDestination(t *testing.T) {
+	src := MustOpenDB()
+	defer src.MustClose()
+	if err := src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := MustOpenDB()
+	defer os.Remove(dst.f)
+	if err := dst.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"gadgets", "gizmos", "sprockets"} {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for _, k := range []string{"key-aaa", "key-bbb", "key-ccc"} {
+				if err := b.Put([]byte(k), []byte("value")); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	corruptDB(t, dst, []byte("key-bbb"), []byte("key-zzz"))
+
+	err := bolt.Compact(dst.DB, src.DB, nil)
+	if err == nil || !strings.Contains(err.Error(), "unsorted keys") || !strings.Contains(err.Error(), "and 2 more errors") {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := dst.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// leafFill returns the fraction of the leaf pages of b that is used.
+func leafFill(b *bolt.Bucket) float64 {
+	s := b.Stats()
+	return float64(s.LeafInuse) / float64(s.LeafAlloc)
+}
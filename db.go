@@ -3,26 +3,36 @@ package bbolt
 import (
 	"errors"
 	"fmt"
-	"hash/fnv"
-	"log"
 	"os"
 	"runtime"
 	"sort"
 	"sync"
 	"time"
 	"unsafe"
+
+	"go.etcd.io/bbolt/internal/format"
 )
 
 // The largest step that can be taken when remapping the mmap.
 const maxMmapStep = 1 << 30 // 1GB
 
 // The data file format version.
-const version = 2
+const version = format.Version
+
+// The data file format version of files using the features in meta.flags.
+const featureVersion = format.FeatureVersion
+
+// metaFlagFreelistDelta is set in meta.flags while the freelist on disk has
+// deltas, so that versions of Bolt that can't read them refuse the file.
+const metaFlagFreelistDelta = format.MetaFlagFreelistDelta
 
 // Represents a marker value to indicate that a file is a Bolt DB.
-const magic uint32 = 0xED0CDAED
+const magic = format.Magic
+
+const pgidNoFreelist = format.PgidNoFreelist
 
-const pgidNoFreelist pgid = 0xffffffffffffffff
+// The path of databases opened with OpenMemory.
+const memoryPath = ":memory:"
 
 // IgnoreNoSync specifies whether the NoSync field of a DB is ignored when
 // syncing changes to a file.  This is required as some operating systems,
@@ -35,6 +45,7 @@ const (
 	DefaultMaxBatchSize  int = 1000
 	DefaultMaxBatchDelay     = 10 * time.Millisecond
 	DefaultAllocSize         = 16 * 1024 * 1024
+	DefaultPageCacheSize     = 4096
 )
 
 // default page size for db is set to the OS page size.
@@ -53,6 +64,20 @@ const (
 	FreelistMapType = FreelistType("hashmap")
 )
 
+// AccessMode is how pages of the data file are accessed.
+type AccessMode string
+
+const (
+	// AccessModeMmap indicates pages are read directly from a read-only
+	// memory map of the data file. Keys and values are zero-copy slices of
+	// the map. This is the default.
+	AccessModeMmap = AccessMode("mmap")
+	// AccessModePread indicates pages are read with pread into a bounded LRU
+	// page cache, so the size of the database is not limited by the address
+	// space and the file does not count towards the process' mapped memory.
+	AccessModePread = AccessMode("pread")
+)
+
 // DB represents a collection of buckets persisted to a file on disk.
 // All data access is performed through transactions which can be obtained through the DB.
 // All the functions on DB will return a ErrDatabaseNotOpen if accessed before Open() is called.
@@ -80,6 +105,12 @@ type DB struct {
 	// re-sync during recovery.
 	NoFreelistSync bool
 
+	// When true and NoFreelistSync is set, Close writes the freelist just past
+	// the end of the data as a hint. The next Open uses the hint instead of
+	// re-syncing the freelist, as long as no transaction has been committed
+	// since it was written.
+	FreelistHint bool
+
 	// FreelistType sets the backend freelist type. There are two options. Array which is simple but endures
 	// dramatic performance degradation if database is large and framentation in freelist is common.
 	// The alternative one is using hashmap, it is faster in almost all circumstances
@@ -87,6 +118,17 @@ type DB struct {
 	// The default type is array
 	FreelistType FreelistType
 
+	// FreelistCheckpointInterval is the number of commits that append a delta
+	// of the pages they allocated and freed to the freelist on disk before a
+	// commit rewrites the whole freelist as a new checkpoint. This makes
+	// commits on databases with large freelists cheaper.
+	//
+	// While the freelist on disk has deltas, the file's version is marked as
+	// using optional features so that versions of Bolt that do not understand
+	// them return ErrVersionMismatch. If <=0, every commit rewrites the whole
+	// freelist, which keeps the file readable by them.
+	FreelistCheckpointInterval int
+
 	// When true, skips the truncate call when growing the database.
 	// Setting this to true is only safe on non-ext3/ext4 systems.
 	// Skipping truncation avoids preallocation of hard drive space and
@@ -120,10 +162,20 @@ type DB struct {
 	// of truncate() and fsync() when growing the data file.
 	AllocSize int
 
-	path     string
-	openFile func(string, int, os.FileMode) (*os.File, error)
-	file     *os.File
-	dataref  []byte // mmap'ed readonly, write throws SEGV
+	path    string
+	storage Storage
+
+	recoveryParallelism int
+	recoveryProgress    func(RecoveryProgress)
+	tracer              Tracer
+	logger              Logger
+
+	pageCache *pageCache // set when pages are read with pread instead of mmap
+
+	file     File
+	locked   bool       // the file is locked exclusively and recorded as such
+	mapping  *mapping   // current memory map, nil with AccessModePread
+	replaced []*mapping // replaced mappings still used by read transactions
 	data     *[maxMapSize]byte
 	datasz   int
 	filesz   int // current on disk file size
@@ -145,16 +197,22 @@ type DB struct {
 
 	rwlock   sync.Mutex   // Allows only one writer at a time.
 	metalock sync.Mutex   // Protects meta page access.
-	mmaplock sync.RWMutex // Protects mmap access during remapping.
+	mmaplock sync.RWMutex // Held shared by read transactions so Close waits for them.
 	statlock sync.RWMutex // Protects stats access.
 
 	ops struct {
-		writeAt func(b []byte, off int64) (n int, err error)
+		writeAt  func(b []byte, off int64) (n int, err error)
+		writevAt func(bufs [][]byte, off int64) (n, calls int, err error) // nil if unsupported
 	}
 
+	failpoints failpoints
+
 	// Read only mode.
 	// When true, Update() and Begin(true) return ErrDatabaseReadOnly immediately.
 	readOnly bool
+
+	// When true, the database is read at the meta page with the lower txid.
+	useOlderMeta bool
 }
 
 // Path returns the path to currently open database file.
@@ -188,6 +246,16 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	db.MmapFlags = options.MmapFlags
 	db.NoFreelistSync = options.NoFreelistSync
 	db.FreelistType = options.FreelistType
+	db.FreelistCheckpointInterval = options.FreelistCheckpointInterval
+	db.FreelistHint = options.FreelistHint
+	db.recoveryParallelism = options.RecoveryParallelism
+	db.recoveryProgress = options.OnRecoveryProgress
+	if db.tracer = options.Tracer; db.tracer == nil {
+		db.tracer = NopTracer{}
+	}
+	if db.logger = options.Logger; db.logger == nil {
+		db.logger = discardLogger{}
+	}
 
 	// Set default values for later DB operations.
 	db.MaxBatchSize = DefaultMaxBatchSize
@@ -195,19 +263,20 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	db.AllocSize = DefaultAllocSize
 
 	flag := os.O_RDWR
-	if options.ReadOnly {
+	if options.ReadOnly || options.UseOlderMeta {
 		flag = os.O_RDONLY
 		db.readOnly = true
 	}
+	db.useOlderMeta = options.UseOlderMeta
 
-	db.openFile = options.OpenFile
-	if db.openFile == nil {
-		db.openFile = os.OpenFile
+	db.storage = options.Storage
+	if db.storage == nil {
+		db.storage = OSStorage{OpenFile: options.OpenFile}
 	}
 
 	// Open data file and separate sync handler for metadata writes.
 	var err error
-	if db.file, err = db.openFile(path, flag|os.O_CREATE, mode); err != nil {
+	if db.file, err = db.storage.Open(path, flag|os.O_CREATE, mode); err != nil {
 		_ = db.close()
 		return nil, err
 	}
@@ -220,13 +289,29 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	// if !options.ReadOnly.
 	// The database file is locked using the shared lock (more than one process may
 	// hold a lock at the same time) otherwise (options.ReadOnly is set).
-	if err := flock(db, !db.readOnly, options.Timeout); err != nil {
-		_ = db.close()
-		return nil, err
+	// Read-only databases are not locked at all with options.NoLock.
+	if !db.readOnly || !options.NoLock {
+		if err := db.file.Lock(!db.readOnly, options.Timeout); err == ErrTimeout {
+			_ = db.close()
+			if h := readLockHolder(db.storage, path); h != nil {
+				return nil, &TimeoutError{Holder: *h}
+			}
+			return nil, err
+		} else if err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+	if !db.readOnly {
+		db.writeLockHolder(mode)
+		db.locked = true
 	}
 
 	// Default values for test hooks
 	db.ops.writeAt = db.file.WriteAt
+	if w, ok := db.file.(vectorWriterAt); ok {
+		db.ops.writevAt = w.WritevAt
+	}
 
 	if db.pageSize = options.PageSize; db.pageSize == 0 {
 		// Set the default page size to the OS page size.
@@ -234,10 +319,10 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	}
 
 	// Initialize the database if it doesn't exist.
-	if info, err := db.file.Stat(); err != nil {
+	if size, err := db.file.Size(); err != nil {
 		_ = db.close()
 		return nil, err
-	} else if info.Size() == 0 {
+	} else if size == 0 {
 		// Initialize new files with meta pages.
 		if err := db.init(); err != nil {
 			// clean up file descriptor on initialization fail
@@ -273,21 +358,56 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		},
 	}
 
+	// Read pages through a page cache instead of the mmap if requested.
+	if options.AccessMode == AccessModePread {
+		size := options.PageCacheSize
+		if size <= 0 {
+			size = DefaultPageCacheSize
+		}
+		db.pageCache = newPageCache(size)
+	}
+
 	// Memory map the data file.
 	if err := db.mmap(options.InitialMmapSize); err != nil {
 		_ = db.close()
 		return nil, err
 	}
 
+	// Unlike the newer one, the older meta page is not fallen back from.
+	if db.useOlderMeta {
+		if err := db.meta().validate(); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
 	if db.readOnly {
 		return db, nil
 	}
 
+	// Files using features unknown to this version can only be read, and
+	// files of an older version only read until they are upgraded.
+	if m := db.meta(); !m.format().Writable() {
+		_ = db.close()
+		return nil, ErrVersionMismatch
+	} else if m.formatVersion() < version && !options.Upgrade {
+		_ = db.close()
+		return nil, ErrUpgradeRequired
+	}
+
 	db.loadFreelist()
 
-	// Flush freelist when transitioning from no sync to sync so
-	// NoFreelistSync unaware boltdb can open the db later.
-	if !db.NoFreelistSync && !db.hasSyncedFreelist() {
+	if db.meta().formatVersion() < version {
+		if err := db.upgrade(); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
+	// Flush freelist when transitioning from no sync to sync, or from
+	// freelist deltas to full freelists, so NoFreelistSync and
+	// FreelistCheckpointInterval unaware boltdb can open the db later.
+	if !db.NoFreelistSync && (!db.hasSyncedFreelist() || (db.FreelistCheckpointInterval <= 0 && db.hasFreelistDeltas())) {
 		tx, err := db.Begin(true)
 		if tx != nil {
 			err = tx.Commit()
@@ -302,20 +422,97 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	return db, nil
 }
 
+// OpenMemory creates and opens a database that is kept in memory instead of in
+// a file. Its contents are lost when it is closed; use Tx.CopyFile, or
+// Tx.WriteTo with a file on disk, to keep a snapshot.
+// Passing in nil options will cause Bolt to open the database with the default options.
+// Options.Storage and Options.OpenFile are ignored.
+func OpenMemory(options *Options) (*DB, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+	o := *options
+	o.Storage = NewMemStorage()
+	return Open(memoryPath, 0600, &o)
+}
+
+// RevertMeta rolls the database at path back to the state before its last
+// committed transaction, by writing the contents of the older meta page over
+// it with a txid above the newer one. Reverting again restores the rolled
+// back transaction, as long as nothing has been committed in between.
+//
+// The database must not be open. Options.UseOlderMeta can be used to inspect
+// the state it will be reverted to first. Options.Storage, Options.OpenFile
+// and Options.Timeout are used to open and lock the file.
+func RevertMeta(path string, options *Options) error {
+	if options == nil {
+		options = DefaultOptions
+	}
+	storage := options.Storage
+	if storage == nil {
+		storage = OSStorage{OpenFile: options.OpenFile}
+	}
+	f, err := storage.Open(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Lock(true, options.Timeout); err != nil {
+		return err
+	}
+	defer func() { _ = f.Unlock() }()
+
+	// Read the page size from the first meta page as Open does, then both.
+	pageSize := defaultPageSize
+	if n, err := format.ReadPageSize(f); err == nil {
+		pageSize = n
+	}
+	newer, err := format.ReadMeta(f, pageSize, 0)
+	if err != nil {
+		return err
+	}
+	older, err := format.ReadMeta(f, pageSize, 1)
+	if err != nil {
+		return err
+	}
+	if older.Txid > newer.Txid {
+		newer, older = older, newer
+	}
+
+	// The older meta page's slot is the next one to be written.
+	m := *(*meta)(unsafe.Pointer(older))
+	m.txid = newer.Txid + 1
+	out := make([]byte, pageSize)
+	p := (*page)(unsafe.Pointer(&out[0]))
+	m.write(p)
+	if _, err := f.WriteAt(out, int64(p.id)*int64(pageSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
 // loadFreelist reads the freelist if it is synced, or reconstructs it
 // by scanning the DB if it is not synced. It assumes there are no
 // concurrent accesses being made to the freelist.
 func (db *DB) loadFreelist() {
 	db.freelistLoad.Do(func() {
+		start, source := time.Now(), "freelist"
 		db.freelist = newFreelist(db.FreelistType)
 		if !db.hasSyncedFreelist() {
-			// Reconstruct free list by scanning the DB.
-			db.freelist.readIDs(db.freepages())
+			// Reconstruct free list from the hint or by scanning the DB.
+			ids, ok := db.readFreelistHint()
+			source = "hint"
+			if !ok {
+				ids = db.freepages(db.recoveryParallelism, db.recoveryProgress)
+				source = "scan"
+			}
+			db.freelist.readIDs(ids)
 		} else {
-			// Read free list from freelist page.
-			db.freelist.read(db.page(db.meta().freelist))
+			// Read free list from freelist page and any deltas.
+			db.freelist.readLog(db.page(db.meta().freelist), db.page)
 		}
 		db.stats.FreePageN = db.freelist.free_count()
+		db.logger.Info("freelist loaded", "path", db.path, "source", source, "free", db.stats.FreePageN, "elapsed", time.Since(start))
 	})
 }
 
@@ -323,21 +520,48 @@ func (db *DB) hasSyncedFreelist() bool {
 	return db.meta().freelist != pgidNoFreelist
 }
 
+func (db *DB) hasFreelistDeltas() bool {
+	return db.hasSyncedFreelist() && (db.page(db.meta().freelist).flags&freelistDeltaPageFlag) != 0
+}
+
 // mmap opens the underlying memory-mapped file and initializes the meta references.
 // minsz is the minimum size that the new mmap can be.
-func (db *DB) mmap(minsz int) error {
-	db.mmaplock.Lock()
-	defer db.mmaplock.Unlock()
+func (db *DB) mmap(minsz int) (err error) {
+	if _, err := db.failpoint(FailpointMmap); err != nil {
+		return err
+	}
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			db.logger.Error("mmap failed", "path", db.path, "minsz", minsz, "err", err)
+			return
+		}
+		db.tracer.Remap(db.datasz, time.Since(start))
+		db.logger.Info("mmap", "path", db.path, "size", db.datasz, "elapsed", time.Since(start))
+	}()
+
+	if db.pageCache != nil {
+		return db.pread(minsz)
+	}
 
-	info, err := db.file.Stat()
+	// Files that can't be mapped again while a view of them is in use are
+	// unmapped first, so remapping them waits for read transactions to close
+	// and keeps them from beginning.
+	_, exclusive := db.file.(exclusiveMapper)
+	if exclusive {
+		db.mmaplock.Lock()
+		defer db.mmaplock.Unlock()
+	}
+
+	fsize, err := db.file.Size()
 	if err != nil {
 		return fmt.Errorf("mmap stat error: %s", err)
-	} else if int(info.Size()) < db.pageSize*2 {
+	} else if int(fsize) < db.pageSize*2 {
 		return fmt.Errorf("file size too small")
 	}
 
 	// Ensure the size is at least the minimum size.
-	var size = int(info.Size())
+	var size = int(fsize)
 	if size < minsz {
 		size = minsz
 	}
@@ -346,24 +570,53 @@ func (db *DB) mmap(minsz int) error {
 		return err
 	}
 
-	// Dereference all mmap references before unmapping.
+	// Dereference all mmap references of the writer, which always reads from
+	// the current mapping, before it is replaced.
 	if db.rwtx != nil {
 		db.rwtx.root.dereference()
 	}
 
-	// Unmap existing data before continuing.
-	if err := db.munmap(); err != nil {
-		return err
+	if exclusive {
+		if err := db.munmap(); err != nil {
+			return err
+		}
 	}
 
-	// Memory-map the data file as a byte slice.
-	if err := mmap(db, size); err != nil {
+	// Memory-map the data file as a byte slice. Otherwise the existing
+	// mapping is left in place for the read transactions still using it.
+	b, err := db.file.Map(size, db.MmapFlags)
+	if err != nil {
 		return err
 	}
+	m := &mapping{ref: b, data: (*[maxMapSize]byte)(unsafe.Pointer(&b[0]))}
 
-	// Save references to the meta pages.
+	// Switch to the new mapping, and the meta pages in it, while read
+	// transactions can't begin; the mmap lock already keeps them from it if
+	// the file is mapped exclusively. The old mapping is unmapped now if no
+	// read transaction uses it, or else by the last one to close.
+	if !exclusive {
+		db.metalock.Lock()
+	}
+	old := db.mapping
+	db.mapping = m
+	db.data = m.data
+	db.datasz = size
 	db.meta0 = db.page(0).meta()
 	db.meta1 = db.page(1).meta()
+	unmapOld := old != nil && old.readers == 0
+	if old != nil && !unmapOld {
+		db.replaced = append(db.replaced, old)
+	}
+	if !exclusive {
+		db.metalock.Unlock()
+	}
+	db.setSizeStats(size, int(fsize))
+
+	if unmapOld {
+		if err := db.file.Unmap(old.ref); err != nil {
+			return fmt.Errorf("unmap error: " + err.Error())
+		}
+	}
 
 	// Validate the meta pages. We only return an error if both meta pages fail
 	// validation, since meta0 failing validation means that it wasn't saved
@@ -377,9 +630,27 @@ func (db *DB) mmap(minsz int) error {
 	return nil
 }
 
-// munmap unmaps the data file from memory.
+// munmap unmaps the data file from memory, including the replaced mappings
+// that closing read transactions have not got round to unmapping.
 func (db *DB) munmap() error {
-	if err := munmap(db); err != nil {
+	var err error
+	for _, m := range db.replaced {
+		if e := db.file.Unmap(m.ref); e != nil && err == nil {
+			err = e
+		}
+	}
+	db.replaced = nil
+
+	// Unmap using the original byte slice, if we have mapped data.
+	if db.mapping != nil {
+		if e := db.file.Unmap(db.mapping.ref); e != nil && err == nil {
+			err = e
+		}
+		db.mapping = nil
+		db.data = nil
+		db.datasz = 0
+	}
+	if err != nil {
 		return fmt.Errorf("unmap error: " + err.Error())
 	}
 	return nil
@@ -396,8 +667,9 @@ func (db *DB) mmapSize(size int) (int, error) {
 		}
 	}
 
-	// Verify the requested size is not above the maximum allowed.
-	if size > maxMapSize {
+	// Verify the requested size is not above the maximum allowed. Without an
+	// mmap there is no maximum.
+	if size > maxMapSize && db.pageCache == nil {
 		return 0, fmt.Errorf("mmap too large")
 	}
 
@@ -415,7 +687,7 @@ func (db *DB) mmapSize(size int) (int, error) {
 	}
 
 	// If we've exceeded the max size then only grow up to the max size.
-	if sz > maxMapSize {
+	if sz > maxMapSize && db.pageCache == nil {
 		sz = maxMapSize
 	}
 
@@ -459,7 +731,7 @@ func (db *DB) init() error {
 	if _, err := db.ops.writeAt(buf, 0); err != nil {
 		return err
 	}
-	if err := fdatasync(db); err != nil {
+	if err := db.file.Sync(); err != nil {
 		return err
 	}
 
@@ -489,13 +761,22 @@ func (db *DB) close() error {
 
 	db.opened = false
 
+	// Leave a hint of the freelist for the next open if it is not synced.
+	if db.FreelistHint && db.NoFreelistSync && !db.readOnly && db.freelist != nil && !db.hasSyncedFreelist() {
+		if err := db.writeFreelistHint(); err != nil {
+			db.logger.Error("freelist hint write failed", "path", db.path, "err", err)
+		}
+	}
+
 	db.freelist = nil
 
 	// Clear ops.
 	db.ops.writeAt = nil
+	db.ops.writevAt = nil
 
 	// Close the mmap.
 	if err := db.munmap(); err != nil {
+		db.logger.Error("munmap failed", "path", db.path, "err", err)
 		return err
 	}
 
@@ -503,19 +784,25 @@ func (db *DB) close() error {
 	if db.file != nil {
 		// No need to unlock read-only file.
 		if !db.readOnly {
-			// Unlock the file.
-			if err := funlock(db); err != nil {
-				log.Printf("bolt.Close(): funlock error: %s", err)
+			// Unlock the file, once it is no longer recorded as locked.
+			if db.locked {
+				db.removeLockHolder()
+				db.locked = false
+			}
+			if err := db.file.Unlock(); err != nil {
+				db.logger.Error("funlock failed", "path", db.path, "err", err)
 			}
 		}
 
 		// Close the file descriptor.
 		if err := db.file.Close(); err != nil {
+			db.logger.Error("close failed", "path", db.path, "err", err)
 			return fmt.Errorf("db file close: %s", err)
 		}
 		db.file = nil
 	}
 
+	db.logger.Info("closed", "path", db.path)
 	db.path = ""
 	return nil
 }
@@ -526,14 +813,19 @@ func (db *DB) close() error {
 // will cause the calls to block and be serialized until the current write
 // transaction finishes.
 //
-// Transactions should not be dependent on one another. Opening a read
-// transaction and a write transaction in the same goroutine can cause the
-// writer to deadlock because the database periodically needs to re-mmap itself
-// as it grows and it cannot do that while a read transaction is open.
+// Transactions should not be dependent on one another. The database
+// periodically needs to re-mmap itself as it grows; read transactions keep
+// reading from the mapping they began with, which stays mapped until the last
+// of them closes, so they don't block the writer from remapping. A long
+// running read transaction (for example, a snapshot transaction) can hold on
+// to the address space of several superseded mappings, though, which
+// DB.InitialMmapSize can avoid if it is large enough.
 //
-// If a long running read transaction (for example, a snapshot transaction) is
-// needed, you might want to set DB.InitialMmapSize to a large enough value
-// to avoid potential blocking of write transaction.
+// On Windows a file can't be remapped while it is mapped, so the writer waits
+// for read transactions to close before remapping, and opening a read
+// transaction and a write transaction in the same goroutine can cause the
+// writer to deadlock. Set DB.InitialMmapSize large enough to avoid remapping
+// there if long running read transactions are needed.
 //
 // IMPORTANT: You must close read-only transactions after you are finished or
 // else the database will not reclaim old pages.
@@ -548,12 +840,14 @@ func (db *DB) beginTx() (*Tx, error) {
 	// Lock the meta pages while we initialize the transaction. We obtain
 	// the meta lock before the mmap lock because that's the order that the
 	// write transaction will obtain them.
+	start := time.Now()
 	db.metalock.Lock()
 
-	// Obtain a read-only lock on the mmap. When the mmap is remapped it will
-	// obtain a write lock so all transactions must finish before it can be
-	// remapped.
+	// Obtain a read-only lock on the mmap, which Close waits for. Remapping
+	// doesn't: the transaction keeps the mapping it begins with until it
+	// closes.
 	db.mmaplock.RLock()
+	wait := time.Since(start)
 
 	// Exit if the database is not open yet.
 	if !db.opened {
@@ -565,6 +859,10 @@ func (db *DB) beginTx() (*Tx, error) {
 	// Create a transaction associated with the database.
 	t := &Tx{}
 	t.init(db)
+	if db.mapping != nil {
+		t.mapping = db.mapping
+		t.mapping.readers++
+	}
 
 	// Keep track of transaction until it closes.
 	db.txs = append(db.txs, t)
@@ -577,8 +875,11 @@ func (db *DB) beginTx() (*Tx, error) {
 	db.statlock.Lock()
 	db.stats.TxN++
 	db.stats.OpenTxN = n
+	db.stats.ReadLockLatency.observe(wait)
 	db.statlock.Unlock()
 
+	db.tracer.LockWait(false, wait)
+	db.tracer.Begin(false, time.Since(start))
 	return t, nil
 }
 
@@ -590,7 +891,9 @@ func (db *DB) beginRWTx() (*Tx, error) {
 
 	// Obtain writer lock. This is released by the transaction when it closes.
 	// This enforces only one writer transaction at a time.
+	start := time.Now()
 	db.rwlock.Lock()
+	wait := time.Since(start)
 
 	// Once we have the writer lock then we can lock the meta pages so that
 	// we can set up the transaction.
@@ -608,6 +911,13 @@ func (db *DB) beginRWTx() (*Tx, error) {
 	t.init(db)
 	db.rwtx = t
 	db.freePages()
+
+	db.statlock.Lock()
+	db.stats.WriteLockLatency.observe(wait)
+	db.statlock.Unlock()
+
+	db.tracer.LockWait(true, wait)
+	db.tracer.Begin(true, time.Since(start))
 	return t, nil
 }
 
@@ -657,6 +967,23 @@ func (db *DB) removeTx(tx *Tx) {
 	}
 	n := len(db.txs)
 
+	// Unmap the mapping the transaction read from if it has been replaced
+	// and the transaction was the last to use it. Once the database is
+	// closed, close has unmapped it already.
+	if m := tx.mapping; m != nil {
+		if m.readers--; m.readers == 0 && m != db.mapping && db.opened {
+			for i, r := range db.replaced {
+				if r == m {
+					db.replaced = append(db.replaced[:i], db.replaced[i+1:]...)
+					break
+				}
+			}
+			if err := db.file.Unmap(m.ref); err != nil {
+				db.logger.Error("munmap failed", "path", db.path, "err", err)
+			}
+		}
+	}
+
 	// Unlock the meta pages.
 	db.metalock.Unlock()
 
@@ -827,6 +1154,11 @@ retry:
 			continue retry
 		}
 
+		b.db.statlock.Lock()
+		b.db.stats.BatchN++
+		b.db.stats.BatchCallN += len(b.calls)
+		b.db.statlock.Unlock()
+
 		// pass success, or bolt internal errors, to all callers
 		for _, c := range b.calls {
 			c.err <- err
@@ -864,7 +1196,36 @@ func safelyCall(fn func(*Tx) error, tx *Tx) (err error) {
 //
 // This is not necessary under normal operation, however, if you use NoSync
 // then it allows you to force the database file to sync against the disk.
-func (db *DB) Sync() error { return fdatasync(db) }
+func (db *DB) Sync() error { return db.file.Sync() }
+
+// SetFreelistSync changes whether the freelist is synced to disk and commits
+// a transaction that converts the data file to match. When enabling sync the
+// freelist is first recomputed from the pages reachable from the root bucket,
+// so this can also be used to rebuild a damaged or leaky freelist.
+//
+// Returns ErrDatabaseReadOnly if the database was opened in read-only mode.
+func (db *DB) SetFreelistSync(sync bool) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	// Pages still pending for open read transactions stay pending. The
+	// rebuilt freelist is written out in full rather than as a delta on top
+	// of the old one.
+	if sync {
+		db.freelist.noSyncReload(db.freepages(db.recoveryParallelism, nil))
+		tx.checkpoint = true
+	}
+
+	prev := db.NoFreelistSync
+	db.NoFreelistSync = !sync
+	if err := tx.Commit(); err != nil {
+		db.NoFreelistSync = prev
+		return err
+	}
+	return nil
+}
 
 // Stats retrieves ongoing performance stats for the database.
 // This is only updated when a transaction closes.
@@ -875,17 +1236,39 @@ func (db *DB) Stats() Stats {
 }
 
 // This is for internal access to the raw data bytes from the C cursor, use
-// carefully, or not at all.
+// carefully, or not at all. Data is zero when the database is opened with
+// AccessModePread.
 func (db *DB) Info() *Info {
+	if db.data == nil {
+		return &Info{0, db.pageSize}
+	}
 	return &Info{uintptr(unsafe.Pointer(&db.data[0])), db.pageSize}
 }
 
-// page retrieves a page reference from the mmap based on the current page size.
+// page retrieves a page reference from the mmap based on the current page size,
+// or from the page cache if the database was opened with AccessModePread.
 func (db *DB) page(id pgid) *page {
+	if db.pageCache != nil {
+		return db.readPage(id)
+	}
 	pos := id * pgid(db.pageSize)
 	return (*page)(unsafe.Pointer(&db.data[pos]))
 }
 
+// mapping is a memory map of the data file. A read transaction reads from the
+// mapping that was current when it began, so that the writer can replace it
+// with a larger one without waiting for the transaction to close.
+type mapping struct {
+	ref     []byte // mmap'ed readonly, write throws SEGV
+	data    *[maxMapSize]byte
+	readers int // open read transactions using the mapping; protected by metalock
+}
+
+// page retrieves a page reference from the mapping.
+func (m *mapping) page(id pgid, pageSize int) *page {
+	return (*page)(unsafe.Pointer(&m.data[id*pgid(pageSize)]))
+}
+
 // pageInBuffer retrieves a page reference from a given byte array based on the current page size.
 func (db *DB) pageInBuffer(b []byte, id pgid) *page {
 	return (*page)(unsafe.Pointer(&b[id*pgid(db.pageSize)]))
@@ -903,6 +1286,11 @@ func (db *DB) meta() *meta {
 		metaB = db.meta0
 	}
 
+	// Use the lower meta page if requested. Open ensures it is valid.
+	if db.useOlderMeta {
+		return metaB
+	}
+
 	// Use higher meta page if valid. Otherwise fallback to previous, if valid.
 	if err := metaA.validate(); err == nil {
 		return metaA
@@ -954,8 +1342,13 @@ func (db *DB) grow(sz int) error {
 		return nil
 	}
 
+	if _, err := db.failpoint(FailpointGrow); err != nil {
+		return err
+	}
+
 	// If the data is smaller than the alloc size then only allocate what's needed.
 	// Once it goes over the allocation size then allocate in chunks.
+	start := time.Now()
 	if db.datasz < db.AllocSize {
 		sz = db.datasz
 	} else {
@@ -967,52 +1360,37 @@ func (db *DB) grow(sz int) error {
 	if !db.NoGrowSync && !db.readOnly {
 		if runtime.GOOS != "windows" {
 			if err := db.file.Truncate(int64(sz)); err != nil {
+				db.logger.Error("grow failed", "path", db.path, "size", sz, "err", err)
 				return fmt.Errorf("file resize error: %s", err)
 			}
 		}
-		if err := db.file.Sync(); err != nil {
+		if err := db.sync(); err != nil {
+			db.logger.Error("grow sync failed", "path", db.path, "size", sz, "err", err)
 			return fmt.Errorf("file sync error: %s", err)
 		}
 	}
 
 	db.filesz = sz
+	db.tracer.Grow(sz, time.Since(start))
+	db.logger.Info("grow", "path", db.path, "size", sz, "elapsed", time.Since(start))
+	db.statlock.Lock()
+	if sz > db.stats.FileSize {
+		db.stats.FileSize = sz
+	}
+	db.statlock.Unlock()
 	return nil
 }
 
-func (db *DB) IsReadOnly() bool {
-	return db.readOnly
+// setSizeStats records the size of the mmap and of the data file.
+func (db *DB) setSizeStats(mmapSize, fileSize int) {
+	db.statlock.Lock()
+	db.stats.MmapSize = mmapSize
+	db.stats.FileSize = fileSize
+	db.statlock.Unlock()
 }
 
-func (db *DB) freepages() []pgid {
-	tx, err := db.beginTx()
-	defer func() {
-		err = tx.Rollback()
-		if err != nil {
-			panic("freepages: failed to rollback tx")
-		}
-	}()
-	if err != nil {
-		panic("freepages: failed to open read only tx")
-	}
-
-	reachable := make(map[pgid]*page)
-	nofreed := make(map[pgid]bool)
-	ech := make(chan error)
-	go func() {
-		for e := range ech {
-			panic(fmt.Sprintf("freepages: failed to get all reachable pages (%v)", e))
-		}
-	}()
-	tx.checkBucket(&tx.root, reachable, nofreed, ech)
-	close(ech)
-
-	var fids []pgid
-	for i := pgid(2); i < db.meta().pgid; i++ {
-		if _, ok := reachable[i]; !ok {
-			fids = append(fids, i)
-		}
-	}
-	return fids
+func (db *DB) IsReadOnly() bool {
+	return db.readOnly
 }
 
 // Options represents the options that can be set when opening a database.
@@ -1029,6 +1407,17 @@ type Options struct {
 	// under normal operation, but requires a full database re-sync during recovery.
 	NoFreelistSync bool
 
+	// Sets the DB.FreelistHint flag.
+	FreelistHint bool
+
+	// RecoveryParallelism is the number of goroutines used to scan for free
+	// pages when the freelist is not synced to disk. If <=0, GOMAXPROCS is used.
+	RecoveryParallelism int
+
+	// OnRecoveryProgress, if set, is called periodically while Open scans for
+	// free pages because the freelist is not synced to disk.
+	OnRecoveryProgress func(RecoveryProgress)
+
 	// FreelistType sets the backend freelist type. There are two options. Array which is simple but endures
 	// dramatic performance degradation if database is large and framentation in freelist is common.
 	// The alternative one is using hashmap, it is faster in almost all circumstances
@@ -1036,17 +1425,66 @@ type Options struct {
 	// The default type is array
 	FreelistType FreelistType
 
+	// Sets the DB.FreelistCheckpointInterval flag.
+	FreelistCheckpointInterval int
+
 	// Open database in read-only mode. Uses flock(..., LOCK_SH |LOCK_NB) to
 	// grab a shared lock (UNIX).
 	ReadOnly bool
 
+	// NoLock opens a read-only database without locking the data file, for
+	// files on read-only media where locks are meaningless or unavailable.
+	// Nothing stops another process from writing the file meanwhile. It is
+	// ignored unless ReadOnly or UseOlderMeta is set.
+	NoLock bool
+
+	// Upgrade upgrades a database written with an older version of the file
+	// format to the current version when it is opened. Without it, such a
+	// database can only be opened read-only, and other opens fail with
+	// ErrUpgradeRequired. To keep the original, copy it with Tx.CopyFile
+	// from a read-only open and upgrade the copy.
+	Upgrade bool
+
+	// UseOlderMeta opens the database at the older of its two meta pages,
+	// as it was before the last committed transaction. The database is
+	// opened read-only, as if ReadOnly were set. The older state is only
+	// intact if the pages it uses have not been reused since, which is the
+	// case until the next transaction commits; see RevertMeta.
+	UseOlderMeta bool
+
 	// Sets the DB.MmapFlags flag before memory mapping the file.
 	MmapFlags int
 
+	// Logger, if set, is told about significant events such as remapping
+	// and growing the data file, and errors that can't be returned.
+	Logger Logger
+
+	// Tracer, if set, is told the duration and size of each phase of
+	// beginning and committing transactions, and of remapping and growing
+	// the data file.
+	Tracer Tracer
+
+	// AccessMode sets how pages are read from the data file. The default,
+	// AccessModeMmap, memory maps the file. AccessModePread reads pages into
+	// a page cache instead, which lifts the limit on database size on 32-bit
+	// platforms and means the data file is never remapped.
+	//
+	// In AccessModePread keys and values point into cached copies of pages
+	// shared with other transactions rather than into the mmap. They follow
+	// the same rules: they must not be modified and are only valid for the
+	// life of the transaction.
+	AccessMode AccessMode
+
+	// PageCacheSize is the maximum number of pages held in the page cache
+	// when AccessMode is AccessModePread. Pages with overflow count once for
+	// each page they span. If <=0, DefaultPageCacheSize is used.
+	PageCacheSize int
+
 	// InitialMmapSize is the initial mmap size of the database
-	// in bytes. Read transactions won't block write transaction
-	// if the InitialMmapSize is large enough to hold database mmap
-	// size. (See DB.Begin for more information)
+	// in bytes. Long running read transactions won't keep old
+	// mappings alive, or block write transactions on Windows, if the
+	// InitialMmapSize is large enough to hold database mmap size.
+	// (See DB.Begin for more information)
 	//
 	// If <=0, the initial map size is 0.
 	// If initialMmapSize is smaller than the previous database size,
@@ -1062,8 +1500,12 @@ type Options struct {
 	NoSync bool
 
 	// OpenFile is used to open files. It defaults to os.OpenFile. This option
-	// is useful for writing hermetic tests.
+	// is useful for writing hermetic tests. It is ignored if Storage is set.
 	OpenFile func(string, int, os.FileMode) (*os.File, error)
+
+	// Storage is used to open the data file. It defaults to OSStorage. Use
+	// NewMemStorage to keep the database in memory.
+	Storage Storage
 }
 
 // DefaultOptions represent the options used if nil options are passed into Open().
@@ -1083,8 +1525,24 @@ type Stats struct {
 	FreelistInuse int // total bytes used by the freelist
 
 	// Transaction stats
-	TxN     int // total number of started read transactions
-	OpenTxN int // number of currently open read transactions
+	TxN       int // total number of started read transactions
+	OpenTxN   int // number of currently open read transactions
+	CommitN   int // total number of committed write transactions
+	RollbackN int // total number of rolled back write transactions
+
+	// Batch stats
+	BatchN     int // total number of batches run by DB.Batch
+	BatchCallN int // total number of calls run in those batches
+
+	// Size stats
+	MmapSize int // size of the mmap, or of the data read with AccessModePread
+	FileSize int // size of the data file
+
+	// Latency stats
+	CommitLatency    Histogram // time taken by each successful Tx.Commit
+	SyncLatency      Histogram // time taken by each sync of the data file
+	WriteLockLatency Histogram // time write transactions waited for the writer lock
+	ReadLockLatency  Histogram // time read transactions waited for the meta and mmap locks
 
 	TxStats TxStats // global, ongoing stats.
 }
@@ -1101,7 +1559,17 @@ func (s *Stats) Sub(other *Stats) Stats {
 	diff.PendingPageN = s.PendingPageN
 	diff.FreeAlloc = s.FreeAlloc
 	diff.FreelistInuse = s.FreelistInuse
+	diff.MmapSize = s.MmapSize
+	diff.FileSize = s.FileSize
 	diff.TxN = s.TxN - other.TxN
+	diff.CommitN = s.CommitN - other.CommitN
+	diff.RollbackN = s.RollbackN - other.RollbackN
+	diff.BatchN = s.BatchN - other.BatchN
+	diff.BatchCallN = s.BatchCallN - other.BatchCallN
+	diff.CommitLatency = s.CommitLatency.Sub(&other.CommitLatency)
+	diff.SyncLatency = s.SyncLatency.Sub(&other.SyncLatency)
+	diff.WriteLockLatency = s.WriteLockLatency.Sub(&other.WriteLockLatency)
+	diff.ReadLockLatency = s.ReadLockLatency.Sub(&other.ReadLockLatency)
 	diff.TxStats = s.TxStats.Sub(&other.TxStats)
 	return diff
 }
@@ -1125,14 +1593,28 @@ type meta struct {
 
 // validate checks the marker bytes and version of the meta page to ensure it matches this binary.
 func (m *meta) validate() error {
-	if m.magic != magic {
-		return ErrInvalid
-	} else if m.version != version {
-		return ErrVersionMismatch
-	} else if m.checksum != 0 && m.checksum != m.sum64() {
-		return ErrChecksum
+	// Older versions that can be upgraded are read as they are, as long as
+	// every feature they use is known.
+	if v := m.formatVersion(); m.magic == magic && v < version && upgradable(v) {
+		if !m.format().Writable() {
+			return ErrVersionMismatch
+		} else if m.checksum != 0 && m.checksum != m.sum64() {
+			return ErrChecksum
+		}
+		return nil
 	}
-	return nil
+	return m.format().Validate()
+}
+
+// formatVersion returns the format version of the file, whether or not it
+// uses optional features.
+func (m *meta) formatVersion() uint32 {
+	return m.format().FormatVersion()
+}
+
+// format returns the meta as its format package equivalent.
+func (m *meta) format() *format.Meta {
+	return (*format.Meta)(unsafe.Pointer(m))
 }
 
 // copy copies one meta object to another.
@@ -1149,6 +1631,12 @@ func (m *meta) write(p *page) {
 		panic(fmt.Sprintf("freelist pgid (%d) above high water mark (%d)", m.freelist, m.pgid))
 	}
 
+	// Files using optional features are marked with FeatureVersionFlag.
+	m.version = version
+	if m.flags != 0 {
+		m.version = featureVersion
+	}
+
 	// Page id is either going to be 0 or 1 which we can determine by the transaction ID.
 	p.id = pgid(m.txid % 2)
 	p.flags |= metaPageFlag
@@ -1161,9 +1649,7 @@ func (m *meta) write(p *page) {
 
 // generates the checksum for the meta.
 func (m *meta) sum64() uint64 {
-	var h = fnv.New64a()
-	_, _ = h.Write((*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))[:])
-	return h.Sum64()
+	return m.format().Sum64()
 }
 
 // _assert will panic with a given formatted message if the given condition is false.
@@ -13,12 +13,15 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 	"unsafe"
 
 	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/format"
 )
 
 var statsFlag = flag.Bool("stats", false, "show performance stats")
@@ -150,11 +153,11 @@ func TestOpen_ErrVersionMismatch(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Rewrite meta pages.
+	// Rewrite meta pages with a version from the future.
 	meta0 := (*meta)(unsafe.Pointer(&buf[pageHeaderSize]))
-	meta0.version++
+	meta0.version = 100
 	meta1 := (*meta)(unsafe.Pointer(&buf[pageSize+pageHeaderSize]))
-	meta1.version++
+	meta1.version = 100
 	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
 		t.Fatal(err)
 	}
@@ -342,247 +345,1191 @@ func TestOpen_Check(t *testing.T) {
 	if err = db.View(func(tx *bolt.Tx) error { return <-tx.Check() }); err != nil {
 		t.Fatal(err)
 	}
-	if err = db.Close(); err != nil {
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error { return <-tx.Check() }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that write errors to the meta file handler during initialization are returned.
+func TestOpen_MetaInitWriteError(t *testing.T) {
+	t.Skip("pending")
+}
+
+// Ensure that a database that is too small returns an error.
+func TestOpen_FileTooSmall(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := int64(db.Info().PageSize)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the database
+	if err = os.Truncate(path, pageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = bolt.Open(path, 0666, nil)
+	if err == nil || err.Error() != "file size too small" {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// TestDB_Open_InitialMmapSize tests if having InitialMmapSize large enough
+// to hold data from concurrent write transaction resolves the issue that
+// read transaction blocks the write transaction and causes deadlock.
+// This is a very hacky test since the mmap size is not exposed.
+func TestDB_Open_InitialMmapSize(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	initMmapSize := 1 << 30  // 1GB
+	testWriteSize := 1 << 27 // 134MB
+
+	db, err := bolt.Open(path, 0666, &bolt.Options{InitialMmapSize: initMmapSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create a long-running read transaction
+	// that never gets closed while writing
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create a write transaction
+	wtx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := wtx.CreateBucket([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and commit a large write
+	err = b.Put([]byte("foo"), make([]byte, testWriteSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		if err := wtx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-time.After(5 * time.Second):
+		t.Errorf("unexpected that the reader blocks writer")
+	case <-done:
+	}
+
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that an open read transaction doesn't block a write transaction that
+// remaps the database, and keeps reading from the mapping it began with, except
+// on Windows where the write transaction waits for it.
+func TestDB_Remap_OpenReadTx(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := rtx.Bucket([]byte("widgets")).Get([]byte("foo"))
+	data := db.Info().Data
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			if err := b.Put([]byte("foo"), []byte("baz")); err != nil {
+				return err
+			}
+			return b.Put([]byte("large"), make([]byte, 1<<22))
+		})
+	}()
+	if runtime.GOOS == "windows" {
+		// Files can't be remapped while they are mapped on Windows, so the
+		// remap waits for the read transaction instead.
+		select {
+		case <-done:
+			t.Fatal("remap didn't wait for read transaction")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if err := rtx.Rollback(); err != nil {
+			t.Fatal(err)
+		} else if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("remap blocked by read transaction")
+		}
+
+		// The read transaction still sees the old value through the old
+		// mapping.
+		if !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := rtx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if err := rtx.Rollback(); err != nil {
+			t.Fatal(err)
+		} else if db.Info().Data == data {
+			t.Fatal("expected the database to be remapped")
+		}
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("baz")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDB_Open_ReadOnly checks a database in read only mode can read but not write.
+func TestDB_Open_ReadOnly(t *testing.T) {
+	// Create a writable db, write k-v and close it.
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := db.f
+	o := &bolt.Options{ReadOnly: true}
+	readOnlyDB, err := bolt.Open(f, 0666, o)
+	if err != nil {
+		panic(err)
+	}
+
+	if !readOnlyDB.IsReadOnly() {
+		t.Fatal("expect db in read only mode")
+	}
+
+	// Read from a read-only transaction.
+	if err := readOnlyDB.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
+		if !bytes.Equal(value, []byte("bar")) {
+			t.Fatal("expect value 'bar', got", value)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Can't launch read-write transaction.
+	if _, err := readOnlyDB.Begin(true); err != bolt.ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := readOnlyDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOpen_BigPage checks the database uses bigger pages when
+// changing PageSize.
+func TestOpen_BigPage(t *testing.T) {
+	pageSize := os.Getpagesize()
+
+	db1 := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 2})
+	defer db1.MustClose()
+
+	db2 := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 4})
+	defer db2.MustClose()
+
+	if db1sz, db2sz := fileSize(db1.f), fileSize(db2.f); db1sz >= db2sz {
+		t.Errorf("expected %d < %d", db1sz, db2sz)
+	}
+}
+
+// TestOpen_RecoverFreeList tests opening the DB with free-list
+// write-out after no free list sync will recover the free list
+// and write it out.
+func TestOpen_RecoverFreeList(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer db.MustClose()
+
+	// Write some pages.
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wbuf := make([]byte, 8192)
+	for i := 0; i < 100; i++ {
+		s := fmt.Sprintf("%d", i)
+		b, err := tx.CreateBucket([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.Put([]byte(s), wbuf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Generate free pages.
+	if tx, err = db.Begin(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		s := fmt.Sprintf("%d", i)
+		b := tx.Bucket([]byte(s))
+		if b == nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Record freelist count from opening with NoFreelistSync.
+	db.MustReopen()
+	freepages := db.Stats().FreePageN
+	if freepages == 0 {
+		t.Fatalf("no free pages on NoFreelistSync reopen")
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check free page count is reconstructed when opened with freelist sync.
+	db.o = &bolt.Options{}
+	db.MustReopen()
+	// One less free page for syncing the free list on open.
+	freepages--
+	if fp := db.Stats().FreePageN; fp < freepages {
+		t.Fatalf("closed with %d free pages, opened with %d", freepages, fp)
+	}
+}
+
+// Ensure that opening a NoFreelistSync database reports recovery progress
+// and finds the same free pages regardless of the scan parallelism.
+func TestOpen_RecoverFreeList_Parallel(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer db.MustClose()
+
+	// Write nested buckets so there are subtrees to scan, then free some.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 20; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("%d", i)))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 5; j++ {
+				child, err := b.CreateBucket([]byte(fmt.Sprintf("%d", j)))
+				if err != nil {
+					return err
+				}
+				for k := 0; k < 50; k++ {
+					if err := child.Put(u64tob(uint64(k)), make([]byte, 200)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 20; i += 3 {
+			if err := tx.DeleteBucket([]byte(fmt.Sprintf("%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var freepages []int
+	for _, parallelism := range []int{1, 4} {
+		var calls int
+		var last bolt.RecoveryProgress
+		db.o = &bolt.Options{
+			NoFreelistSync:      true,
+			RecoveryParallelism: parallelism,
+			OnRecoveryProgress: func(p bolt.RecoveryProgress) {
+				calls++
+				last = p
+			},
+		}
+		db.MustReopen()
+		freepages = append(freepages, db.Stats().FreePageN)
+		if err := db.DB.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls == 0 {
+			t.Fatal("expected progress to be reported")
+		} else if !last.Done || last.ScannedN == 0 || last.ScannedN > last.PageN {
+			t.Fatalf("unexpected final progress: %+v", last)
+		}
+	}
+	if freepages[0] == 0 || freepages[0] != freepages[1] {
+		t.Fatalf("unexpected free pages: %v", freepages)
+	}
+	db.MustReopen()
+}
+
+// Ensure that a freelist hint is used on open only while it matches the meta.
+func TestOpen_RecoverFreeList_Hint(t *testing.T) {
+	var scans int
+	o := &bolt.Options{
+		NoFreelistSync: true,
+		FreelistHint:   true,
+		OnRecoveryProgress: func(p bolt.RecoveryProgress) {
+			if p.Done {
+				scans++
+			}
+		},
+	}
+	db := MustOpenWithOption(o)
+	defer db.MustClose()
+
+	// Write and then delete some data to generate free pages.
+	for _, del := range []bool{false, true} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			for i := 0; i < 50; i++ {
+				name := []byte(fmt.Sprintf("%d", i))
+				if del {
+					if err := tx.DeleteBucket(name); err != nil {
+						return err
+					}
+					continue
+				}
+				b, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(name, make([]byte, 8192)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if del {
+			break
+		}
+	}
+	freepages := db.Stats().FreePageN + db.Stats().PendingPageN
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening uses the hint instead of scanning.
+	db.MustReopen()
+	if scans != 0 {
+		t.Fatalf("expected hint to be used, got %d scans", scans)
+	} else if fp := db.Stats().FreePageN; fp != freepages {
+		t.Fatalf("closed with %d free pages, opened with %d", freepages, fp)
+	}
+
+	// A hint from an older transaction is ignored.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("new"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.DB.FreelistHint = false
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if scans != 1 {
+		t.Fatalf("expected a scan, got %d", scans)
+	}
+}
+
+// Ensure that a database committing freelist deltas reopens with the same
+// free pages, and writes a full freelist again once deltas are disabled.
+func TestOpen_FreelistDeltas(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{FreelistCheckpointInterval: 4})
+	defer db.MustClose()
+
+	// Grow and shrink buckets over enough commits to write several checkpoints.
+	for i := 0; i < 20; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("%d", i%5)))
+			if err != nil {
+				return err
+			}
+			if name := []byte(fmt.Sprintf("%d", (i+1)%5)); i%3 == 2 && tx.Bucket(name) != nil {
+				return tx.DeleteBucket(name)
+			}
+			for j := 0; j < 100; j++ {
+				if err := b.Put(u64tob(uint64(j)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.MustCheck()
+
+	// The last commit should have appended a delta.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for id := 2; ; id++ {
+			p, err := tx.Page(id)
+			if err != nil {
+				return err
+			} else if p == nil {
+				return errors.New("no freelist delta page found")
+			} else if p.Type == "freelist-delta" {
+				return nil
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	freepages := db.Stats().FreePageN
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files with deltas are marked so that older versions refuse them.
+	if m := mustReadMeta(db.f); m.Version != format.FeatureVersion || m.Flags != format.MetaFlagFreelistDelta {
+		t.Fatalf("unexpected version %d and flags %x", m.Version, m.Flags)
+	}
+
+	db.MustReopen()
+	if fp := db.Stats().FreePageN; fp != freepages {
+		t.Fatalf("closed with %d free pages, opened with %d", freepages, fp)
+	}
+	db.MustCheck()
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening without deltas writes out a checkpoint on open.
+	db.o = &bolt.Options{}
+	db.MustReopen()
+	db.MustCheck()
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m := mustReadMeta(db.f); m.Version != format.Version || m.Flags != 0 {
+		t.Fatalf("unexpected version %d and flags %x", m.Version, m.Flags)
+	}
+	db.MustReopen()
+}
+
+// mustReadMeta returns the newest meta page of the database file at path.
+func mustReadMeta(path string) *format.Meta {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	pageSize, err := format.ReadPageSize(f)
+	if err != nil {
+		panic(err)
+	}
+	m, err := format.ReadNewestMeta(f, pageSize)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Ensure that a database can be read through the page cache instead of the mmap.
+func TestOpen_AccessModePread(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{AccessMode: bolt.AccessModePread, PageCacheSize: 8})
+	defer db.MustClose()
+
+	put := func(n int, value []byte) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				if err := b.Put(u64tob(uint64(i)), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(1000, []byte("old"))
+
+	// A read transaction must keep seeing its snapshot while the pages it
+	// reads are evicted and rewritten.
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rtx.Rollback() }()
+	put(1000, []byte("new"))
+	put(1000, make([]byte, 3*4096))
+	if v := rtx.Bucket([]byte("widgets")).Get(u64tob(500)); string(v) != "old" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		if v := tx.Bucket([]byte("widgets")).Get(u64tob(999)); len(v) != 3*4096 {
+			t.Fatalf("unexpected value length: %d", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a timeout to lock the database reports the process holding
+// the lock.
+func TestOpen_LockHolder(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	_, err := bolt.Open(db.Path(), 0666, &bolt.Options{Timeout: 100 * time.Millisecond})
+	e, ok := err.(*bolt.TimeoutError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if e.Unwrap() != bolt.ErrTimeout {
+		t.Fatalf("unexpected unwrapped error: %v", e.Unwrap())
+	}
+	hostname, _ := os.Hostname()
+	if e.Holder.PID != os.Getpid() || e.Holder.Hostname != hostname {
+		t.Fatalf("unexpected holder: %+v", e.Holder)
+	} else if d := time.Since(e.Holder.Since); d < 0 || d > time.Minute {
+		t.Fatalf("unexpected holder since: %s", e.Holder.Since)
+	} else if !strings.Contains(e.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Fatalf("unexpected message: %s", e.Error())
+	}
+
+	// The lock file goes away with the lock, so a writer blocked by readers
+	// later gets plain ErrTimeout.
+	path := db.Path()
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected lock file: %v", err)
+	}
+	rdb, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	if _, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 100 * time.Millisecond}); err != bolt.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a read-only database can be opened without locking it.
+func TestOpen_NoLock(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bolt.Open(db.Path(), 0666, &bolt.Options{ReadOnly: true, Timeout: 100 * time.Millisecond}); err == nil {
+		t.Fatal("expected error")
+	}
+	rdb, err := bolt.Open(db.Path(), 0666, &bolt.Options{ReadOnly: true, NoLock: true, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	if err := rdb.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// NoLock is ignored for writers.
+	if _, err := bolt.Open(db.Path(), 0666, &bolt.Options{NoLock: true, Timeout: 100 * time.Millisecond}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure that a database can be read from an io.ReaderAt.
+func TestOpenReader(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rdb, err := bolt.OpenReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rdb.Begin(true); err != bolt.ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := rdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty or garbage reader isn't a database.
+	if _, err := bolt.OpenReader(bytes.NewReader(nil), 0); err != bolt.ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	garbage := make([]byte, 65536)
+	if _, err := bolt.OpenReader(bytes.NewReader(garbage), int64(len(garbage))); err != bolt.ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a database can be kept in in-memory storage.
+func TestOpen_MemStorage(t *testing.T) {
+	storage := bolt.NewMemStorage()
+	db, err := bolt.Open("test.db", 0666, &bolt.Options{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Grow the database past its initial mmap size while a reader is open.
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 1000)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}()
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// A second read-write handle cannot lock the file.
+	if _, err := bolt.Open("test.db", 0666, &bolt.Options{Storage: storage, Timeout: 100 * time.Millisecond}); err == nil {
+		t.Fatal("expected error")
+	} else if e, ok := err.(*bolt.TimeoutError); !ok || e.Holder.PID != os.Getpid() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Copy the database within the storage.
+	var buf bytes.Buffer
+	if err := db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&buf)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := storage.Open("copy.db", os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := f.WriteAt(buf.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both files hold the data after reopening.
+	for _, path := range []string{"test.db", "copy.db"} {
+		db, err := bolt.Open(path, 0666, &bolt.Options{Storage: storage})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.View(func(tx *bolt.Tx) error {
+			if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1000 {
+				t.Fatalf("%s: unexpected key count: %d", path, n)
+			}
+			for err := range tx.Check() {
+				t.Fatalf("%s: %s", path, err)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that a database can be opened read-only at its older meta page.
+func TestOpen_UseOlderMeta(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	putRevertKey(t, db, "1")
+	putRevertKey(t, db, "2")
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	older, err := bolt.Open(db.f, 0666, &bolt.Options{UseOlderMeta: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if !older.IsReadOnly() {
+		t.Fatal("expected read-only database")
+	}
+	if v := getRevertKey(t, older); v != "1" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if err := older.Update(func(*bolt.Tx) error { return nil }); err != bolt.ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := older.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.MustReopen()
+	if v := getRevertKey(t, db.DB); v != "2" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+// Ensure that RevertMeta rolls back the last committed transaction, and that
+// reverting again restores it.
+func TestRevertMeta(t *testing.T) {
+	t.Run("default", func(t *testing.T) { testRevertMeta(t, &bolt.Options{}) })
+	t.Run("NoFreelistSync", func(t *testing.T) { testRevertMeta(t, &bolt.Options{NoFreelistSync: true}) })
+}
+
+func testRevertMeta(t *testing.T, o *bolt.Options) {
+	db := MustOpenWithOption(o)
+	defer db.MustClose()
+	putRevertKey(t, db, "1")
+	putRevertKey(t, db, "2")
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bolt.RevertMeta(db.f, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if v := getRevertKey(t, db.DB); v != "1" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	// MustCheck would commit a transaction.
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bolt.RevertMeta(db.f, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if v := getRevertKey(t, db.DB); v != "2" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	db.MustCheck()
+
+	// The database keeps working after a revert.
+	for _, v := range []string{"3", "4", "5"} {
+		putRevertKey(t, db, v)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bolt.RevertMeta(db.f, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if v := getRevertKey(t, db.DB); v != "4" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+// putRevertKey commits v as the value of a key, with enough other data to
+// use several pages.
+func putRevertKey(t *testing.T, db *DB, v string) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put(u64tob(uint64(i)), bytes.Repeat([]byte(v), 100)); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("key"), []byte(v))
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getRevertKey(t *testing.T, db *bolt.DB) string {
+	var v string
+	if err := db.View(func(tx *bolt.Tx) error {
+		v = string(tx.Bucket([]byte("widgets")).Get([]byte("key")))
+		return nil
+	}); err != nil {
 		t.Fatal(err)
 	}
+	return v
+}
 
-	db, err = bolt.Open(path, 0666, nil)
+// Ensure that an in-memory database can be used and written out to disk.
+func TestOpenMemory(t *testing.T) {
+	db, err := bolt.OpenMemory(nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := db.View(func(tx *bolt.Tx) error { return <-tx.Check() }); err != nil {
-		t.Fatal(err)
-	}
-	if err := db.Close(); err != nil {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
 		t.Fatal(err)
 	}
-}
-
-// Ensure that write errors to the meta file handler during initialization are returned.
-func TestOpen_MetaInitWriteError(t *testing.T) {
-	t.Skip("pending")
-}
 
-// Ensure that a database that is too small returns an error.
-func TestOpen_FileTooSmall(t *testing.T) {
+	// Write a snapshot to disk.
 	path := tempfile()
-	defer os.RemoveAll(path)
-
-	db, err := bolt.Open(path, 0666, nil)
+	defer os.Remove(path)
+	f, err := os.Create(path)
 	if err != nil {
 		t.Fatal(err)
 	}
-	pageSize := int64(db.Info().PageSize)
-	if err = db.Close(); err != nil {
+	if err := db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	}); err != nil {
 		t.Fatal(err)
 	}
-
-	// corrupt the database
-	if err = os.Truncate(path, pageSize); err != nil {
+	if err := f.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	db, err = bolt.Open(path, 0666, nil)
-	if err == nil || err.Error() != "file size too small" {
-		t.Fatalf("unexpected error: %s", err)
-	}
-}
-
-// TestDB_Open_InitialMmapSize tests if having InitialMmapSize large enough
-// to hold data from concurrent write transaction resolves the issue that
-// read transaction blocks the write transaction and causes deadlock.
-// This is a very hacky test since the mmap size is not exposed.
-func TestDB_Open_InitialMmapSize(t *testing.T) {
-	path := tempfile()
-	defer os.Remove(path)
-
-	initMmapSize := 1 << 30  // 1GB
-	testWriteSize := 1 << 27 // 134MB
-
-	db, err := bolt.Open(path, 0666, &bolt.Options{InitialMmapSize: initMmapSize})
-	if err != nil {
+	// CopyFile writes to the file system rather than the memory.
+	copyPath := tempfile()
+	defer os.Remove(copyPath)
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(copyPath, 0600)
+	}); err != nil {
 		t.Fatal(err)
 	}
-
-	// create a long-running read transaction
-	// that never gets closed while writing
-	rtx, err := db.Begin(false)
-	if err != nil {
+	if err := db.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	// create a write transaction
-	wtx, err := db.Begin(true)
+	// A new in-memory database starts empty.
+	db, err = bolt.OpenMemory(nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	b, err := wtx.CreateBucket([]byte("test"))
-	if err != nil {
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("expected empty database")
+		}
+		return nil
+	}); err != nil {
 		t.Fatal(err)
 	}
-
-	// and commit a large write
-	err = b.Put([]byte("foo"), make([]byte, testWriteSize))
-	if err != nil {
+	if err := db.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	done := make(chan struct{})
-
-	go func() {
-		if err := wtx.Commit(); err != nil {
+	// The snapshots hold the data.
+	for _, path := range []string{path, copyPath} {
+		db, err = bolt.Open(path, 0666, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.View(func(tx *bolt.Tx) error {
+			if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1000 {
+				t.Fatalf("%s: unexpected key count: %d", path, n)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
 			t.Fatal(err)
 		}
-		done <- struct{}{}
-	}()
-
-	select {
-	case <-time.After(5 * time.Second):
-		t.Errorf("unexpected that the reader blocks writer")
-	case <-done:
-	}
-
-	if err := rtx.Rollback(); err != nil {
-		t.Fatal(err)
 	}
 }
 
-// TestDB_Open_ReadOnly checks a database in read only mode can read but not write.
-func TestDB_Open_ReadOnly(t *testing.T) {
-	// Create a writable db, write k-v and close it.
-	db := MustOpenDB()
+// Ensure that a database can be converted between synced and unsynced
+// freelists.
+func TestDB_SetFreelistSync(t *testing.T) {
+	var scans int
+	progress := func(p bolt.RecoveryProgress) {
+		if p.Done {
+			scans++
+		}
+	}
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true, OnRecoveryProgress: progress})
 	defer db.MustClose()
 
+	// Write and then delete some data to generate free pages.
 	if err := db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte("widgets"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
-			t.Fatal(err)
+		for i := 0; i < 50; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("%d", i)))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("k"), make([]byte, 8192)); err != nil {
+				return err
+			}
 		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
-	if err := db.DB.Close(); err != nil {
-		t.Fatal(err)
-	}
-
-	f := db.f
-	o := &bolt.Options{ReadOnly: true}
-	readOnlyDB, err := bolt.Open(f, 0666, o)
-	if err != nil {
-		panic(err)
-	}
-
-	if !readOnlyDB.IsReadOnly() {
-		t.Fatal("expect db in read only mode")
-	}
-
-	// Read from a read-only transaction.
-	if err := readOnlyDB.View(func(tx *bolt.Tx) error {
-		value := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
-		if !bytes.Equal(value, []byte("bar")) {
-			t.Fatal("expect value 'bar', got", value)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 50; i += 2 {
+			if err := tx.DeleteBucket([]byte(fmt.Sprintf("%d", i))); err != nil {
+				return err
+			}
 		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Can't launch read-write transaction.
-	if _, err := readOnlyDB.Begin(true); err != bolt.ErrDatabaseReadOnly {
-		t.Fatalf("unexpected error: %s", err)
+	// Persist the freelist; reopening then reads it instead of scanning.
+	if err := db.SetFreelistSync(true); err != nil {
+		t.Fatal(err)
+	} else if db.NoFreelistSync {
+		t.Fatal("expected freelist sync to be enabled")
 	}
-
-	if err := readOnlyDB.Close(); err != nil {
+	db.MustCheck()
+	freepages := db.Stats().FreePageN + db.Stats().PendingPageN
+	if err := db.DB.Close(); err != nil {
 		t.Fatal(err)
 	}
-}
-
-// TestOpen_BigPage checks the database uses bigger pages when
-// changing PageSize.
-func TestOpen_BigPage(t *testing.T) {
-	pageSize := os.Getpagesize()
-
-	db1 := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 2})
-	defer db1.MustClose()
-
-	db2 := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 4})
-	defer db2.MustClose()
+	db.MustReopen()
+	if scans != 0 {
+		t.Fatalf("expected synced freelist, got %d scans", scans)
+	} else if fp := db.Stats().FreePageN; fp != freepages {
+		t.Fatalf("closed with %d free pages, opened with %d", freepages, fp)
+	}
 
-	if db1sz, db2sz := fileSize(db1.f), fileSize(db2.f); db1sz >= db2sz {
-		t.Errorf("expected %d < %d", db1sz, db2sz)
+	// Drop the freelist again; reopening must scan.
+	if err := db.SetFreelistSync(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if scans != 1 {
+		t.Fatalf("expected one scan, got %d", scans)
 	}
 }
 
-// TestOpen_RecoverFreeList tests opening the DB with free-list
-// write-out after no free list sync will recover the free list
-// and write it out.
-func TestOpen_RecoverFreeList(t *testing.T) {
-	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+// Ensure that the freelist sync mode cannot be changed on a read-only database.
+// Ensure that a freelist rebuilt while committing freelist deltas is written
+// out as a checkpoint rather than a delta on top of the old freelist.
+func TestDB_SetFreelistSync_Deltas(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{FreelistCheckpointInterval: 8})
 	defer db.MustClose()
 
-	// Write some pages.
-	tx, err := db.Begin(true)
-	if err != nil {
-		t.Fatal(err)
-	}
-	wbuf := make([]byte, 8192)
-	for i := 0; i < 100; i++ {
-		s := fmt.Sprintf("%d", i)
-		b, err := tx.CreateBucket([]byte(s))
-		if err != nil {
-			t.Fatal(err)
-		}
-		if err = b.Put([]byte(s), wbuf); err != nil {
+	for i := 0; i < 3; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("k"), make([]byte, 8192))
+		}); err != nil {
 			t.Fatal(err)
 		}
 	}
-	if err = tx.Commit(); err != nil {
+	if err := db.DB.Close(); err != nil {
 		t.Fatal(err)
 	}
+	if m := mustReadMeta(db.f); m.Flags != format.MetaFlagFreelistDelta {
+		t.Fatalf("expected freelist deltas, got flags %x", m.Flags)
+	}
 
-	// Generate free pages.
-	if tx, err = db.Begin(true); err != nil {
+	db.MustReopen()
+	if err := db.SetFreelistSync(true); err != nil {
 		t.Fatal(err)
 	}
-	for i := 0; i < 50; i++ {
-		s := fmt.Sprintf("%d", i)
-		b := tx.Bucket([]byte(s))
-		if b == nil {
-			t.Fatal(err)
-		}
-		if err := b.Delete([]byte(s)); err != nil {
-			t.Fatal(err)
-		}
+	freepages := db.Stats().FreePageN + db.Stats().PendingPageN
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
 	}
-	if err := tx.Commit(); err != nil {
+
+	// The newest meta refers to a plain freelist page.
+	m := mustReadMeta(db.f)
+	if m.Flags != 0 {
+		t.Fatalf("unexpected flags %x", m.Flags)
+	}
+	f, err := os.Open(db.f)
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := db.DB.Close(); err != nil {
+	defer f.Close()
+	if p, _, err := format.ReadPage(f, int(m.PageSize), m.Freelist); err != nil {
 		t.Fatal(err)
+	} else if p.Type() != "freelist" {
+		t.Fatalf("unexpected freelist page type: %s", p.Type())
 	}
 
-	// Record freelist count from opening with NoFreelistSync.
 	db.MustReopen()
-	freepages := db.Stats().FreePageN
-	if freepages == 0 {
-		t.Fatalf("no free pages on NoFreelistSync reopen")
+	if fp := db.Stats().FreePageN; fp != freepages {
+		t.Fatalf("closed with %d free pages, opened with %d", freepages, fp)
 	}
+}
+
+func TestDB_SetFreelistSync_ReadOnly(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
 	if err := db.DB.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	// Check free page count is reconstructed when opened with freelist sync.
-	db.o = &bolt.Options{}
-	db.MustReopen()
-	// One less free page for syncing the free list on open.
-	freepages--
-	if fp := db.Stats().FreePageN; fp < freepages {
-		t.Fatalf("closed with %d free pages, opened with %d", freepages, fp)
+	readOnlyDB, err := bolt.Open(db.f, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnlyDB.Close()
+
+	if err := readOnlyDB.SetFreelistSync(false); err != bolt.ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
 	}
 }
 
@@ -1004,6 +1951,22 @@ func TestDB_Stats(t *testing.T) {
 	} else if stats.PendingPageN != 2 {
 		t.Fatalf("unexpected PendingPageN != 2: %d", stats.PendingPageN)
 	}
+
+	// Latencies are recorded for the commit, its two syncs and the writer
+	// lock, and for the read transaction's locks.
+	if err := db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	stats = db.Stats()
+	if stats.CommitLatency.Count != 1 || stats.CommitLatency.Max <= 0 {
+		t.Fatalf("unexpected CommitLatency: %d, %s", stats.CommitLatency.Count, stats.CommitLatency.Max)
+	} else if stats.SyncLatency.Count < 2 {
+		t.Fatalf("unexpected SyncLatency.Count: %d", stats.SyncLatency.Count)
+	} else if stats.WriteLockLatency.Count != 1 || stats.ReadLockLatency.Count != 1 {
+		t.Fatalf("unexpected lock latency counts: %d, %d", stats.WriteLockLatency.Count, stats.ReadLockLatency.Count)
+	} else if p := stats.CommitLatency.Quantile(0.99); p <= 0 || p > stats.CommitLatency.Max {
+		t.Fatalf("unexpected CommitLatency p99: %s", p)
+	}
 }
 
 // Ensure that database pages are in expected order and type.
@@ -1090,6 +2053,22 @@ func TestDBStats_Sub(t *testing.T) {
 	if diff.FreePageN != 14 {
 		t.Fatalf("unexpected FreePageN: %d", diff.FreePageN)
 	}
+
+	// latency histograms are subtracted
+	db := MustOpenDB()
+	defer db.MustClose()
+	before := db.Stats()
+	for i := 0; i < 3; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after := db.Stats()
+	if diff := after.Sub(&before); diff.CommitLatency.Count != 3 || diff.WriteLockLatency.Count != 3 {
+		t.Fatalf("unexpected latency counts: %d, %d", diff.CommitLatency.Count, diff.WriteLockLatency.Count)
+	} else if diff.CommitLatency.Max > after.CommitLatency.Max || diff.CommitLatency.Sum != after.CommitLatency.Sum-before.CommitLatency.Sum {
+		t.Fatalf("unexpected CommitLatency: %s, %s", diff.CommitLatency.Max, diff.CommitLatency.Sum)
+	}
 }
 
 // Ensure two functions can perform updates in a single batch.
@@ -39,6 +39,11 @@ Keys and values retrieved from the database are only valid for the life of
 the transaction. When used outside the transaction, these byte slices can
 point to different data or can point to invalid memory which will cause a panic.
 
+When opened with AccessModePread the data file is not memory-mapped. Pages are
+read into a page cache instead and keys and values point into cached pages
+that are shared between transactions. The same rules apply: they must not be
+changed, and they are only valid for the life of the transaction.
+
 
 */
 package bbolt
@@ -1,6 +1,10 @@
 package bbolt
 
-import "errors"
+import (
+	"errors"
+
+	"go.etcd.io/bbolt/internal/format"
+)
 
 // These errors can be returned when opening or calling methods on a DB.
 var (
@@ -14,17 +18,28 @@ var (
 
 	// ErrInvalid is returned when both meta pages on a database are invalid.
 	// This typically occurs when a file is not a bolt database.
-	ErrInvalid = errors.New("invalid database")
+	ErrInvalid = format.ErrInvalid
 
 	// ErrVersionMismatch is returned when the data file was created with a
 	// different version of Bolt.
-	ErrVersionMismatch = errors.New("version mismatch")
+	ErrVersionMismatch = format.ErrVersionMismatch
+
+	// ErrUpgradeRequired is returned when a database written with an older
+	// version of the file format is opened for writing without
+	// Options.Upgrade.
+	ErrUpgradeRequired = errors.New("database requires upgrade")
 
 	// ErrChecksum is returned when either meta page checksum does not match.
-	ErrChecksum = errors.New("checksum error")
+	ErrChecksum = format.ErrChecksum
+
+	// ErrEndianMismatch is returned when the data file was written on a host
+	// with the other byte order. It can be converted with the
+	// "bbolt convert-endian" command.
+	ErrEndianMismatch = format.ErrEndianMismatch
 
 	// ErrTimeout is returned when a database cannot obtain an exclusive lock
-	// on the data file after the timeout passed to Open().
+	// on the data file after the timeout passed to Open(). Open returns a
+	// *TimeoutError, which unwraps to it, when the lock holder is known.
 	ErrTimeout = errors.New("timeout")
 )
 
@@ -41,6 +56,10 @@ var (
 	// ErrDatabaseReadOnly is returned when a mutating transaction is started on a
 	// read-only database.
 	ErrDatabaseReadOnly = errors.New("database is in read-only mode")
+
+	// ErrFailpoint is returned by an operation that failed at a failpoint
+	// enabled with DB.EnableFailpoint.
+	ErrFailpoint = errors.New("failpoint triggered")
 )
 
 // These errors can occur when putting or deleting a value or a bucket.
@@ -0,0 +1,122 @@
+package bbolt
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Names of the points at which failures can be injected with
+// DB.EnableFailpoint.
+const (
+	// FailpointBeforeWritePage is reached before each dirty page is written
+	// by a commit. While it or FailpointAfterWritePage is enabled, pages are
+	// written one at a time rather than in coalesced runs.
+	FailpointBeforeWritePage = "beforeWritePage"
+	// FailpointAfterWritePage is reached after each dirty page is written by
+	// a commit.
+	FailpointAfterWritePage = "afterWritePage"
+	// FailpointBeforeSync is reached before the dirty pages written by a
+	// commit are synced, ahead of the meta page being written.
+	FailpointBeforeSync = "beforeSync"
+	// FailpointBeforeWriteMeta is reached before a commit writes the meta
+	// page.
+	FailpointBeforeWriteMeta = "beforeWriteMeta"
+	// FailpointAfterWriteMeta is reached after a commit has written and
+	// synced the meta page. The transaction is durable at this point, so it
+	// is not rolled back even though Commit returns the error.
+	FailpointAfterWriteMeta = "afterWriteMeta"
+	// FailpointGrow is reached when a commit grows the data file.
+	FailpointGrow = "grow"
+	// FailpointMmap is reached when the data file is remapped to fit a
+	// larger database.
+	FailpointMmap = "mmap"
+)
+
+// FailpointAction is what happens when an enabled failpoint is reached.
+type FailpointAction int
+
+const (
+	// FailpointError makes the operation return an error.
+	FailpointError FailpointAction = iota
+	// FailpointShortWrite makes a write at FailpointBeforeWritePage or
+	// FailpointBeforeWriteMeta write only the first half of its data before
+	// returning an error. At other failpoints it acts like FailpointError.
+	FailpointShortWrite
+	// FailpointPanic panics.
+	FailpointPanic
+)
+
+// Failpoint describes a failure to inject at a named point.
+type Failpoint struct {
+	Action FailpointAction
+
+	// Err is the error returned by the operation. Defaults to ErrFailpoint.
+	Err error
+
+	// Skip is the number of times the failpoint is passed before it starts
+	// to fail. Once it fails it keeps failing until it is disabled.
+	Skip int
+}
+
+// failpoints holds the failpoints enabled on a DB.
+type failpoints struct {
+	mu sync.Mutex
+	m  map[string]*Failpoint
+}
+
+// EnableFailpoint makes the operation at the named failpoint fail as
+// described by fp. It replaces any failpoint already enabled with that name.
+// Failpoints are meant for testing how applications handle I/O failures.
+func (db *DB) EnableFailpoint(name string, fp Failpoint) {
+	db.failpoints.mu.Lock()
+	defer db.failpoints.mu.Unlock()
+	if db.failpoints.m == nil {
+		db.failpoints.m = make(map[string]*Failpoint)
+	}
+	db.failpoints.m[name] = &fp
+}
+
+// DisableFailpoint disables the named failpoint.
+func (db *DB) DisableFailpoint(name string) {
+	db.failpoints.mu.Lock()
+	defer db.failpoints.mu.Unlock()
+	delete(db.failpoints.m, name)
+}
+
+// failpointEnabled returns whether any of the named failpoints is enabled.
+func (db *DB) failpointEnabled(names ...string) bool {
+	db.failpoints.mu.Lock()
+	defer db.failpoints.mu.Unlock()
+	for _, name := range names {
+		if db.failpoints.m[name] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// failpoint is called when the named failpoint is reached. It returns an
+// error if the failpoint fails, with short set if the caller should only
+// write part of its data first. It panics if the failpoint says to.
+func (db *DB) failpoint(name string) (short bool, err error) {
+	db.failpoints.mu.Lock()
+	defer db.failpoints.mu.Unlock()
+	fp := db.failpoints.m[name]
+	if fp == nil {
+		return false, nil
+	} else if fp.Skip > 0 {
+		fp.Skip--
+		return false, nil
+	}
+
+	switch fp.Action {
+	case FailpointPanic:
+		panic(fmt.Sprintf("failpoint %s", name))
+	case FailpointShortWrite:
+		short = true
+	}
+	if err = fp.Err; err == nil {
+		err = ErrFailpoint
+	}
+	return short, err
+}
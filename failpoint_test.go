@@ -0,0 +1,256 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Ensure that a commit failing at a failpoint leaves the database as it was,
+// on disk and in memory.
+func TestFailpoint(t *testing.T) {
+	for _, o := range []struct {
+		name string
+		opts *bolt.Options
+	}{
+		{"default", &bolt.Options{}},
+		{"NoFreelistSync", &bolt.Options{NoFreelistSync: true}},
+		{"FreelistDeltas", &bolt.Options{FreelistCheckpointInterval: 4}},
+		{"pread", &bolt.Options{AccessMode: bolt.AccessModePread}},
+	} {
+		for _, c := range []struct {
+			name      string
+			fp        bolt.Failpoint
+			committed bool
+		}{
+			{bolt.FailpointBeforeWritePage, bolt.Failpoint{Skip: 1}, false},
+			{bolt.FailpointBeforeWritePage, bolt.Failpoint{Action: bolt.FailpointShortWrite, Skip: 3}, false},
+			{bolt.FailpointAfterWritePage, bolt.Failpoint{Skip: 2}, false},
+			{bolt.FailpointBeforeSync, bolt.Failpoint{}, false},
+			{bolt.FailpointBeforeWriteMeta, bolt.Failpoint{}, false},
+			{bolt.FailpointBeforeWriteMeta, bolt.Failpoint{Action: bolt.FailpointShortWrite}, false},
+			{bolt.FailpointAfterWriteMeta, bolt.Failpoint{}, true},
+			{bolt.FailpointGrow, bolt.Failpoint{}, false},
+			{bolt.FailpointMmap, bolt.Failpoint{}, false},
+		} {
+			if c.name == bolt.FailpointGrow && o.opts.NoFreelistSync {
+				// The file is only grown when the freelist is synced.
+				continue
+			}
+			name := fmt.Sprintf("%s/%s/%d/%d", o.name, c.name, c.fp.Action, c.fp.Skip)
+			t.Run(name, func(t *testing.T) {
+				testFailpoint(t, o.opts, c.name, c.fp, c.committed)
+			})
+		}
+	}
+}
+
+func testFailpoint(t *testing.T, opts *bolt.Options, name string, fp bolt.Failpoint, committed bool) {
+	o := *opts
+	db := MustOpenWithOption(&o)
+	defer db.MustClose()
+	fillFailpointDB(t, db, 0)
+
+	before := db.Stats()
+	db.EnableFailpoint(name, fp)
+	err := db.Update(func(tx *bolt.Tx) error {
+		return fillFailpointTx(tx, 1)
+	})
+	db.DisableFailpoint(name)
+
+	// Errors from remapping are wrapped.
+	if err == nil || !strings.Contains(err.Error(), bolt.ErrFailpoint.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if committed {
+		checkFailpointDB(t, db, 1)
+	} else {
+		checkFailpointDB(t, db, 0)
+		after := db.Stats()
+		if before.FreePageN+before.PendingPageN != after.FreePageN+after.PendingPageN {
+			t.Fatalf("free pages: before=%d+%d after=%d+%d",
+				before.FreePageN, before.PendingPageN, after.FreePageN, after.PendingPageN)
+		}
+	}
+	db.MustCheck()
+
+	// The database keeps working, both now and after reopening.
+	fillFailpointDB(t, db, 2)
+	checkFailpointDB(t, db, 2)
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	checkFailpointDB(t, db, 2)
+}
+
+// Ensure that a commit panicking at a failpoint is rolled back.
+func TestFailpoint_Panic(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	fillFailpointDB(t, db, 0)
+
+	db.EnableFailpoint(bolt.FailpointBeforeWriteMeta, bolt.Failpoint{Action: bolt.FailpointPanic})
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+		_ = db.Update(func(tx *bolt.Tx) error {
+			return fillFailpointTx(tx, 1)
+		})
+	}()
+	db.DisableFailpoint(bolt.FailpointBeforeWriteMeta)
+
+	checkFailpointDB(t, db, 0)
+	db.MustCheck()
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	checkFailpointDB(t, db, 0)
+}
+
+// Ensure that a failpoint can return a custom error.
+func TestFailpoint_Err(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	errTest := fmt.Errorf("test error")
+	db.EnableFailpoint(bolt.FailpointBeforeSync, bolt.Failpoint{Err: errTest})
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != errTest {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db.DisableFailpoint(bolt.FailpointBeforeSync)
+}
+
+// fillFailpointDB commits generation gen of the test data.
+func fillFailpointDB(t *testing.T, db *DB, gen int) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return fillFailpointTx(tx, gen)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fillFailpointTx replaces the test data with generation gen. The values are
+// large enough that each generation grows the file and remaps it.
+func fillFailpointTx(tx *bolt.Tx, gen int) error {
+	if tx.Bucket([]byte("widgets")) != nil {
+		if err := tx.DeleteBucket([]byte("widgets")); err != nil {
+			return err
+		}
+	}
+	b, err := tx.CreateBucket([]byte("widgets"))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 100*(gen+1); i++ {
+		if err := b.Put(u64tob(uint64(i)), bytes.Repeat([]byte{byte(gen)}, 1000)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFailpointDB verifies the database holds generation gen of the test data.
+func checkFailpointDB(t *testing.T, db *DB, gen int) {
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if n := b.Stats().KeyN; n != 100*(gen+1) {
+			t.Fatalf("generation %d: unexpected key count: %d", gen, n)
+		}
+		if v := b.Get(u64tob(0)); !bytes.Equal(v, bytes.Repeat([]byte{byte(gen)}, 1000)) {
+			t.Fatalf("generation %d: unexpected value", gen)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that the page write failpoints are reached after each page of a run
+// of contiguous pages, even when the file writes runs at once.
+func TestFailpoint_WritePageRun(t *testing.T) {
+	for _, name := range []string{bolt.FailpointBeforeWritePage, bolt.FailpointAfterWritePage} {
+		t.Run(name, func(t *testing.T) {
+			storage := &countingStorage{}
+			db := MustOpenWithOption(&bolt.Options{Storage: storage})
+			defer db.MustClose()
+			pageSize := db.Info().PageSize
+
+			db.EnableFailpoint(name, bolt.Failpoint{Skip: 2})
+			storage.n = 0
+			if err := db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				for i := 0; i < 200; i++ {
+					if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != bolt.ErrFailpoint {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			db.DisableFailpoint(name)
+
+			exp := 2 * pageSize
+			if name == bolt.FailpointAfterWritePage {
+				exp += pageSize
+			}
+			if storage.n != int64(exp) {
+				t.Fatalf("unexpected bytes written: %d, expected %d", storage.n, exp)
+			}
+			db.MustCheck()
+		})
+	}
+}
+
+// countingStorage is a Storage of files in the operating system's file
+// system that counts the bytes written to them.
+type countingStorage struct {
+	n int64
+}
+
+func (s *countingStorage) Open(name string, flag int, perm os.FileMode) (bolt.File, error) {
+	f, err := bolt.OSStorage{}.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{File: f, s: s}, nil
+}
+
+type countingFile struct {
+	bolt.File
+	s *countingStorage
+}
+
+func (f *countingFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	f.s.n += int64(n)
+	return n, err
+}
+
+// WritevAt lets commits write runs of pages at once, as they do on Linux.
+func (f *countingFile) WritevAt(bufs [][]byte, off int64) (n, calls int, err error) {
+	for _, b := range bufs {
+		m, err := f.WriteAt(b, off+int64(n))
+		n += m
+		calls++
+		if err != nil {
+			return n, calls, err
+		}
+	}
+	return n, calls, nil
+}
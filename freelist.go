@@ -33,6 +33,8 @@ type freelist struct {
 	mergeSpans     func(ids pgids)             // the mergeSpan func
 	getFreePageIDs func() []pgid               // get free pgids func
 	readIDs        func(pgids []pgid)          // readIDs func reads list of pages and init the freelist
+	allocTxid      txid                        // txid of the write tx that allocated the allocated ids
+	allocated      []pgid                      // page ids taken off the freelist by allocTxid
 }
 
 // newFreelist returns an empty, initialized freelist.
@@ -140,6 +142,7 @@ func (f *freelist) arrayAllocate(txid txid, n int) pgid {
 				delete(f.cache, initial+i)
 			}
 			f.allocs[initial] = txid
+			f.logAllocation(txid, initial, n)
 			return initial
 		}
 
@@ -167,6 +170,9 @@ func (f *freelist) free(txid txid, p *page) {
 	} else if (p.flags & freelistPageFlag) != 0 {
 		// Freelist is always allocated by prior tx.
 		allocTxid = txid - 1
+	} else if (p.flags & freelistDeltaPageFlag) != 0 {
+		// Deltas record the tx that wrote them.
+		allocTxid = p.freelistDelta().txid
 	}
 
 	for id := p.id; id <= p.id+pgid(p.overflow); id++ {
@@ -253,6 +259,12 @@ func (f *freelist) rollback(txid txid) {
 	// Remove pages from pending list and mark as free if allocated by txid.
 	delete(f.pending, txid)
 	f.mergeSpans(m)
+
+	// Forget the allocations logged for txid so that the next write
+	// transaction, which reuses the id, starts with an empty delta.
+	if f.allocTxid == txid {
+		f.allocated = nil
+	}
 }
 
 // freed returns whether a given page is in the free list.
@@ -262,31 +274,26 @@ func (f *freelist) freed(pgid pgid) bool {
 
 // read initializes the freelist from a freelist page.
 func (f *freelist) read(p *page) {
+	ids := readFreelistPage(p)
+	if len(ids) == 0 {
+		f.ids = nil
+	} else {
+		f.readIDs(ids)
+	}
+}
+
+// readFreelistPage returns a sorted copy of the page ids stored on a
+// freelist page.
+func readFreelistPage(p *page) []pgid {
 	if (p.flags & freelistPageFlag) == 0 {
 		panic(fmt.Sprintf("invalid freelist page: %d, page type is %s", p.id, p.typ()))
 	}
-	// If the page.count is at the max uint16 value (64k) then it's considered
-	// an overflow and the size of the freelist is stored as the first element.
-	idx, count := 0, int(p.count)
-	if count == 0xFFFF {
-		idx = 1
-		count = int(((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[0])
-	}
-
-	// Copy the list of page ids from the freelist.
-	if count == 0 {
-		f.ids = nil
-	} else {
-		ids := ((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[idx : idx+count]
+	ids := p.format().FreelistIDs()
 
-		// copy the ids, so we don't modify on the freelist page directly
-		idsCopy := make([]pgid, count)
-		copy(idsCopy, ids)
-		// Make sure they're sorted.
-		sort.Sort(pgids(idsCopy))
+	// Make sure they're sorted.
+	sort.Sort(pgids(ids))
 
-		f.readIDs(idsCopy)
-	}
+	return ids
 }
 
 // arrayReadIDs initializes the freelist from a given list of ids.
@@ -325,9 +332,10 @@ func (f *freelist) write(p *page) error {
 	return nil
 }
 
-// reload reads the freelist from a page and filters out pending items.
-func (f *freelist) reload(p *page) {
-	f.read(p)
+// reload reads the freelist from a freelist page, or from the checkpoint and
+// deltas of a freelist log headed by p, and filters out pending items.
+func (f *freelist) reload(p *page, pageFn func(pgid) *page) {
+	f.readLog(p, pageFn)
 
 	// Build a cache of only pending pages.
 	pcache := make(map[pgid]bool)
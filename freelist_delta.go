@@ -0,0 +1,151 @@
+package bbolt
+
+import (
+	"sort"
+	"unsafe"
+)
+
+const freelistDeltaHeaderSize = int(unsafe.Sizeof(freelistDelta{}))
+
+// freelistDelta is the header of a freelist delta page. Instead of rewriting
+// the whole freelist, a commit can append a delta listing the page ids it took
+// off the freelist and the page ids it added to it. Deltas are chained back
+// through prev to a regular freelist page, the checkpoint. The header is
+// followed by allocN allocated ids and then freeN freed ids.
+type freelistDelta struct {
+	prev   pgid   // previous delta page, or the checkpoint page
+	txid   txid   // transaction that wrote the delta
+	depth  uint32 // number of deltas in the chain, including this one
+	allocN uint32 // number of page ids taken off the freelist
+	freeN  uint32 // number of page ids added to the freelist
+	_      uint32
+}
+
+// freelistDelta returns a pointer to the freelist delta header of the page.
+func (p *page) freelistDelta() *freelistDelta {
+	return (*freelistDelta)(unsafe.Pointer(&p.ptr))
+}
+
+// ids returns the page ids allocated and freed by the delta.
+func (d *freelistDelta) ids() (alloc, free []pgid) {
+	if d.allocN == 0 && d.freeN == 0 {
+		return nil, nil
+	}
+	ptr := unsafe.Pointer(uintptr(unsafe.Pointer(d)) + uintptr(freelistDeltaHeaderSize))
+	ids := (*[maxAllocSize]pgid)(ptr)[: d.allocN+d.freeN : d.allocN+d.freeN]
+	return ids[:d.allocN], ids[d.allocN:]
+}
+
+// freelistChain returns the pages making up the on-disk freelist headed by
+// id, newest first: any delta pages followed by the checkpoint page.
+func freelistChain(id pgid, pageFn func(pgid) *page) []*page {
+	var chain []*page
+	for {
+		p := pageFn(id)
+		chain = append(chain, p)
+		if (p.flags & freelistDeltaPageFlag) == 0 {
+			return chain
+		}
+		id = p.freelistDelta().prev
+	}
+}
+
+// logAllocation records that n pages starting at id were taken off the
+// freelist by txid so that they can be written out in the next delta.
+func (f *freelist) logAllocation(txid txid, id pgid, n int) {
+	if f.allocTxid != txid {
+		f.allocTxid = txid
+		f.allocated = nil
+	}
+	for i := pgid(0); i < pgid(n); i++ {
+		f.allocated = append(f.allocated, id+i)
+	}
+}
+
+// deltaSize returns the size of the delta page for txid after serialization.
+// extra allows room for page ids that are yet to be allocated.
+func (f *freelist) deltaSize(txid txid, extra int) int {
+	n := extra
+	if f.allocTxid == txid {
+		n += len(f.allocated)
+	}
+	if txp := f.pending[txid]; txp != nil {
+		n += len(txp.ids)
+	}
+	return pageHeaderSize + freelistDeltaHeaderSize + (int(unsafe.Sizeof(pgid(0))) * n)
+}
+
+// writeDelta writes the page ids allocated and freed by txid onto a freelist
+// delta page that follows the freelist page prev.
+func (f *freelist) writeDelta(txid txid, prev *page, p *page) error {
+	p.flags |= freelistDeltaPageFlag
+
+	d := p.freelistDelta()
+	d.prev = prev.id
+	d.txid = txid
+	d.depth = 1
+	if (prev.flags & freelistDeltaPageFlag) != 0 {
+		d.depth += prev.freelistDelta().depth
+	}
+
+	var alloc, free []pgid
+	if f.allocTxid == txid {
+		alloc = f.allocated
+	}
+	if txp := f.pending[txid]; txp != nil {
+		free = txp.ids
+	}
+	d.allocN = uint32(len(alloc))
+	d.freeN = uint32(len(free))
+
+	a, fr := d.ids()
+	copy(a, alloc)
+	copy(fr, free)
+
+	return nil
+}
+
+// readLog initializes the freelist from a freelist page, or from the head of
+// a delta chain by replaying the deltas on top of their checkpoint.
+func (f *freelist) readLog(p *page, pageFn func(pgid) *page) {
+	if (p.flags & freelistDeltaPageFlag) == 0 {
+		f.read(p)
+		return
+	}
+
+	chain := freelistChain(p.id, pageFn)
+	ids := readFreelistPage(chain[len(chain)-1])
+
+	// Replay the deltas oldest first; the last change to a page id wins.
+	present := make(map[pgid]bool)
+	for i := len(chain) - 2; i >= 0; i-- {
+		alloc, free := chain[i].freelistDelta().ids()
+		for _, id := range alloc {
+			present[id] = false
+		}
+		for _, id := range free {
+			present[id] = true
+		}
+	}
+
+	// Drop every id touched by a delta from the checkpoint, then add back
+	// the ones that ended up free.
+	var a, added pgids
+	for _, id := range ids {
+		if _, ok := present[id]; !ok {
+			a = append(a, id)
+		}
+	}
+	for id, free := range present {
+		if free {
+			added = append(added, id)
+		}
+	}
+	sort.Sort(added)
+
+	if a = a.merge(added); len(a) == 0 {
+		f.ids = nil
+	} else {
+		f.readIDs(a)
+	}
+}
@@ -25,6 +25,7 @@ func (f *freelist) hashmapAllocate(txid txid, n int) pgid {
 			f.delSpan(pid, uint64(n))
 
 			f.allocs[pid] = txid
+			f.logAllocation(txid, pid, n)
 
 			for i := pgid(0); i < pgid(n); i++ {
 				delete(f.cache, pid+i)
@@ -44,6 +45,7 @@ func (f *freelist) hashmapAllocate(txid txid, n int) pgid {
 			f.delSpan(pid, uint64(size))
 
 			f.allocs[pid] = txid
+			f.logAllocation(txid, pid, n)
 
 			remain := size - uint64(n)
 
@@ -0,0 +1,158 @@
+package bbolt
+
+import (
+	"sync"
+	"unsafe"
+
+	"go.etcd.io/bbolt/internal/format"
+)
+
+const freelistHintHeaderSize = int(unsafe.Sizeof(freelistHint{}))
+
+// RecoveryProgress describes how far Open has got rebuilding the freelist of
+// a database whose freelist is not synced to disk.
+type RecoveryProgress struct {
+	ScannedN int  // number of reachable pages scanned so far
+	PageN    int  // number of pages below the high water mark
+	Done     bool // true on the final call, once the scan has finished
+}
+
+// freepages returns the ids of all pages below the high water mark that are
+// not reachable from the root bucket or the freelist. Bucket subtrees are
+// scanned in parallel by up to parallelism goroutines. If progress is not nil
+// it is called periodically while the scan runs.
+//
+// Only errors that stop pages being reached are fatal; the structure of the
+// pages is left for Tx.Check. They panic once the scan has finished, on the
+// calling goroutine.
+func (db *DB) freepages(parallelism int, progress func(RecoveryProgress)) []pgid {
+	tx, err := db.beginTx()
+	defer func() {
+		err = tx.Rollback()
+		if err != nil {
+			panic("freepages: failed to rollback tx")
+		}
+	}()
+	if err != nil {
+		panic("freepages: failed to open read only tx")
+	}
+
+	s := newPageScan(tx, parallelism)
+	s.reachOnly = true
+	var failOnce sync.Once
+	var failed *CheckError
+	s.fail = func(e *CheckError) {
+		failOnce.Do(func() { failed = e })
+	}
+	if progress != nil {
+		s.progress = func(scannedN int, done bool) {
+			progress(RecoveryProgress{ScannedN: scannedN, PageN: int(tx.meta.pgid), Done: done})
+		}
+	}
+	// Pages of a synced freelist are in use even though no bucket refers to them.
+	if tx.meta.freelist != pgidNoFreelist {
+		for _, p := range freelistChain(tx.meta.freelist, tx.page) {
+			for i := pgid(0); i <= pgid(p.overflow); i++ {
+				s.mark(p.id + i)
+			}
+		}
+	}
+	s.walk(tx.meta.root.root, nil, nil)
+	s.wg.Wait()
+	if failed != nil {
+		panic("freepages: " + failed.Error())
+	}
+	s.report(true)
+
+	var fids []pgid
+	for i := pgid(2); i < tx.meta.pgid; i++ {
+		if !s.marked(i) {
+			fids = append(fids, i)
+		}
+	}
+	return fids
+}
+
+// freelistHint is the header of a freelist hint page. A hint is written just
+// past the high water mark when a database that doesn't sync its freelist is
+// closed, so that the next Open can read the freelist instead of scanning for
+// it. It is only trusted while the meta page still has the same txid.
+type freelistHint struct {
+	txid     txid   // txid of the meta page the hint was written for
+	count    uint64 // number of free page ids that follow the header
+	checksum uint64 // checksum of the txid, count and ids
+}
+
+// sum64 generates the checksum of the hint and the ids that follow it.
+func (h *freelistHint) sum64(ids []pgid) uint64 {
+	return (*format.FreelistHint)(unsafe.Pointer(h)).Sum64(ids)
+}
+
+// writeFreelistHint writes the freelist onto hint pages starting at the high
+// water mark. All pending pages are written as free, so no transactions may be
+// open.
+func (db *DB) writeFreelistHint() error {
+	m := db.meta()
+	n := db.freelist.count()
+	size := pageHeaderSize + freelistHintHeaderSize + (int(unsafe.Sizeof(pgid(0))) * n)
+	count := (size + db.pageSize - 1) / db.pageSize
+
+	buf := make([]byte, count*db.pageSize)
+	p := db.pageInBuffer(buf, 0)
+	p.id = m.pgid
+	p.flags = freelistHintPageFlag
+	p.overflow = uint32(count - 1)
+
+	h := (*freelistHint)(unsafe.Pointer(&p.ptr))
+	h.txid = m.txid
+	h.count = uint64(n)
+	ids := (*[maxAllocSize]pgid)(unsafe.Pointer(&buf[pageHeaderSize+freelistHintHeaderSize]))[:n:n]
+	db.freelist.copyall(ids)
+	h.checksum = h.sum64(ids)
+
+	if _, err := db.ops.writeAt(buf, int64(m.pgid)*int64(db.pageSize)); err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+// readFreelistHint returns the free page ids stored in the freelist hint, if
+// there is a valid one for the current meta page.
+func (db *DB) readFreelistHint() ([]pgid, bool) {
+	m := db.meta()
+	offset := int64(m.pgid) * int64(db.pageSize)
+
+	buf := make([]byte, db.pageSize)
+	if _, err := db.file.ReadAt(buf, offset); err != nil {
+		return nil, false
+	}
+	p := db.pageInBuffer(buf, 0)
+	h := (*freelistHint)(unsafe.Pointer(&p.ptr))
+	if (p.flags&freelistHintPageFlag) == 0 || p.id != m.pgid || h.txid != m.txid {
+		return nil, false
+	}
+	size := pageHeaderSize + freelistHintHeaderSize + (int(unsafe.Sizeof(pgid(0))) * int(h.count))
+	if h.count > uint64(m.pgid) || size > (int(p.overflow)+1)*db.pageSize {
+		return nil, false
+	}
+
+	// Read the rest of the hint.
+	buf = make([]byte, (int(p.overflow)+1)*db.pageSize)
+	if _, err := db.file.ReadAt(buf, offset); err != nil {
+		return nil, false
+	}
+	h = (*freelistHint)(unsafe.Pointer(&db.pageInBuffer(buf, 0).ptr))
+	ids := make([]pgid, h.count)
+	copy(ids, (*[maxAllocSize]pgid)(unsafe.Pointer(&buf[pageHeaderSize+freelistHintHeaderSize]))[:h.count:h.count])
+	if h.checksum != h.sum64(ids) {
+		return nil, false
+	}
+
+	// The ids must be sorted, unique and below the high water mark.
+	for i, id := range ids {
+		if id < 2 || id >= m.pgid || (i > 0 && id <= ids[i-1]) {
+			return nil, false
+		}
+	}
+	return ids, true
+}
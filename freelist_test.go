@@ -301,6 +301,68 @@ func TestFreelist_write(t *testing.T) {
 	}
 }
 
+// Ensure that a freelist can be rebuilt from a checkpoint and its deltas.
+func TestFreelist_readLog(t *testing.T) {
+	bufs := make(map[pgid][]byte)
+	pageFn := func(id pgid) *page {
+		if bufs[id] == nil {
+			bufs[id] = make([]byte, 4096)
+		}
+		return (*page)(unsafe.Pointer(&bufs[id][0]))
+	}
+
+	// Write a checkpoint with some free pages.
+	f := newTestFreelist()
+	f.readIDs([]pgid{5, 6, 7, 20})
+	checkpoint := pageFn(2)
+	checkpoint.id = 2
+	if err := f.write(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	// Allocate two pages and free two others in one transaction.
+	if id := f.allocate(100, 2); id != 5 && id != 6 {
+		t.Fatalf("unexpected allocation: %d", id)
+	}
+	f.free(100, &page{id: 30})
+	f.free(100, &page{id: 31})
+	delta := pageFn(3)
+	delta.id = 3
+	if err := f.writeDelta(100, checkpoint, delta); err != nil {
+		t.Fatal(err)
+	}
+	if depth := delta.freelistDelta().depth; depth != 1 {
+		t.Fatalf("unexpected depth: %d", depth)
+	}
+
+	// Free one of the allocated pages again in the next transaction.
+	f.release(100)
+	alloc, _ := delta.freelistDelta().ids()
+	f.free(101, &page{id: alloc[0]})
+	delta2 := pageFn(4)
+	delta2.id = 4
+	if err := f.writeDelta(101, delta, delta2); err != nil {
+		t.Fatal(err)
+	}
+	if depth := delta2.freelistDelta().depth; depth != 2 {
+		t.Fatalf("unexpected depth: %d", depth)
+	}
+
+	// Replaying the chain must give the same pages as a full freelist.
+	exp := make([]pgid, f.count())
+	f.copyall(exp)
+
+	f2 := newTestFreelist()
+	f2.readLog(delta2, pageFn)
+	if got := f2.getFreePageIDs(); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+
+	if chain := freelistChain(4, pageFn); len(chain) != 3 || chain[2] != checkpoint {
+		t.Fatalf("unexpected chain length: %d", len(chain))
+	}
+}
+
 func Benchmark_FreelistRelease10K(b *testing.B)    { benchmark_FreelistRelease(b, 10000) }
 func Benchmark_FreelistRelease100K(b *testing.B)   { benchmark_FreelistRelease(b, 100000) }
 func Benchmark_FreelistRelease1000K(b *testing.B)  { benchmark_FreelistRelease(b, 1000000) }
@@ -0,0 +1,126 @@
+package bbolt
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	// histogramSubBits is the number of bits below the highest set bit of a
+	// duration, in nanoseconds, that choose its bucket within a power of two.
+	histogramSubBits = 2
+
+	// histogramSubBuckets is the number of buckets each power of two is
+	// split into.
+	histogramSubBuckets = 1 << histogramSubBits
+
+	// histogramBuckets is the number of buckets covering every duration.
+	histogramBuckets = (64 - histogramSubBits) * histogramSubBuckets
+)
+
+// Histogram is a distribution of durations, such as the latency of commits.
+// Durations are counted in buckets a quarter of a power of two wide, so the
+// quantiles it reports are no more than 25% above the exact values.
+//
+// Histograms are values: copying one copies its counts.
+type Histogram struct {
+	Count int           // number of durations observed
+	Sum   time.Duration // total of the durations observed
+	Max   time.Duration // longest duration observed
+
+	buckets [histogramBuckets]int
+}
+
+// observe adds a duration to the histogram.
+func (h *Histogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+	h.buckets[histogramBucket(d)]++
+}
+
+// Quantile returns the duration that the fraction q of the observed durations
+// are no longer than, such as the median for 0.5 or the 99th percentile for
+// 0.99. It is the upper bound of the bucket the quantile falls in, capped at
+// Max, or zero if no durations have been observed.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q * float64(h.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var n int
+	for i, c := range h.buckets {
+		if n += c; n >= rank {
+			return h.upper(i)
+		}
+	}
+	return h.Max
+}
+
+// Sub calculates and returns the distribution of the durations observed
+// since other, an earlier copy of the histogram. The maximum of those is only
+// known exactly if it is longer than every duration observed before; otherwise
+// Max is the upper bound of the highest bucket they fall in, capped at Max.
+func (h *Histogram) Sub(other *Histogram) Histogram {
+	var diff Histogram
+	diff.Count = h.Count - other.Count
+	diff.Sum = h.Sum - other.Sum
+	for i := range h.buckets {
+		diff.buckets[i] = h.buckets[i] - other.buckets[i]
+	}
+	if h.Max > other.Max {
+		diff.Max = h.Max
+		return diff
+	}
+	for i := len(diff.buckets) - 1; i >= 0; i-- {
+		if diff.buckets[i] > 0 {
+			diff.Max = h.upper(i)
+			break
+		}
+	}
+	return diff
+}
+
+// upper returns the longest duration in bucket i, capped at Max.
+func (h *Histogram) upper(i int) time.Duration {
+	d := time.Duration(math.MaxInt64)
+	if i+1 < histogramBuckets {
+		d = histogramLower(i+1) - 1
+	}
+	if d > h.Max {
+		d = h.Max
+	}
+	return d
+}
+
+// histogramBucket returns the index of the bucket counting d. Durations
+// shorter than histogramSubBuckets nanoseconds have a bucket each; longer
+// ones share a bucket with those with the same highest bits.
+func histogramBucket(d time.Duration) int {
+	v := uint64(d)
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	e := bits.Len64(v) - 1
+	m := int(v>>uint(e-histogramSubBits)) & (histogramSubBuckets - 1)
+	return (e-histogramSubBits+1)*histogramSubBuckets + m
+}
+
+// histogramLower returns the shortest duration in bucket i.
+func histogramLower(i int) time.Duration {
+	if i < histogramSubBuckets {
+		return time.Duration(i)
+	}
+	e := i/histogramSubBuckets + histogramSubBits - 1
+	m := i % histogramSubBuckets
+	return time.Duration(histogramSubBuckets+m) << uint(e-histogramSubBits)
+}
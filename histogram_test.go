@@ -0,0 +1,65 @@
+package bbolt
+
+import (
+	"testing"
+	"time"
+)
+
+// Ensure that every duration falls in the bucket whose bounds contain it.
+func TestHistogramBucket(t *testing.T) {
+	for _, d := range []time.Duration{0, 1, 3, 4, 7, 8, 9, 1000, time.Millisecond, time.Hour, 1<<63 - 1} {
+		i := histogramBucket(d)
+		if i < 0 || i >= histogramBuckets {
+			t.Fatalf("%d: bucket out of range: %d", d, i)
+		} else if lower := histogramLower(i); d < lower {
+			t.Fatalf("%d: below bucket %d lower bound %d", d, i, lower)
+		} else if i+1 < histogramBuckets && d >= histogramLower(i+1) {
+			t.Fatalf("%d: above bucket %d", d, i)
+		}
+	}
+}
+
+// Ensure that quantiles are close to the exact values.
+func TestHistogram_Quantile(t *testing.T) {
+	var h Histogram
+	if h.Quantile(0.5) != 0 {
+		t.Fatalf("unexpected empty quantile: %s", h.Quantile(0.5))
+	}
+	for i := 1; i <= 1000; i++ {
+		h.observe(time.Duration(i) * time.Microsecond)
+	}
+	if h.Count != 1000 || h.Max != time.Millisecond || h.Sum != 500500*time.Microsecond {
+		t.Fatalf("unexpected count, max and sum: %d, %s, %s", h.Count, h.Max, h.Sum)
+	}
+	for _, q := range []float64{0.5, 0.99, 1} {
+		exact := time.Duration(q*1000) * time.Microsecond
+		if d := h.Quantile(q); d < exact || d > exact*5/4 {
+			t.Fatalf("%v: unexpected quantile: %s, exact %s", q, d, exact)
+		}
+	}
+}
+
+// Ensure that histograms can be subtracted from one another.
+func TestHistogram_Sub(t *testing.T) {
+	var a Histogram
+	a.observe(time.Second)
+	a.observe(time.Millisecond)
+	b := a
+	b.observe(2 * time.Millisecond)
+	b.observe(3 * time.Millisecond)
+
+	diff := b.Sub(&a)
+	if diff.Count != 2 || diff.Sum != 5*time.Millisecond {
+		t.Fatalf("unexpected count and sum: %d, %s", diff.Count, diff.Sum)
+	} else if diff.Quantile(0.5) < 2*time.Millisecond || diff.Quantile(0.5) >= 3*time.Millisecond {
+		t.Fatalf("unexpected median: %s", diff.Quantile(0.5))
+	} else if diff.Max < 3*time.Millisecond || diff.Max > 3*time.Millisecond*5/4 {
+		t.Fatalf("unexpected max: %s", diff.Max)
+	}
+
+	// A new maximum is known exactly.
+	b.observe(2 * time.Second)
+	if diff := b.Sub(&a); diff.Max != 2*time.Second {
+		t.Fatalf("unexpected max: %s", diff.Max)
+	}
+}
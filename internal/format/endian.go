@@ -0,0 +1,414 @@
+package format
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"unsafe"
+)
+
+// The meta page records the byte order of the file: the magic is stored in
+// the byte order of the host that wrote it, so a file written with the other
+// byte order reads it as magicSwapped.
+const magicSwapped uint32 = 0xEDDA0CED
+
+// nativeOrder is the byte order of the host.
+var nativeOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	if x := uint16(1); *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeOrder = binary.BigEndian
+	}
+}
+
+// ReadWriterAt is a file that can be read and written at offsets.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// ConvertEndian rewrites the database file f, in place, in the other byte
+// order and returns the byte order it was converted to. The meta pages, the
+// pages reachable from the newest valid meta page, its freelist and any
+// freelist hint are converted; the remaining pages are free and left as they
+// are. Meta and hint checksums are recomputed, unless they were invalid.
+//
+// The file is left partly converted if an error is returned part way.
+func ConvertEndian(f ReadWriterAt) (binary.ByteOrder, error) {
+	c := &converter{f: f, seen: make(map[Pgid]bool)}
+	var buf [PageHeaderSize + MetaSize]byte
+	if err := readFull(f, buf[:], 0); err != nil {
+		return nil, err
+	}
+	switch magic := binary.LittleEndian.Uint32(buf[PageHeaderSize:]); magic {
+	case Magic:
+		c.from, c.to = binary.LittleEndian, binary.BigEndian
+	case magicSwapped:
+		c.from, c.to = binary.BigEndian, binary.LittleEndian
+	default:
+		return nil, ErrInvalid
+	}
+	c.pageSize = int(c.from.Uint32(buf[PageHeaderSize+int(unsafe.Offsetof(Meta{}.PageSize)):]))
+
+	// Convert both meta pages, then what the newest valid one refers to.
+	var newest *Meta
+	for id := Pgid(0); id < 2; id++ {
+		m, err := c.meta(id)
+		if err != nil {
+			return nil, err
+		} else if m != nil && (newest == nil || m.Txid > newest.Txid) {
+			newest = m
+		}
+	}
+	if newest == nil {
+		return nil, ErrChecksum
+	}
+	c.hwm = newest.Pgid
+	if err := c.tree(newest.Root.Root); err != nil {
+		return nil, err
+	}
+	if newest.Freelist != PgidNoFreelist {
+		if err := c.freelist(newest.Freelist); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.hint(newest); err != nil {
+		return nil, err
+	}
+	return c.to, nil
+}
+
+// converter converts the pages of a file from one byte order to the other.
+type converter struct {
+	f        ReadWriterAt
+	from, to binary.ByteOrder
+	pageSize int
+	hwm      Pgid // pages from here on are out of bounds
+	seen     map[Pgid]bool
+}
+
+// swap converts the integer of size bytes at buf[off:].
+func (c *converter) swap(buf []byte, off, size int) {
+	switch size {
+	case 2:
+		c.to.PutUint16(buf[off:], c.from.Uint16(buf[off:]))
+	case 4:
+		c.to.PutUint32(buf[off:], c.from.Uint32(buf[off:]))
+	case 8:
+		c.to.PutUint64(buf[off:], c.from.Uint64(buf[off:]))
+	}
+}
+
+// swapFields converts the fields of a struct at buf[off:] laid out as given,
+// by offset and size.
+func (c *converter) swapFields(buf []byte, off int, fields [][2]uintptr) {
+	for _, f := range fields {
+		c.swap(buf, off+int(f[0]), int(f[1]))
+	}
+}
+
+var (
+	pageFields = [][2]uintptr{
+		{unsafe.Offsetof(Page{}.ID), 8},
+		{unsafe.Offsetof(Page{}.Flags), 2},
+		{unsafe.Offsetof(Page{}.Count), 2},
+		{unsafe.Offsetof(Page{}.Overflow), 4},
+	}
+	metaFields = [][2]uintptr{
+		{unsafe.Offsetof(Meta{}.Magic), 4},
+		{unsafe.Offsetof(Meta{}.Version), 4},
+		{unsafe.Offsetof(Meta{}.PageSize), 4},
+		{unsafe.Offsetof(Meta{}.Flags), 4},
+		{unsafe.Offsetof(Meta{}.Root) + unsafe.Offsetof(Bucket{}.Root), 8},
+		{unsafe.Offsetof(Meta{}.Root) + unsafe.Offsetof(Bucket{}.Sequence), 8},
+		{unsafe.Offsetof(Meta{}.Freelist), 8},
+		{unsafe.Offsetof(Meta{}.Pgid), 8},
+		{unsafe.Offsetof(Meta{}.Txid), 8},
+		{unsafe.Offsetof(Meta{}.Checksum), 8},
+	}
+	bucketFields = [][2]uintptr{
+		{unsafe.Offsetof(Bucket{}.Root), 8},
+		{unsafe.Offsetof(Bucket{}.Sequence), 8},
+	}
+	branchElementFields = [][2]uintptr{
+		{unsafe.Offsetof(BranchPageElement{}.Pos), 4},
+		{unsafe.Offsetof(BranchPageElement{}.Ksize), 4},
+		{unsafe.Offsetof(BranchPageElement{}.Pgid), 8},
+	}
+	leafElementFields = [][2]uintptr{
+		{unsafe.Offsetof(LeafPageElement{}.Flags), 4},
+		{unsafe.Offsetof(LeafPageElement{}.Pos), 4},
+		{unsafe.Offsetof(LeafPageElement{}.Ksize), 4},
+		{unsafe.Offsetof(LeafPageElement{}.Vsize), 4},
+	}
+	deltaFields = [][2]uintptr{
+		{unsafe.Offsetof(FreelistDelta{}.Prev), 8},
+		{unsafe.Offsetof(FreelistDelta{}.Txid), 8},
+		{unsafe.Offsetof(FreelistDelta{}.Depth), 4},
+		{unsafe.Offsetof(FreelistDelta{}.AllocN), 4},
+		{unsafe.Offsetof(FreelistDelta{}.FreeN), 4},
+	}
+	hintFields = [][2]uintptr{
+		{unsafe.Offsetof(FreelistHint{}.Txid), 8},
+		{unsafe.Offsetof(FreelistHint{}.Count), 8},
+		{unsafe.Offsetof(FreelistHint{}.Checksum), 8},
+	}
+)
+
+// swapIDs converts the n page ids at buf[off:].
+func (c *converter) swapIDs(buf []byte, off, n int) {
+	for i := 0; i < n; i++ {
+		c.swap(buf, off+i*8, 8)
+	}
+}
+
+// read reads page id and its overflow pages, and converts its header. The
+// header is returned as read.
+func (c *converter) read(id Pgid) (*Page, []byte, error) {
+	if id >= c.hwm && c.hwm != 0 {
+		return nil, nil, fmt.Errorf("page %d: out of bounds: %d", id, c.hwm)
+	} else if c.seen[id] {
+		return nil, nil, fmt.Errorf("page %d: multiple references", id)
+	}
+	c.seen[id] = true
+
+	var hdr [PageHeaderSize]byte
+	if err := readFull(c.f, hdr[:], int64(id)*int64(c.pageSize)); err != nil {
+		return nil, nil, err
+	}
+	p := &Page{
+		ID:       Pgid(c.from.Uint64(hdr[unsafe.Offsetof(Page{}.ID):])),
+		Flags:    c.from.Uint16(hdr[unsafe.Offsetof(Page{}.Flags):]),
+		Count:    c.from.Uint16(hdr[unsafe.Offsetof(Page{}.Count):]),
+		Overflow: c.from.Uint32(hdr[unsafe.Offsetof(Page{}.Overflow):]),
+	}
+	if p.ID != id {
+		return nil, nil, fmt.Errorf("page %d: unexpected id %d", id, p.ID)
+	}
+	buf := make([]byte, (int(p.Overflow)+1)*c.pageSize)
+	if err := readFull(c.f, buf, int64(id)*int64(c.pageSize)); err != nil {
+		return nil, nil, err
+	}
+	c.swapFields(buf, 0, pageFields)
+	return p, buf, nil
+}
+
+// write writes back the page id held in buf.
+func (c *converter) write(id Pgid, buf []byte) error {
+	_, err := c.f.WriteAt(buf, int64(id)*int64(c.pageSize))
+	return err
+}
+
+// meta converts meta page id and returns it, as read, if it is valid.
+func (c *converter) meta(id Pgid) (*Meta, error) {
+	buf := make([]byte, PageHeaderSize+MetaSize)
+	if err := readFull(c.f, buf, int64(id)*int64(c.pageSize)); err != nil {
+		return nil, err
+	}
+
+	// The checksum covers the bytes of the meta, so it is recomputed after
+	// converting them if it was valid.
+	m := &Meta{
+		Version:  c.from.Uint32(buf[PageHeaderSize+int(unsafe.Offsetof(Meta{}.Version)):]),
+		PageSize: c.from.Uint32(buf[PageHeaderSize+int(unsafe.Offsetof(Meta{}.PageSize)):]),
+		Flags:    c.from.Uint32(buf[PageHeaderSize+int(unsafe.Offsetof(Meta{}.Flags)):]),
+		Root:     Bucket{Root: Pgid(c.from.Uint64(buf[PageHeaderSize+int(unsafe.Offsetof(Meta{}.Root)):]))},
+		Freelist: Pgid(c.from.Uint64(buf[PageHeaderSize+int(unsafe.Offsetof(Meta{}.Freelist)):])),
+		Pgid:     Pgid(c.from.Uint64(buf[PageHeaderSize+int(unsafe.Offsetof(Meta{}.Pgid)):])),
+		Txid:     Txid(c.from.Uint64(buf[PageHeaderSize+int(unsafe.Offsetof(Meta{}.Txid)):])),
+	}
+	checksumOff := PageHeaderSize + int(unsafe.Offsetof(Meta{}.Checksum))
+	checksum := c.from.Uint64(buf[checksumOff:])
+	valid := c.from.Uint32(buf[PageHeaderSize:]) == Magic && checksum == sum64(buf[PageHeaderSize:checksumOff])
+
+	c.swapFields(buf, 0, pageFields)
+	c.swapFields(buf, PageHeaderSize, metaFields)
+	if valid {
+		c.to.PutUint64(buf[checksumOff:], sum64(buf[PageHeaderSize:checksumOff]))
+	}
+	if err := c.write(id, buf); err != nil || !valid {
+		return nil, err
+	}
+	return m, nil
+}
+
+// tree converts the tree rooted at page id.
+func (c *converter) tree(id Pgid) error {
+	p, buf, err := c.read(id)
+	if err != nil {
+		return err
+	}
+
+	var children []Pgid
+	switch {
+	case (p.Flags & BranchPageFlag) != 0:
+		children, err = c.branch(p, buf)
+	case (p.Flags & LeafPageFlag) != 0:
+		children, err = c.leaf(p, buf)
+	default:
+		err = fmt.Errorf("page %d: invalid type: %s", id, p.Type())
+	}
+	if err != nil {
+		return err
+	} else if err := c.write(id, buf); err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := c.tree(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// branch converts the elements of branch page p, held in buf, and returns the
+// pages they refer to.
+func (c *converter) branch(p *Page, buf []byte) ([]Pgid, error) {
+	var children []Pgid
+	for i := 0; i < int(p.Count); i++ {
+		off := PageHeaderSize + i*BranchPageElementSize
+		if off+BranchPageElementSize > len(buf) {
+			return nil, fmt.Errorf("page %d: element %d out of bounds", p.ID, i)
+		}
+		children = append(children, Pgid(c.from.Uint64(buf[off+int(unsafe.Offsetof(BranchPageElement{}.Pgid)):])))
+		c.swapFields(buf, off, branchElementFields)
+	}
+	return children, nil
+}
+
+// leaf converts the elements of leaf page p, held in buf, along with the
+// headers and pages of the buckets stored in them. It returns the root pages
+// of the buckets that aren't inline. buf holds the page, or the inline page
+// of a bucket value.
+func (c *converter) leaf(p *Page, buf []byte) ([]Pgid, error) {
+	var roots []Pgid
+	for i := 0; i < int(p.Count); i++ {
+		off := PageHeaderSize + i*LeafPageElementSize
+		if off+LeafPageElementSize > len(buf) {
+			return nil, fmt.Errorf("page %d: element %d out of bounds", p.ID, i)
+		}
+		flags := c.from.Uint32(buf[off+int(unsafe.Offsetof(LeafPageElement{}.Flags)):])
+		pos := int(c.from.Uint32(buf[off+int(unsafe.Offsetof(LeafPageElement{}.Pos)):]))
+		ksize := int(c.from.Uint32(buf[off+int(unsafe.Offsetof(LeafPageElement{}.Ksize)):]))
+		vsize := int(c.from.Uint32(buf[off+int(unsafe.Offsetof(LeafPageElement{}.Vsize)):]))
+		c.swapFields(buf, off, leafElementFields)
+		if (flags & BucketLeafFlag) == 0 {
+			continue
+		}
+
+		// Convert the bucket header and any inline page after it.
+		vstart := off + pos + ksize
+		if vsize < BucketHeaderSize || vstart+vsize > len(buf) {
+			return nil, fmt.Errorf("page %d: element %d: invalid bucket value", p.ID, i)
+		}
+		value := buf[vstart : vstart+vsize]
+		root := Pgid(c.from.Uint64(value[unsafe.Offsetof(Bucket{}.Root):]))
+		c.swapFields(value, 0, bucketFields)
+		if root != 0 {
+			roots = append(roots, root)
+			continue
+		}
+		inline := value[BucketHeaderSize:]
+		if len(inline) < PageHeaderSize {
+			return nil, fmt.Errorf("page %d: element %d: inline bucket too short", p.ID, i)
+		}
+		ip := &Page{ID: p.ID, Count: c.from.Uint16(inline[unsafe.Offsetof(Page{}.Count):])}
+		c.swapFields(inline, 0, pageFields)
+		if _, err := c.leaf(ip, inline); err != nil {
+			return nil, err
+		}
+	}
+	return roots, nil
+}
+
+// freelist converts the freelist headed by page id, following any deltas.
+func (c *converter) freelist(id Pgid) error {
+	for {
+		p, buf, err := c.read(id)
+		if err != nil {
+			return err
+		}
+
+		next := PgidNoFreelist
+		switch {
+		case (p.Flags & FreelistPageFlag) != 0:
+			idx, n := 0, int(p.Count)
+			if p.Count == 0xFFFF {
+				if len(buf) < PageHeaderSize+8 {
+					return fmt.Errorf("page %d: freelist out of bounds", id)
+				}
+				idx, n = 1, int(c.from.Uint64(buf[PageHeaderSize:]))
+			}
+			if PageHeaderSize+(idx+n)*8 > len(buf) {
+				return fmt.Errorf("page %d: freelist out of bounds", id)
+			}
+			c.swapIDs(buf, PageHeaderSize, idx+n)
+		case (p.Flags & FreelistDeltaPageFlag) != 0:
+			off := PageHeaderSize
+			next = Pgid(c.from.Uint64(buf[off+int(unsafe.Offsetof(FreelistDelta{}.Prev)):]))
+			n := int(c.from.Uint32(buf[off+int(unsafe.Offsetof(FreelistDelta{}.AllocN)):])) +
+				int(c.from.Uint32(buf[off+int(unsafe.Offsetof(FreelistDelta{}.FreeN)):]))
+			if off+FreelistDeltaSize+n*8 > len(buf) {
+				return fmt.Errorf("page %d: freelist delta out of bounds", id)
+			}
+			c.swapFields(buf, off, deltaFields)
+			c.swapIDs(buf, off+FreelistDeltaSize, n)
+		default:
+			return fmt.Errorf("page %d: invalid freelist page type: %s", id, p.Type())
+		}
+		if err := c.write(id, buf); err != nil {
+			return err
+		}
+		if next == PgidNoFreelist {
+			return nil
+		}
+		id = next
+	}
+}
+
+// hint converts the freelist hint written past the high water mark for m,
+// if there is one.
+func (c *converter) hint(m *Meta) error {
+	var hdr [PageHeaderSize + FreelistHintSize]byte
+	if err := readFull(c.f, hdr[:], int64(m.Pgid)*int64(c.pageSize)); err == io.ErrUnexpectedEOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	off := PageHeaderSize
+	if Pgid(c.from.Uint64(hdr[unsafe.Offsetof(Page{}.ID):])) != m.Pgid ||
+		(c.from.Uint16(hdr[unsafe.Offsetof(Page{}.Flags):])&FreelistHintPageFlag) == 0 ||
+		Txid(c.from.Uint64(hdr[off+int(unsafe.Offsetof(FreelistHint{}.Txid)):])) != m.Txid {
+		return nil
+	}
+
+	c.hwm = 0
+	_, buf, err := c.read(m.Pgid)
+	if err != nil {
+		return err
+	}
+	n := c.from.Uint64(buf[off+int(unsafe.Offsetof(FreelistHint{}.Count)):])
+	if n > uint64(len(buf)-off-FreelistHintSize)/8 {
+		return nil
+	}
+	checksumOff := off + int(unsafe.Offsetof(FreelistHint{}.Checksum))
+	ids := buf[off+FreelistHintSize : off+FreelistHintSize+int(n)*8]
+	valid := c.from.Uint64(buf[checksumOff:]) == sum64(buf[off:checksumOff], ids)
+
+	c.swapFields(buf, off, hintFields)
+	c.swapIDs(ids, 0, int(n))
+	if valid {
+		c.to.PutUint64(buf[checksumOff:], sum64(buf[off:checksumOff], ids))
+	}
+	return c.write(m.Pgid, buf)
+}
+
+// sum64 returns the checksum of the concatenation of bufs.
+func sum64(bufs ...[]byte) uint64 {
+	h := fnv.New64a()
+	for _, b := range bufs {
+		_, _ = h.Write(b)
+	}
+	return h.Sum64()
+}
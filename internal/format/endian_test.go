@@ -0,0 +1,110 @@
+package format_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/format"
+)
+
+// Ensure that a database converted to the other byte order is refused, and
+// converted back to the same bytes.
+func TestConvertEndian(t *testing.T) {
+	for _, o := range []*bolt.Options{
+		{},
+		{FreelistCheckpointInterval: 10},
+		{NoFreelistSync: true, FreelistHint: true},
+	} {
+		t.Run(fmt.Sprintf("%+v", *o), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "bolt-format-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "db")
+
+			db, err := bolt.Open(path, 0600, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 20; i++ {
+				if err := db.Update(func(tx *bolt.Tx) error {
+					b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+					if err != nil {
+						return err
+					}
+					for j := 0; j < 100; j++ {
+						if err := b.Put([]byte(fmt.Sprintf("%04d-%04d", i, j)), make([]byte, 100)); err != nil {
+							return err
+						}
+					}
+					inline, err := b.CreateBucketIfNotExists([]byte("inline"))
+					if err != nil {
+						return err
+					}
+					if err := inline.Put([]byte(fmt.Sprint(i)), []byte("bar")); err != nil {
+						return err
+					}
+					return b.Delete([]byte(fmt.Sprintf("%04d-%04d", i/2, 0)))
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			orig, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			to, err := format.ConvertEndian(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf, err := ioutil.ReadFile(path); err != nil {
+				t.Fatal(err)
+			} else if to.Uint32(buf[format.PageHeaderSize:]) != format.Magic {
+				t.Fatalf("unexpected magic: %x", buf[format.PageHeaderSize:format.PageHeaderSize+4])
+			}
+			if _, err := bolt.Open(path, 0600, o); err != bolt.ErrEndianMismatch {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if back, err := format.ConvertEndian(f); err != nil {
+				t.Fatal(err)
+			} else if back == to {
+				t.Fatalf("unexpected byte order: %s", back)
+			}
+			if buf, err := ioutil.ReadFile(path); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(buf, orig) {
+				t.Fatal("unexpected file contents")
+			}
+
+			db, err = bolt.Open(path, 0600, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.View(func(tx *bolt.Tx) error {
+				for err := range tx.Check() {
+					return err
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
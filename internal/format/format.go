@@ -0,0 +1,108 @@
+// Package format describes the bbolt file format. It parses and validates the
+// pages, meta pages and freelists, including freelist deltas and hints, of a
+// database file read from an io.ReaderAt.
+//
+// It is shared by the bbolt package and the bbolt command so the two agree on
+// the layout of the file.
+package format
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// Magic is the marker value stored on both meta pages.
+const Magic uint32 = 0xED0CDAED
+
+// Version is the data file format version.
+const Version = 2
+
+// FeatureVersionFlag is set in the version recorded by files that use
+// optional features, which are recorded in Meta.Flags, so that versions of
+// Bolt that predate the features refuse to open them rather than misreading
+// them. The other bits hold the format version, so format versions are never
+// confused with files that use features.
+const FeatureVersionFlag = 0x80000000
+
+// FeatureVersion is the version recorded by files of the current format
+// version that use optional features.
+const FeatureVersion = FeatureVersionFlag | Version
+
+// Meta flags recording the optional features a file uses. The low 16 bits
+// are features that a version which doesn't know them can't read the file
+// with. The high 16 bits are read only compatible features: such a version
+// can read the file, but mustn't write to it.
+const (
+	// MetaFlagFreelistDelta marks a file whose freelist is a checkpoint
+	// followed by a chain of freelist delta pages.
+	MetaFlagFreelistDelta = 0x01
+
+	// MetaFlagsReadOnlyCompat masks the read only compatible features.
+	MetaFlagsReadOnlyCompat = 0xFFFF0000
+
+	// knownMetaFlags holds every feature understood by this version.
+	knownMetaFlags = MetaFlagFreelistDelta
+)
+
+// maxAllocSize is the size used when creating array pointers: 2GB on 64-bit
+// platforms and 256MB on 32-bit ones.
+const maxAllocSize = 0x7FFFFFFF >> (3 * (1 - ^uint(0)>>63))
+
+// Page flags.
+const (
+	BranchPageFlag   = 0x01
+	LeafPageFlag     = 0x02
+	MetaPageFlag     = 0x04
+	FreelistPageFlag = 0x10
+
+	FreelistDeltaPageFlag = 0x40
+	FreelistHintPageFlag  = 0x80
+)
+
+// BucketLeafFlag marks a leaf element whose value is a bucket.
+const BucketLeafFlag = 0x01
+
+// PgidNoFreelist is stored as the meta page's freelist id when the freelist
+// isn't synced to disk.
+const PgidNoFreelist Pgid = 0xffffffffffffffff
+
+// Sizes of the fixed parts of the file format.
+const (
+	PageHeaderSize        = int(unsafe.Offsetof(((*Page)(nil)).Ptr))
+	BranchPageElementSize = int(unsafe.Sizeof(BranchPageElement{}))
+	LeafPageElementSize   = int(unsafe.Sizeof(LeafPageElement{}))
+	BucketHeaderSize      = int(unsafe.Sizeof(Bucket{}))
+	MetaSize              = int(unsafe.Sizeof(Meta{}))
+	FreelistDeltaSize     = int(unsafe.Sizeof(FreelistDelta{}))
+	FreelistHintSize      = int(unsafe.Sizeof(FreelistHint{}))
+)
+
+var (
+	// ErrInvalid is returned when a meta page is not a bolt meta page.
+	ErrInvalid = errors.New("invalid database")
+
+	// ErrVersionMismatch is returned when a meta page was written by a
+	// different version of the file format.
+	ErrVersionMismatch = errors.New("version mismatch")
+
+	// ErrChecksum is returned when a meta page checksum does not match.
+	ErrChecksum = errors.New("checksum error")
+
+	// ErrEndianMismatch is returned when a meta page was written in the
+	// other byte order.
+	ErrEndianMismatch = errors.New("endian mismatch")
+)
+
+// Pgid is the id of a page: its offset in the file in pages.
+type Pgid uint64
+
+// Txid is the id of a transaction.
+type Txid uint64
+
+// Bucket is the on-file representation of a bucket. It is stored as the value
+// of a bucket's key. If the bucket is small enough, its root page is stored
+// inline in the value, after the header, and Root is 0.
+type Bucket struct {
+	Root     Pgid   // page id of the bucket's root-level page
+	Sequence uint64 // monotonically incrementing, used by NextSequence()
+}
@@ -0,0 +1,146 @@
+package format
+
+import (
+	"hash/fnv"
+	"unsafe"
+)
+
+// FreelistDelta is the header of a freelist delta page. Instead of rewriting
+// the whole freelist, a commit can append a delta listing the page ids it took
+// off the freelist and the page ids it added to it. Deltas are chained back
+// through Prev to a regular freelist page, the checkpoint. The header is
+// followed by AllocN allocated ids and then FreeN freed ids.
+type FreelistDelta struct {
+	Prev   Pgid   // previous delta page, or the checkpoint page
+	Txid   Txid   // transaction that wrote the delta
+	Depth  uint32 // number of deltas in the chain, including this one
+	AllocN uint32 // number of page ids taken off the freelist
+	FreeN  uint32 // number of page ids added to the freelist
+	_      uint32
+}
+
+// FreelistHint is the header of a freelist hint page. A hint is written just
+// past the high water mark when a database that doesn't sync its freelist is
+// closed. It is followed by Count free page ids, and is only valid for the
+// meta page with the same Txid.
+type FreelistHint struct {
+	Txid     Txid   // txid of the meta page the hint was written for
+	Count    uint64 // number of free page ids that follow the header
+	Checksum uint64 // checksum of the txid, count and ids
+}
+
+// FreelistIDs returns a copy of the page ids stored on a freelist page, in
+// the order they are stored. The page must be FreelistSize bytes or larger.
+func (p *Page) FreelistIDs() []Pgid {
+	idx, count := p.freelistCount()
+	if count == 0 {
+		return nil
+	}
+	ids := make([]Pgid, count)
+	copy(ids, ((*[maxAllocSize]Pgid)(unsafe.Pointer(&p.Ptr)))[idx:idx+count])
+	return ids
+}
+
+// SetFreelistIDs stores ids on a freelist page of size bytes, counting them
+// with the first element if there are too many for the page's count. It
+// returns false, leaving the page unchanged, if they don't fit.
+func (p *Page) SetFreelistIDs(ids []Pgid, size int) bool {
+	idx := 0
+	if len(ids) >= 0xFFFF {
+		idx = 1
+	}
+	if PageHeaderSize+(idx+len(ids))*int(unsafe.Sizeof(Pgid(0))) > size {
+		return false
+	}
+
+	all := (*[maxAllocSize]Pgid)(unsafe.Pointer(&p.Ptr))[: idx+len(ids) : idx+len(ids)]
+	if idx == 0 {
+		p.Count = uint16(len(ids))
+	} else {
+		p.Count = 0xFFFF
+		all[0] = Pgid(len(ids))
+	}
+	copy(all[idx:], ids)
+	return true
+}
+
+// FreelistSize returns the number of bytes a freelist, freelist delta or
+// freelist hint page needs to hold its ids, or 0 if the page is none of them.
+func (p *Page) FreelistSize() int {
+	const idSize = int(unsafe.Sizeof(Pgid(0)))
+	if (p.Flags & FreelistPageFlag) != 0 {
+		idx, count := p.freelistCount()
+		return PageHeaderSize + (idx+count)*idSize
+	} else if (p.Flags & FreelistDeltaPageFlag) != 0 {
+		d := p.FreelistDelta()
+		return PageHeaderSize + FreelistDeltaSize + (int(d.AllocN)+int(d.FreeN))*idSize
+	} else if (p.Flags & FreelistHintPageFlag) != 0 {
+		h := p.FreelistHint()
+		if h.Count > uint64(maxAllocSize/idSize) {
+			return maxAllocSize
+		}
+		return PageHeaderSize + FreelistHintSize + int(h.Count)*idSize
+	}
+	return 0
+}
+
+// freelistCount returns the index of the first id on a freelist page and the
+// number of ids. If the page's count is at the max uint16 value (64k) then
+// it's considered an overflow and the number of ids is stored as the first
+// element.
+func (p *Page) freelistCount() (idx, count int) {
+	if p.Count == 0xFFFF {
+		return 1, int(((*[maxAllocSize]Pgid)(unsafe.Pointer(&p.Ptr)))[0])
+	}
+	return 0, int(p.Count)
+}
+
+// FreelistDelta returns a pointer to the header of a freelist delta page.
+func (p *Page) FreelistDelta() *FreelistDelta {
+	return (*FreelistDelta)(unsafe.Pointer(&p.Ptr))
+}
+
+// IDs returns copies of the page ids allocated and freed by the delta. The
+// page must be FreelistSize bytes or larger.
+func (d *FreelistDelta) IDs() (alloc, free []Pgid) {
+	ids := d.ids()
+	alloc = append([]Pgid(nil), ids[:d.AllocN]...)
+	free = append([]Pgid(nil), ids[d.AllocN:]...)
+	return alloc, free
+}
+
+// ids returns the page ids that follow the delta header, in place.
+func (d *FreelistDelta) ids() []Pgid {
+	n := d.AllocN + d.FreeN
+	if n == 0 {
+		return nil
+	}
+	ptr := unsafe.Pointer(uintptr(unsafe.Pointer(d)) + uintptr(FreelistDeltaSize))
+	return (*[maxAllocSize]Pgid)(ptr)[:n:n]
+}
+
+// FreelistHint returns a pointer to the header of a freelist hint page.
+func (p *Page) FreelistHint() *FreelistHint {
+	return (*FreelistHint)(unsafe.Pointer(&p.Ptr))
+}
+
+// IDs returns a copy of the page ids stored in the hint. The page must be
+// FreelistSize bytes or larger.
+func (h *FreelistHint) IDs() []Pgid {
+	if h.Count == 0 {
+		return nil
+	}
+	ptr := unsafe.Pointer(uintptr(unsafe.Pointer(h)) + uintptr(FreelistHintSize))
+	return append([]Pgid(nil), (*[maxAllocSize]Pgid)(ptr)[:h.Count:h.Count]...)
+}
+
+// Sum64 generates the checksum of the hint and the given ids, which are the
+// ones that follow it.
+func (h *FreelistHint) Sum64(ids []Pgid) uint64 {
+	var hash = fnv.New64a()
+	_, _ = hash.Write((*[unsafe.Offsetof(FreelistHint{}.Checksum)]byte)(unsafe.Pointer(h))[:])
+	if len(ids) > 0 {
+		_, _ = hash.Write((*[maxAllocSize]byte)(unsafe.Pointer(&ids[0]))[:len(ids)*int(unsafe.Sizeof(Pgid(0)))])
+	}
+	return hash.Sum64()
+}
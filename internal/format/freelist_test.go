@@ -0,0 +1,133 @@
+package format
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// Ensure that the ids on a freelist page are read and stored, including when
+// their number is stored as the first element.
+func TestPage_FreelistIDs(t *testing.T) {
+	for _, n := range []int{0, 3, 0xFFFF, 0x10000} {
+		exp := make([]Pgid, n)
+		for i := range exp {
+			exp[i] = Pgid(i + 2)
+		}
+
+		buf := make([]byte, PageHeaderSize+(n+1)*8)
+		p := (*Page)(unsafe.Pointer(&buf[0]))
+		p.Flags = FreelistPageFlag
+		ids := (*[maxAllocSize / 8]Pgid)(unsafe.Pointer(&p.Ptr))[: n+1 : n+1]
+		if n < 0xFFFF {
+			p.Count = uint16(n)
+			copy(ids, exp)
+		} else {
+			p.Count = 0xFFFF
+			ids[0] = Pgid(n)
+			copy(ids[1:], exp)
+		}
+
+		if size := p.FreelistSize(); size > len(buf) {
+			t.Fatalf("%d ids: unexpected size %d of %d", n, size, len(buf))
+		} else if got := p.FreelistIDs(); len(exp) > 0 && !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%d ids: unexpected ids: %v", n, got[:3])
+		} else if len(exp) == 0 && got != nil {
+			t.Fatalf("unexpected ids: %v", got)
+		}
+
+		// Storing the ids lays the page out the same way.
+		buf2 := make([]byte, len(buf))
+		p2 := (*Page)(unsafe.Pointer(&buf2[0]))
+		p2.Flags = FreelistPageFlag
+		if !p2.SetFreelistIDs(exp, len(buf2)) {
+			t.Fatalf("%d ids: no room", n)
+		} else if !bytes.Equal(buf, buf2) {
+			t.Fatalf("%d ids: unexpected page", n)
+		} else if p2.SetFreelistIDs(append(exp, 1, 1), len(buf2)) {
+			t.Fatalf("%d ids: expected no room", n)
+		}
+	}
+}
+
+// Ensure that the ids of a freelist delta page are read.
+func TestPage_FreelistDelta(t *testing.T) {
+	buf := make([]byte, PageHeaderSize+FreelistDeltaSize+3*8)
+	p := (*Page)(unsafe.Pointer(&buf[0]))
+	p.Flags = FreelistDeltaPageFlag
+	d := p.FreelistDelta()
+	d.AllocN, d.FreeN = 1, 2
+	copy(d.ids(), []Pgid{5, 7, 9})
+
+	if size := p.FreelistSize(); size != len(buf) {
+		t.Fatalf("unexpected size: %d", size)
+	}
+	alloc, free := d.IDs()
+	if !reflect.DeepEqual(alloc, []Pgid{5}) || !reflect.DeepEqual(free, []Pgid{7, 9}) {
+		t.Fatalf("unexpected ids: %v, %v", alloc, free)
+	}
+}
+
+// Ensure that the ids and checksum of a freelist hint page are read.
+func TestPage_FreelistHint(t *testing.T) {
+	buf := make([]byte, PageHeaderSize+FreelistHintSize+2*8)
+	p := (*Page)(unsafe.Pointer(&buf[0]))
+	p.Flags = FreelistHintPageFlag
+	h := p.FreelistHint()
+	h.Txid, h.Count = 3, 2
+	copy((*[2]Pgid)(unsafe.Pointer(&buf[PageHeaderSize+FreelistHintSize]))[:], []Pgid{4, 6})
+
+	if size := p.FreelistSize(); size != len(buf) {
+		t.Fatalf("unexpected size: %d", size)
+	} else if ids := h.IDs(); !reflect.DeepEqual(ids, []Pgid{4, 6}) {
+		t.Fatalf("unexpected ids: %v", ids)
+	} else if h.Sum64(ids) == h.Sum64(ids[:1]) {
+		t.Fatal("expected the checksum to cover the ids")
+	}
+
+	h.Count = 1 << 62
+	if size := p.FreelistSize(); size <= len(buf) {
+		t.Fatalf("unexpected size: %d", size)
+	}
+}
+
+// Ensure that a chain of freelist deltas is replayed on top of its
+// checkpoint, and that a cycle in the chain is reported.
+func TestReadFreelist_Deltas(t *testing.T) {
+	const pageSize = 256
+	buf := make([]byte, 5*pageSize)
+	page := func(id Pgid, flags uint16) *Page {
+		p := (*Page)(unsafe.Pointer(&buf[int(id)*pageSize]))
+		p.ID, p.Flags = id, flags
+		return p
+	}
+
+	// The checkpoint frees 10 and 11, then 10 is allocated and 12 freed,
+	// then 12 is allocated and 10 freed again.
+	cp := page(2, FreelistPageFlag)
+	cp.Count = 2
+	copy((*[2]Pgid)(unsafe.Pointer(&cp.Ptr))[:], []Pgid{10, 11})
+	d1 := page(3, FreelistDeltaPageFlag).FreelistDelta()
+	d1.Prev, d1.Depth, d1.AllocN, d1.FreeN = 2, 1, 1, 1
+	copy(d1.ids(), []Pgid{10, 12})
+	d2 := page(4, FreelistDeltaPageFlag).FreelistDelta()
+	d2.Prev, d2.Depth, d2.AllocN, d2.FreeN = 3, 2, 1, 1
+	copy(d2.ids(), []Pgid{12, 10})
+
+	if ids, err := ReadFreelist(bytes.NewReader(buf), pageSize, 4); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []Pgid{10, 11}) {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+	if ids, err := ReadFreelist(bytes.NewReader(buf), pageSize, 3); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []Pgid{11, 12}) {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+
+	d1.Prev = 4
+	if _, err := ReadFreelist(bytes.NewReader(buf), pageSize, 4); err == nil || err.Error() != "page 4: invalid freelist delta depth: 2" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package format
+
+import (
+	"hash/fnv"
+	"unsafe"
+)
+
+// Meta is the contents of a meta page. The two meta pages at the start of the
+// file alternate between transactions; the valid one with the highest Txid
+// is current.
+type Meta struct {
+	Magic    uint32
+	Version  uint32
+	PageSize uint32
+	Flags    uint32
+	Root     Bucket
+	Freelist Pgid
+	Pgid     Pgid // high water mark: the number of pages in use
+	Txid     Txid
+	Checksum uint64
+}
+
+// Validate checks the marker bytes, version, features and checksum of the
+// meta page. A zero checksum isn't checked. Unknown read only compatible
+// features are allowed; see Writable.
+func (m *Meta) Validate() error {
+	if m.Magic == magicSwapped {
+		return ErrEndianMismatch
+	} else if m.Magic != Magic {
+		return ErrInvalid
+	} else if m.Version != Version && m.Version != FeatureVersion {
+		return ErrVersionMismatch
+	} else if m.Flags&^knownMetaFlags&^MetaFlagsReadOnlyCompat != 0 {
+		return ErrVersionMismatch
+	} else if m.Checksum != 0 && m.Checksum != m.Sum64() {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// FormatVersion returns the format version of the file, without
+// FeatureVersionFlag.
+func (m *Meta) FormatVersion() uint32 {
+	return m.Version &^ FeatureVersionFlag
+}
+
+// Writable returns whether every feature recorded by the meta page is known,
+// so that the file may be written as well as read.
+func (m *Meta) Writable() bool {
+	return m.Flags&^knownMetaFlags == 0
+}
+
+// Sum64 generates the checksum for the meta.
+func (m *Meta) Sum64() uint64 {
+	var h = fnv.New64a()
+	_, _ = h.Write((*[unsafe.Offsetof(Meta{}.Checksum)]byte)(unsafe.Pointer(m))[:])
+	return h.Sum64()
+}
@@ -0,0 +1,47 @@
+package format
+
+import "testing"
+
+// Ensure that meta pages using unknown features are refused, or only read.
+func TestMeta_Validate(t *testing.T) {
+	m := &Meta{Magic: Magic, Version: Version}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m.Version, m.Flags = FeatureVersion, MetaFlagFreelistDelta
+	m.Checksum = m.Sum64()
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	} else if !m.Writable() {
+		t.Fatal("expected writable")
+	} else if m.FormatVersion() != Version {
+		t.Fatalf("unexpected format version: %d", m.FormatVersion())
+	}
+
+	// Unknown read only compatible features can be read but not written.
+	m.Flags |= 0x10000
+	m.Checksum = m.Sum64()
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	} else if m.Writable() {
+		t.Fatal("expected read only")
+	}
+
+	m.Flags |= 0x80
+	m.Checksum = m.Sum64()
+	if err := m.Validate(); err != ErrVersionMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m.Version, m.Flags = Version+2, 0
+	m.Checksum = m.Sum64()
+	if err := m.Validate(); err != ErrVersionMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A magic in the other byte order means the file was written on a host
+	// with the other byte order.
+	m.Magic = 0xEDDA0CED
+	if err := m.Validate(); err != ErrEndianMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package format
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Page is the header of a page. The page's elements or meta follow it,
+// starting at Ptr.
+type Page struct {
+	ID       Pgid
+	Flags    uint16
+	Count    uint16
+	Overflow uint32
+	Ptr      uintptr
+}
+
+// Type returns a human readable page type string used for debugging.
+func (p *Page) Type() string {
+	if (p.Flags & BranchPageFlag) != 0 {
+		return "branch"
+	} else if (p.Flags & LeafPageFlag) != 0 {
+		return "leaf"
+	} else if (p.Flags & MetaPageFlag) != 0 {
+		return "meta"
+	} else if (p.Flags & FreelistPageFlag) != 0 {
+		return "freelist"
+	} else if (p.Flags & FreelistDeltaPageFlag) != 0 {
+		return "freelist-delta"
+	} else if (p.Flags & FreelistHintPageFlag) != 0 {
+		return "freelist-hint"
+	}
+	return fmt.Sprintf("unknown<%02x>", p.Flags)
+}
+
+// Meta returns a pointer to the metadata section of the page.
+func (p *Page) Meta() *Meta {
+	return (*Meta)(unsafe.Pointer(&p.Ptr))
+}
+
+// LeafPageElement retrieves the leaf element by index.
+func (p *Page) LeafPageElement(index uint16) *LeafPageElement {
+	return &((*[0x7FFFFFF]LeafPageElement)(unsafe.Pointer(&p.Ptr)))[index]
+}
+
+// BranchPageElement retrieves the branch element by index.
+func (p *Page) BranchPageElement(index uint16) *BranchPageElement {
+	return &((*[0x7FFFFFF]BranchPageElement)(unsafe.Pointer(&p.Ptr)))[index]
+}
+
+// CheckElements returns the number of leading elements of a branch or leaf
+// page that lie within its size in bytes, along with an error describing the
+// first that doesn't.
+func (p *Page) CheckElements(size int) (int, *ElementError) {
+	elemSize := LeafPageElementSize
+	if (p.Flags & BranchPageFlag) != 0 {
+		elemSize = BranchPageElementSize
+	}
+
+	n := int(p.Count)
+	var e *ElementError
+	if PageHeaderSize+n*elemSize > size {
+		n = (size - PageHeaderSize) / elemSize
+		e = &ElementError{Index: -1, Detail: fmt.Sprintf("%d elements", int(p.Count))}
+	}
+	for i := 0; i < n; i++ {
+		end := PageHeaderSize + i*elemSize
+		if (p.Flags & BranchPageFlag) != 0 {
+			elem := p.BranchPageElement(uint16(i))
+			end += int(elem.Pos) + int(elem.Ksize)
+		} else {
+			elem := p.LeafPageElement(uint16(i))
+			end += int(elem.Pos) + int(elem.Ksize) + int(elem.Vsize)
+		}
+		if end > size {
+			return i, &ElementError{Index: i, Detail: fmt.Sprintf("ends at %d of %d bytes", end, size)}
+		}
+	}
+	return n, e
+}
+
+// ElementError describes the elements of a page that lie outside it.
+type ElementError struct {
+	// Index is the first element out of bounds, or -1 if the element headers
+	// themselves don't fit.
+	Index  int
+	Detail string
+}
+
+// Error implements the error interface.
+func (e *ElementError) Error() string {
+	if e.Index < 0 {
+		return "elements out of bounds: " + e.Detail
+	}
+	return fmt.Sprintf("element %d out of bounds: %s", e.Index, e.Detail)
+}
+
+// BranchPageElement represents a node on a branch page.
+type BranchPageElement struct {
+	Pos   uint32
+	Ksize uint32
+	Pgid  Pgid
+}
+
+// Key returns a byte slice of the node key.
+func (n *BranchPageElement) Key() []byte {
+	buf := (*[maxAllocSize]byte)(unsafe.Pointer(n))
+	return (*[maxAllocSize]byte)(unsafe.Pointer(&buf[n.Pos]))[:n.Ksize:n.Ksize]
+}
+
+// LeafPageElement represents a node on a leaf page.
+type LeafPageElement struct {
+	Flags uint32
+	Pos   uint32
+	Ksize uint32
+	Vsize uint32
+}
+
+// Key returns a byte slice of the node key.
+func (n *LeafPageElement) Key() []byte {
+	buf := (*[maxAllocSize]byte)(unsafe.Pointer(n))
+	return (*[maxAllocSize]byte)(unsafe.Pointer(&buf[n.Pos]))[:n.Ksize:n.Ksize]
+}
+
+// Value returns a byte slice of the node value.
+func (n *LeafPageElement) Value() []byte {
+	buf := (*[maxAllocSize]byte)(unsafe.Pointer(n))
+	return (*[maxAllocSize]byte)(unsafe.Pointer(&buf[n.Pos+n.Ksize]))[:n.Vsize:n.Vsize]
+}
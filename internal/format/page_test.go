@@ -0,0 +1,34 @@
+package format
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// Ensure that elements lying outside a page are found.
+func TestPage_CheckElements(t *testing.T) {
+	buf := make([]byte, 64)
+	p := (*Page)(unsafe.Pointer(&buf[0]))
+	p.Flags = LeafPageFlag
+	p.Count = 2
+	e0, e1 := p.LeafPageElement(0), p.LeafPageElement(1)
+	e0.Pos, e0.Ksize, e0.Vsize = 32, 2, 2
+	e1.Pos, e1.Ksize, e1.Vsize = 28, 2, 2
+
+	if n, e := p.CheckElements(len(buf)); n != 2 || e != nil {
+		t.Fatalf("unexpected result: %d, %v", n, e)
+	}
+	if n, e := p.CheckElements(len(buf) - 1); n != 1 || e == nil || e.Index != 1 {
+		t.Fatalf("unexpected result: %d, %v", n, e)
+	} else if e.Error() != "element 1 out of bounds: ends at 64 of 63 bytes" {
+		t.Fatalf("unexpected error: %s", e)
+	}
+	if n, e := p.CheckElements(50); n != 0 || e == nil || e.Index != 0 {
+		t.Fatalf("unexpected result: %d, %v", n, e)
+	}
+	if n, e := p.CheckElements(PageHeaderSize + 4); n != 0 || e == nil || e.Index != -1 {
+		t.Fatalf("unexpected result: %d, %v", n, e)
+	} else if e.Error() != "elements out of bounds: 2 elements" {
+		t.Fatalf("unexpected error: %s", e)
+	}
+}
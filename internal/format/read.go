@@ -0,0 +1,157 @@
+package format
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"unsafe"
+)
+
+// ReadPageSize reads the page size from the first meta page of r.
+func ReadPageSize(r io.ReaderAt) (int, error) {
+	m, err := readMeta(r, 0)
+	if err != nil {
+		return 0, err
+	}
+	return int(m.PageSize), nil
+}
+
+// ReadMeta reads and validates meta page id, 0 or 1, of r.
+func ReadMeta(r io.ReaderAt, pageSize int, id Pgid) (*Meta, error) {
+	if id > 1 {
+		return nil, fmt.Errorf("page %d: not a meta page", id)
+	}
+	return readMeta(r, int64(id)*int64(pageSize))
+}
+
+// ReadNewestMeta reads both meta pages of r and returns the valid one with
+// the highest transaction id, or the error of the first if neither is valid.
+func ReadNewestMeta(r io.ReaderAt, pageSize int) (*Meta, error) {
+	m0, err0 := ReadMeta(r, pageSize, 0)
+	m1, err1 := ReadMeta(r, pageSize, 1)
+	switch {
+	case err0 == nil && (err1 != nil || m0.Txid > m1.Txid):
+		return m0, nil
+	case err1 == nil:
+		return m1, nil
+	}
+	return nil, err0
+}
+
+// readMeta reads and validates the meta page at offset.
+func readMeta(r io.ReaderAt, offset int64) (*Meta, error) {
+	buf := make([]byte, PageHeaderSize+MetaSize)
+	if err := readFull(r, buf, offset); err != nil {
+		return nil, err
+	}
+	m := (*Page)(unsafe.Pointer(&buf[0])).Meta()
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadPage reads page id of r, along with its overflow pages. It returns the
+// page and the buffer holding it. The buffer is newly allocated, so it may be
+// modified and written back.
+func ReadPage(r io.ReaderAt, pageSize int, id Pgid) (*Page, []byte, error) {
+	offset := int64(id) * int64(pageSize)
+	buf := make([]byte, pageSize)
+	if err := readFull(r, buf, offset); err != nil {
+		return nil, nil, err
+	}
+	p := (*Page)(unsafe.Pointer(&buf[0]))
+	if p.Overflow == 0 {
+		return p, buf, nil
+	}
+
+	// Make sure the overflow is within the file before allocating for it.
+	size := (int64(p.Overflow) + 1) * int64(pageSize)
+	var last [1]byte
+	if err := readFull(r, last[:], offset+size-1); err != nil {
+		return nil, nil, fmt.Errorf("page %d: read %d overflow pages: %s", id, p.Overflow, err)
+	}
+	buf = make([]byte, size)
+	if err := readFull(r, buf, offset); err != nil {
+		return nil, nil, err
+	}
+	return (*Page)(unsafe.Pointer(&buf[0])), buf, nil
+}
+
+// ReadFreelist reads the freelist headed by page id of r and returns the free
+// page ids. The head is either a freelist page or a freelist delta page, in
+// which case the deltas are replayed, oldest first, on top of the freelist
+// page at the end of their chain, and the ids are returned sorted.
+func ReadFreelist(r io.ReaderAt, pageSize int, id Pgid) ([]Pgid, error) {
+	var deltas []*FreelistDelta
+	for {
+		p, err := readFreelistPage(r, pageSize, id)
+		if err != nil {
+			return nil, err
+		} else if (p.Flags & FreelistPageFlag) != 0 {
+			if len(deltas) == 0 {
+				return p.FreelistIDs(), nil
+			}
+			return replayDeltas(p.FreelistIDs(), deltas), nil
+		} else if (p.Flags & FreelistDeltaPageFlag) == 0 {
+			return nil, fmt.Errorf("page %d: invalid freelist page type: %s", id, p.Type())
+		}
+
+		// Depths count down to 1 along the chain, so a cycle can't be followed.
+		d := p.FreelistDelta()
+		if n := len(deltas); d.Depth == 0 || (n > 0 && d.Depth != deltas[n-1].Depth-1) {
+			return nil, fmt.Errorf("page %d: invalid freelist delta depth: %d", id, d.Depth)
+		}
+		deltas = append(deltas, d)
+		id = d.Prev
+	}
+}
+
+// readFreelistPage reads page id of r and checks that it holds all of its
+// freelist ids.
+func readFreelistPage(r io.ReaderAt, pageSize int, id Pgid) (*Page, error) {
+	p, buf, err := ReadPage(r, pageSize, id)
+	if err != nil {
+		return nil, err
+	} else if size := p.FreelistSize(); size > len(buf) {
+		return nil, fmt.Errorf("page %d: freelist needs %d of %d bytes", id, size, len(buf))
+	}
+	return p, nil
+}
+
+// replayDeltas applies deltas, newest first, to the ids of their checkpoint
+// and returns the resulting ids, sorted. The last change to an id wins.
+func replayDeltas(ids []Pgid, deltas []*FreelistDelta) []Pgid {
+	free := make(map[Pgid]bool, len(ids))
+	for _, id := range ids {
+		free[id] = true
+	}
+	for i := len(deltas) - 1; i >= 0; i-- {
+		alloc, freed := deltas[i].IDs()
+		for _, id := range alloc {
+			delete(free, id)
+		}
+		for _, id := range freed {
+			free[id] = true
+		}
+	}
+
+	ids = make([]Pgid, 0, len(free))
+	for id := range free {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// readFull reads len(buf) bytes at offset, reporting a short read as
+// io.ErrUnexpectedEOF.
+func readFull(r io.ReaderAt, buf []byte, offset int64) error {
+	n, err := r.ReadAt(buf, offset)
+	if n == len(buf) {
+		return nil
+	} else if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
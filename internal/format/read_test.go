@@ -0,0 +1,182 @@
+package format_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/internal/format"
+)
+
+// Ensure that the metas, pages and freelist of a database file can be read.
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-format-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{PageSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root format.Pgid
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 10000))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = format.Pgid(tx.Bucket([]byte("widgets")).Root())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	pageSize, err := format.ReadPageSize(f)
+	if err != nil {
+		t.Fatal(err)
+	} else if pageSize != 4096 {
+		t.Fatalf("unexpected page size: %d", pageSize)
+	}
+	m, err := format.ReadNewestMeta(f, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	} else if m.Txid != 2 {
+		t.Fatalf("unexpected txid: %d", m.Txid)
+	}
+
+	// The bucket's only key overflows its page.
+	p, buf, err := format.ReadPage(f, pageSize, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if p.ID != root || p.Type() != "leaf" || p.Overflow != 2 || len(buf) != 3*pageSize {
+		t.Fatalf("unexpected page: %+v, %d bytes", p, len(buf))
+	} else if n, e := p.CheckElements(len(buf)); n != 1 || e != nil {
+		t.Fatalf("unexpected elements: %d, %v", n, e)
+	} else if e := p.LeafPageElement(0); string(e.Key()) != "foo" || len(e.Value()) != 10000 {
+		t.Fatalf("unexpected element: %q", e.Key())
+	}
+
+	if _, err := format.ReadFreelist(f, pageSize, m.Freelist); err != nil {
+		t.Fatal(err)
+	} else if _, err := format.ReadFreelist(f, pageSize, root); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Pages past the end of the file can't be read.
+	if _, _, err := format.ReadPage(f, pageSize, m.Pgid+10); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that damaged meta pages are reported.
+func TestReadMeta_Invalid(t *testing.T) {
+	buf := make([]byte, 2*4096)
+	if _, err := format.ReadMeta(bytes.NewReader(buf), 4096, 0); err != format.ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := format.ReadNewestMeta(bytes.NewReader(buf), 4096); err != format.ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := format.ReadMeta(bytes.NewReader(buf[:20]), 4096, 0); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that the freelist of a database that appends freelist deltas is
+// read as the database reads it.
+func TestReadFreelist_Database(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-format-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{FreelistCheckpointInterval: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 100; j++ {
+				if err := b.Put([]byte{byte(j)}, make([]byte, 100*(i%3))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen so that no pages are pending.
+	db, err = bolt.Open(path, 0600, &bolt.Options{FreelistCheckpointInterval: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var exp []format.Pgid
+	if err := db.View(func(tx *bolt.Tx) error {
+		for id := 2; ; id++ {
+			p, err := tx.Page(id)
+			if err != nil {
+				return err
+			} else if p == nil {
+				return nil
+			} else if p.Type == "free" {
+				exp = append(exp, format.Pgid(id))
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := format.ReadNewestMeta(f, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _, err := format.ReadPage(f, int(m.PageSize), m.Freelist)
+	if err != nil {
+		t.Fatal(err)
+	} else if p.Type() != "freelist-delta" {
+		t.Fatalf("unexpected freelist head: %s", p.Type())
+	}
+	if ids, err := format.ReadFreelist(f, int(m.PageSize), m.Freelist); err != nil {
+		t.Fatal(err)
+	} else if len(exp) == 0 || !reflect.DeepEqual(ids, exp) {
+		t.Fatalf("unexpected ids: %v, expected %v", ids, exp)
+	}
+}
@@ -0,0 +1,115 @@
+package bbolt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockFileSuffix is appended to the path of a database to name the file
+// describing the process holding its exclusive lock.
+const lockFileSuffix = ".lock"
+
+// LockHolder describes the process holding the exclusive lock on a database,
+// as recorded in the lock file next to it.
+type LockHolder struct {
+	PID      int
+	Hostname string
+	Since    time.Time // when the lock was obtained
+}
+
+// TimeoutError is returned by Open, in place of ErrTimeout, when the lock on
+// the data file cannot be obtained within Options.Timeout and the process
+// holding it is known. The holder is only known while it has the database
+// open for writing; readers are not recorded. If the holder exited without
+// closing the database, its lock file is left behind and may be out of date.
+type TimeoutError struct {
+	Holder LockHolder
+}
+
+// Error returns the error message, which includes the holder.
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: locked by pid %d on %s since %s", ErrTimeout, e.Holder.PID, e.Holder.Hostname, e.Holder.Since.Format(time.RFC3339))
+}
+
+// Unwrap returns ErrTimeout.
+func (e *TimeoutError) Unwrap() error {
+	return ErrTimeout
+}
+
+// storageRemover is implemented by Storages that can remove files. Lock
+// files are truncated instead in Storages that can't.
+type storageRemover interface {
+	Remove(name string) error
+}
+
+// Remove removes the named file.
+func (s OSStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// writeLockHolder records the current process as the holder of the exclusive
+// lock on the data file. The record is only used for diagnostics, so errors
+// are ignored: a data file may be writable in a directory that isn't.
+func (db *DB) writeLockHolder(mode os.FileMode) {
+	f, err := db.storage.Open(db.path+lockFileSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	hostname, _ := os.Hostname()
+	_, _ = fmt.Fprintf(&fileWriter{f: f}, "pid=%d\nhostname=%s\nsince=%s\n", os.Getpid(), hostname, time.Now().Format(time.RFC3339Nano))
+}
+
+// removeLockHolder removes the record written by writeLockHolder, before the
+// exclusive lock is released.
+func (db *DB) removeLockHolder() {
+	name := db.path + lockFileSuffix
+	if r, ok := db.storage.(storageRemover); ok {
+		_ = r.Remove(name)
+		return
+	}
+	if f, err := db.storage.Open(name, os.O_WRONLY, 0); err == nil {
+		_ = f.Truncate(0)
+		_ = f.Close()
+	}
+}
+
+// readLockHolder returns the holder of the exclusive lock on the data file
+// at path, or nil if it isn't recorded.
+func readLockHolder(storage Storage, path string) *LockHolder {
+	f, err := storage.Open(path+lockFileSuffix, os.O_RDONLY, 0)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var h LockHolder
+	s := bufio.NewScanner(io.NewSectionReader(f, 0, 4096))
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), "=", 2)
+		if len(kv) != 2 {
+			return nil
+		}
+		switch kv[0] {
+		case "pid":
+			if h.PID, err = strconv.Atoi(kv[1]); err != nil {
+				return nil
+			}
+		case "hostname":
+			h.Hostname = kv[1]
+		case "since":
+			if h.Since, err = time.Parse(time.RFC3339Nano, kv[1]); err != nil {
+				return nil
+			}
+		}
+	}
+	if s.Err() != nil || h.PID == 0 {
+		return nil
+	}
+	return &h
+}
@@ -0,0 +1,24 @@
+package bbolt
+
+// Logger receives messages about significant events in a DB, such as
+// remapping or growing the data file, loading the freelist and errors that
+// can't be returned, along with key/value pairs describing them. Set it with
+// Options.Logger; by default nothing is logged.
+//
+// keyvals alternate between string keys and values of any type, as in
+// "size", 1<<20, "err", err. Methods may be called concurrently, sometimes
+// with database locks held, and must not use the database.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// discardLogger is the Logger used when Options.Logger is not set.
+type discardLogger struct{}
+
+func (discardLogger) Debug(msg string, keyvals ...interface{}) {}
+func (discardLogger) Info(msg string, keyvals ...interface{})  {}
+func (discardLogger) Warn(msg string, keyvals ...interface{})  {}
+func (discardLogger) Error(msg string, keyvals ...interface{}) {}
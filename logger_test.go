@@ -0,0 +1,113 @@
+package bbolt_test
+
+import (
+	"sync"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// logEntry is a message logged to a recordingLogger.
+type logEntry struct {
+	level   string
+	msg     string
+	keyvals map[string]interface{}
+}
+
+// recordingLogger records the messages logged to it.
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) log(level, msg string, keyvals []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(keyvals)%2 != 0 {
+		panic("odd number of keyvals: " + msg)
+	}
+	e := logEntry{level: level, msg: msg, keyvals: make(map[string]interface{})}
+	for i := 0; i < len(keyvals); i += 2 {
+		e.keyvals[keyvals[i].(string)] = keyvals[i+1]
+	}
+	l.entries = append(l.entries, e)
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals) }
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals) }
+
+// find returns the entries logged with msg.
+func (l *recordingLogger) find(msg string) []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var entries []logEntry
+	for _, e := range l.entries {
+		if e.msg == msg {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Ensure that remaps, growth, freelist loads and closes are logged.
+func TestOptions_Logger(t *testing.T) {
+	logger := &recordingLogger{}
+	db := MustOpenWithOption(&bolt.Options{Logger: logger})
+	defer db.MustClose()
+	path := db.Path()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := logger.find("mmap"); len(entries) < 2 {
+		t.Fatalf("unexpected mmap entries: %v", entries)
+	} else if e := entries[len(entries)-1]; e.level != "info" || e.keyvals["path"] != path || e.keyvals["size"].(int) < 1000*1000 {
+		t.Fatalf("unexpected mmap entry: %v", e)
+	}
+	if entries := logger.find("grow"); len(entries) == 0 {
+		t.Fatal("expected grow entries")
+	}
+	if entries := logger.find("freelist loaded"); len(entries) != 1 || entries[0].keyvals["source"] != "freelist" {
+		t.Fatalf("unexpected freelist entries: %v", entries)
+	}
+	if entries := logger.find("closed"); len(entries) != 1 || entries[0].keyvals["path"] != path {
+		t.Fatalf("unexpected closed entries: %v", entries)
+	}
+	if entries := logger.find("mmap failed"); len(entries) != 0 {
+		t.Fatalf("unexpected error entries: %v", entries)
+	}
+
+	// A freelist that isn't synced is rebuilt by scanning.
+	db.o = &bolt.Options{NoFreelistSync: true}
+	db.MustReopen()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete(u64tob(0))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logger = &recordingLogger{}
+	db.o = &bolt.Options{Logger: logger, NoFreelistSync: true}
+	db.MustReopen()
+	if entries := logger.find("freelist loaded"); len(entries) != 1 || entries[0].keyvals["source"] != "scan" {
+		t.Fatalf("unexpected freelist entries: %v", entries)
+	}
+}
@@ -0,0 +1,119 @@
+// Package metrics exports the statistics of a bolt database, as returned by
+// DB.Stats, as an expvar variable and in the Prometheus text exposition
+// format.
+//
+// A Collector reads the statistics each time it is exported:
+//
+//	c := metrics.NewCollector(db)
+//	expvar.Publish("bolt", c)
+//	http.Handle("/metrics", c)
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Sample is the value of one metric.
+type Sample struct {
+	Name  string  // metric name, such as "bolt_commits_total"
+	Help  string  // description of the metric
+	Type  string  // "counter" or "gauge"
+	Value float64 // value when the sample was taken
+}
+
+// Collector collects the statistics of a DB. It implements expvar.Var, and
+// http.Handler to serve them in the Prometheus text exposition format.
+type Collector struct {
+	db *bolt.DB
+}
+
+// NewCollector returns a Collector of the statistics of db.
+func NewCollector(db *bolt.DB) *Collector {
+	return &Collector{db: db}
+}
+
+// Samples returns the current value of every metric.
+func (c *Collector) Samples() []Sample {
+	s := c.db.Stats()
+	counter := func(name, help string, v float64) Sample {
+		return Sample{Name: name, Help: help, Type: "counter", Value: v}
+	}
+	gauge := func(name, help string, v float64) Sample {
+		return Sample{Name: name, Help: help, Type: "gauge", Value: v}
+	}
+	return []Sample{
+		gauge("bolt_free_pages", "Number of free pages on the freelist.", float64(s.FreePageN)),
+		gauge("bolt_pending_pages", "Number of pending pages on the freelist.", float64(s.PendingPageN)),
+		gauge("bolt_free_alloc_bytes", "Bytes allocated in free and pending pages.", float64(s.FreeAlloc)),
+		gauge("bolt_freelist_inuse_bytes", "Bytes used by the freelist.", float64(s.FreelistInuse)),
+		gauge("bolt_mmap_size_bytes", "Size of the mmap.", float64(s.MmapSize)),
+		gauge("bolt_file_size_bytes", "Size of the data file.", float64(s.FileSize)),
+		counter("bolt_read_txs_total", "Read transactions started.", float64(s.TxN)),
+		gauge("bolt_open_read_txs", "Read transactions currently open.", float64(s.OpenTxN)),
+		counter("bolt_commits_total", "Write transactions committed.", float64(s.CommitN)),
+		counter("bolt_rollbacks_total", "Write transactions rolled back.", float64(s.RollbackN)),
+		counter("bolt_batches_total", "Batches run by DB.Batch.", float64(s.BatchN)),
+		counter("bolt_batch_calls_total", "Calls run in batches by DB.Batch.", float64(s.BatchCallN)),
+		counter("bolt_page_allocs_total", "Page allocations.", float64(s.TxStats.PageCount)),
+		counter("bolt_page_alloc_bytes_total", "Bytes allocated in pages.", float64(s.TxStats.PageAlloc)),
+		counter("bolt_cursors_total", "Cursors created.", float64(s.TxStats.CursorCount)),
+		counter("bolt_nodes_total", "Node allocations.", float64(s.TxStats.NodeCount)),
+		counter("bolt_node_derefs_total", "Node dereferences.", float64(s.TxStats.NodeDeref)),
+		counter("bolt_rebalances_total", "Node rebalances.", float64(s.TxStats.Rebalance)),
+		counter("bolt_rebalance_seconds_total", "Time spent rebalancing.", s.TxStats.RebalanceTime.Seconds()),
+		counter("bolt_splits_total", "Nodes split.", float64(s.TxStats.Split)),
+		counter("bolt_spills_total", "Nodes spilled.", float64(s.TxStats.Spill)),
+		counter("bolt_spill_seconds_total", "Time spent spilling.", s.TxStats.SpillTime.Seconds()),
+		counter("bolt_writes_total", "Writes to the data file.", float64(s.TxStats.Write)),
+		counter("bolt_page_writes_total", "Pages written to the data file.", float64(s.TxStats.WritePage)),
+		counter("bolt_write_seconds_total", "Time spent writing to the data file.", s.TxStats.WriteTime.Seconds()),
+	}
+}
+
+// String returns the metrics as a JSON object keyed by metric name, for
+// expvar.
+func (c *Collector) String() string {
+	m := make(map[string]float64)
+	for _, s := range c.Samples() {
+		m[s.Name] = s.Value
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text exposition
+// format, labelled with the path of the database.
+func (c *Collector) WritePrometheus(w io.Writer) error {
+	var buf bytes.Buffer
+	labels := fmt.Sprintf(`{path="%s"}`, escapeLabel(c.db.Path()))
+	for _, s := range c.Samples() {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", s.Name, s.Help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", s.Name, s.Type)
+		fmt.Fprintf(&buf, "%s%s %g\n", s.Name, labels, s.Value)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = c.WritePrometheus(w)
+}
+
+// labelEscaper escapes label values in the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
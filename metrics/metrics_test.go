@@ -0,0 +1,172 @@
+package metrics_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/bbolt/metrics"
+)
+
+// mustOpenDB returns a database with 3 commits, 1 rollback, a batch of 4 calls
+// and an open read transaction, and a function to close it.
+func mustOpenDB(t *testing.T) (*bolt.DB, func()) {
+	dir, err := ioutil.TempDir("", "bolt-metrics-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(fmt.Sprint(i)), []byte("bar"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return errors.New("rollback")
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The batch runs once all 4 calls have been added.
+	db.MaxBatchSize, db.MaxBatchDelay = 4, time.Hour
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Batch(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("widgets")).Put([]byte(fmt.Sprint("batch", i)), []byte("bar"))
+			}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() {
+		_ = rtx.Rollback()
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// expectSamples checks the values of the counters and gauges set up by
+// mustOpenDB.
+func expectSamples(t *testing.T, values map[string]float64) {
+	for name, want := range map[string]float64{
+		"bolt_commits_total":     3,
+		"bolt_rollbacks_total":   1,
+		"bolt_batches_total":     1,
+		"bolt_batch_calls_total": 4,
+		"bolt_open_read_txs":     1,
+	} {
+		if v, ok := values[name]; !ok || v != want {
+			t.Errorf("%s: unexpected value: %v", name, v)
+		}
+	}
+	for _, name := range []string{"bolt_mmap_size_bytes", "bolt_file_size_bytes", "bolt_freelist_inuse_bytes", "bolt_read_txs_total"} {
+		if values[name] <= 0 {
+			t.Errorf("%s: unexpected value: %v", name, values[name])
+		}
+	}
+}
+
+// Ensure that the metrics are served in the Prometheus text format.
+func TestCollector_ServeHTTP(t *testing.T) {
+	db, closeDB := mustOpenDB(t)
+	defer closeDB()
+	srv := httptest.NewServer(metrics.NewCollector(db))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+
+	labels := fmt.Sprintf(`{path="%s"}`, db.Path())
+	values := make(map[string]float64)
+	types := make(map[string]string)
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			f := strings.Fields(line)
+			types[f[2]] = f[3]
+			continue
+		} else if strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 || !strings.HasSuffix(f[0], labels) {
+			t.Fatalf("unexpected line: %s", line)
+		}
+		v, err := strconv.ParseFloat(f[1], 64)
+		if err != nil {
+			t.Fatalf("unexpected line: %s", line)
+		}
+		values[strings.TrimSuffix(f[0], labels)] = v
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expectSamples(t, values)
+	if types["bolt_commits_total"] != "counter" || types["bolt_open_read_txs"] != "gauge" {
+		t.Fatalf("unexpected types: %v", types)
+	}
+}
+
+// Ensure that the metrics are published with expvar.
+func TestCollector_Expvar(t *testing.T) {
+	db, closeDB := mustOpenDB(t)
+	defer closeDB()
+	// Variables can't be unpublished, so each run uses its own name.
+	name := fmt.Sprintf("bolt-%p", db)
+	expvar.Publish(name, metrics.NewCollector(db))
+	srv := httptest.NewServer(expvar.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	var values map[string]float64
+	if err := json.Unmarshal(vars[name], &values); err != nil {
+		t.Fatal(err)
+	}
+	expectSamples(t, values)
+}
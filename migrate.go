@@ -0,0 +1,44 @@
+package bbolt
+
+import "fmt"
+
+// migrations upgrade database files written with older versions of the file
+// format. migrations[v] upgrades a file of version v to version v+1, inside
+// the write transaction that then records the new version in the meta page.
+//
+// A file of an older version can be opened read only if every migration from
+// its version up to the current one is registered, so a migration may only be
+// registered for versions the current code reads correctly as they are.
+// Writable opens require Options.Upgrade.
+//
+// Versions here are format versions. Files using optional features record
+// theirs with format.FeatureVersionFlag set, which is cleared before looking
+// up migrations, so the features don't take up a version number.
+var migrations = map[uint32]func(tx *Tx) error{}
+
+// upgradable returns whether files of version v, older than the current
+// version, can be read and upgraded.
+func upgradable(v uint32) bool {
+	if v >= version {
+		return false
+	}
+	for ; v < version; v++ {
+		if migrations[v] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// upgrade runs the migrations from the version of the current meta page up
+// to the current version in a single write transaction.
+func (db *DB) upgrade() error {
+	return db.Update(func(tx *Tx) error {
+		for v := tx.meta.formatVersion(); v < version; v++ {
+			if err := migrations[v](tx); err != nil {
+				return fmt.Errorf("upgrade from version %d: %s", v, err)
+			}
+		}
+		return nil
+	})
+}
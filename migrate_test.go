@@ -0,0 +1,216 @@
+package bbolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"go.etcd.io/bbolt/internal/format"
+)
+
+// Ensure that a database of an older version can be read, is only written
+// once upgraded, and can be upgraded in place or as a copy.
+func TestOpen_Upgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+
+	db, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rewriteMetas(t, path, func(m *meta) { m.version = version - 1 })
+
+	// Without a migration the old version can't be read at all.
+	if _, err := Open(path, 0666, &Options{ReadOnly: true}); err != ErrVersionMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	migrations[version-1] = func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("upgraded"))
+		return err
+	}
+	defer delete(migrations, version-1)
+
+	if _, err := Open(path, 0666, nil); err != ErrUpgradeRequired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Read only opens read the old version as it is, and can copy it.
+	dst := filepath.Join(dir, "copy")
+	db, err = Open(path, 0666, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return tx.CopyFile(dst, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upgrading the copy leaves the original as it was.
+	checkUpgraded(t, dst)
+	db, err = Open(path, 0666, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if v := db.meta().version; v != version-1 {
+		t.Fatalf("unexpected original version: %d", v)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkUpgraded(t, path)
+}
+
+// Ensure that a database of an older version that uses optional features is
+// upgraded from its format version.
+func TestOpen_UpgradeFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+
+	db, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rewriteMetas(t, path, func(m *meta) {
+		m.version, m.flags = format.FeatureVersionFlag|(version-1), metaFlagFreelistDelta
+	})
+
+	migrations[version-1] = func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("upgraded"))
+		return err
+	}
+	defer delete(migrations, version-1)
+
+	if _, err := Open(path, 0666, nil); err != ErrUpgradeRequired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkUpgraded(t, path)
+}
+
+// checkUpgraded upgrades the database at path and checks that the migration
+// ran and the current version was recorded.
+func checkUpgraded(t *testing.T, path string) {
+	db, err := Open(path, 0666, &Options{Upgrade: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := db.meta().formatVersion(); v != version {
+		t.Fatalf("unexpected version: %d", v)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("upgraded")) == nil {
+			t.Fatal("expected the migration to run")
+		} else if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upgraded database opens without Options.Upgrade.
+	db, err = Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a database using unknown read only compatible features can only
+// be read, and one using other unknown features not at all.
+func TestOpen_UnknownFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+
+	db, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rewriteMetas(t, path, func(m *meta) { m.version, m.flags = featureVersion, 0x10000 })
+	if _, err := Open(path, 0666, nil); err != ErrVersionMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db, err = Open(path, 0666, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rewriteMetas(t, path, func(m *meta) { m.flags = 0x100 })
+	if _, err := Open(path, 0666, &Options{ReadOnly: true}); err != ErrVersionMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// rewriteMetas applies fn to both meta pages of the closed database at path,
+// updating their checksums.
+func rewriteMetas(t *testing.T, path string, fn func(*meta)) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := int((*page)(unsafe.Pointer(&buf[0])).meta().pageSize)
+	for i := 0; i < 2; i++ {
+		m := (*page)(unsafe.Pointer(&buf[i*pageSize])).meta()
+		fn(m)
+		m.checksum = m.sum64()
+	}
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
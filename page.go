@@ -5,27 +5,83 @@ import (
 	"os"
 	"sort"
 	"unsafe"
+
+	"go.etcd.io/bbolt/internal/format"
 )
 
-const pageHeaderSize = int(unsafe.Offsetof(((*page)(nil)).ptr))
+const pageHeaderSize = format.PageHeaderSize
 
 const minKeysPerPage = 2
 
-const branchPageElementSize = int(unsafe.Sizeof(branchPageElement{}))
-const leafPageElementSize = int(unsafe.Sizeof(leafPageElement{}))
+const branchPageElementSize = format.BranchPageElementSize
+const leafPageElementSize = format.LeafPageElementSize
 
 const (
-	branchPageFlag   = 0x01
-	leafPageFlag     = 0x02
-	metaPageFlag     = 0x04
-	freelistPageFlag = 0x10
+	branchPageFlag   = format.BranchPageFlag
+	leafPageFlag     = format.LeafPageFlag
+	metaPageFlag     = format.MetaPageFlag
+	freelistPageFlag = format.FreelistPageFlag
+
+	freelistDeltaPageFlag = format.FreelistDeltaPageFlag
+	freelistHintPageFlag  = format.FreelistHintPageFlag
 )
 
 const (
-	bucketLeafFlag = 0x01
+	bucketLeafFlag = format.BucketLeafFlag
+)
+
+// The page, meta, bucket, element and freelist header types mirror those of
+// the format package, which the bbolt command reads files with. Each line
+// fails to compile unless the two sizes or offsets are equal: only index 0 of
+// a one element array is valid, and a negative difference overflows.
+var (
+	_ = [1]struct{}{}[unsafe.Sizeof(page{})-unsafe.Sizeof(format.Page{})]
+	_ = [1]struct{}{}[unsafe.Offsetof(page{}.id)-unsafe.Offsetof(format.Page{}.ID)]
+	_ = [1]struct{}{}[unsafe.Offsetof(page{}.flags)-unsafe.Offsetof(format.Page{}.Flags)]
+	_ = [1]struct{}{}[unsafe.Offsetof(page{}.count)-unsafe.Offsetof(format.Page{}.Count)]
+	_ = [1]struct{}{}[unsafe.Offsetof(page{}.overflow)-unsafe.Offsetof(format.Page{}.Overflow)]
+	_ = [1]struct{}{}[unsafe.Offsetof(page{}.ptr)-unsafe.Offsetof(format.Page{}.Ptr)]
+
+	_ = [1]struct{}{}[unsafe.Sizeof(meta{})-unsafe.Sizeof(format.Meta{})]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.magic)-unsafe.Offsetof(format.Meta{}.Magic)]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.version)-unsafe.Offsetof(format.Meta{}.Version)]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.pageSize)-unsafe.Offsetof(format.Meta{}.PageSize)]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.flags)-unsafe.Offsetof(format.Meta{}.Flags)]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.root)-unsafe.Offsetof(format.Meta{}.Root)]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.freelist)-unsafe.Offsetof(format.Meta{}.Freelist)]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.pgid)-unsafe.Offsetof(format.Meta{}.Pgid)]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.txid)-unsafe.Offsetof(format.Meta{}.Txid)]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.checksum)-unsafe.Offsetof(format.Meta{}.Checksum)]
+
+	_ = [1]struct{}{}[unsafe.Sizeof(bucket{})-unsafe.Sizeof(format.Bucket{})]
+	_ = [1]struct{}{}[unsafe.Offsetof(bucket{}.root)-unsafe.Offsetof(format.Bucket{}.Root)]
+	_ = [1]struct{}{}[unsafe.Offsetof(bucket{}.sequence)-unsafe.Offsetof(format.Bucket{}.Sequence)]
+
+	_ = [1]struct{}{}[unsafe.Sizeof(branchPageElement{})-unsafe.Sizeof(format.BranchPageElement{})]
+	_ = [1]struct{}{}[unsafe.Offsetof(branchPageElement{}.pos)-unsafe.Offsetof(format.BranchPageElement{}.Pos)]
+	_ = [1]struct{}{}[unsafe.Offsetof(branchPageElement{}.ksize)-unsafe.Offsetof(format.BranchPageElement{}.Ksize)]
+	_ = [1]struct{}{}[unsafe.Offsetof(branchPageElement{}.pgid)-unsafe.Offsetof(format.BranchPageElement{}.Pgid)]
+
+	_ = [1]struct{}{}[unsafe.Sizeof(leafPageElement{})-unsafe.Sizeof(format.LeafPageElement{})]
+	_ = [1]struct{}{}[unsafe.Offsetof(leafPageElement{}.flags)-unsafe.Offsetof(format.LeafPageElement{}.Flags)]
+	_ = [1]struct{}{}[unsafe.Offsetof(leafPageElement{}.pos)-unsafe.Offsetof(format.LeafPageElement{}.Pos)]
+	_ = [1]struct{}{}[unsafe.Offsetof(leafPageElement{}.ksize)-unsafe.Offsetof(format.LeafPageElement{}.Ksize)]
+	_ = [1]struct{}{}[unsafe.Offsetof(leafPageElement{}.vsize)-unsafe.Offsetof(format.LeafPageElement{}.Vsize)]
+
+	_ = [1]struct{}{}[unsafe.Sizeof(freelistDelta{})-unsafe.Sizeof(format.FreelistDelta{})]
+	_ = [1]struct{}{}[unsafe.Offsetof(freelistDelta{}.prev)-unsafe.Offsetof(format.FreelistDelta{}.Prev)]
+	_ = [1]struct{}{}[unsafe.Offsetof(freelistDelta{}.txid)-unsafe.Offsetof(format.FreelistDelta{}.Txid)]
+	_ = [1]struct{}{}[unsafe.Offsetof(freelistDelta{}.depth)-unsafe.Offsetof(format.FreelistDelta{}.Depth)]
+	_ = [1]struct{}{}[unsafe.Offsetof(freelistDelta{}.allocN)-unsafe.Offsetof(format.FreelistDelta{}.AllocN)]
+	_ = [1]struct{}{}[unsafe.Offsetof(freelistDelta{}.freeN)-unsafe.Offsetof(format.FreelistDelta{}.FreeN)]
+
+	_ = [1]struct{}{}[unsafe.Sizeof(freelistHint{})-unsafe.Sizeof(format.FreelistHint{})]
+	_ = [1]struct{}{}[unsafe.Offsetof(freelistHint{}.txid)-unsafe.Offsetof(format.FreelistHint{}.Txid)]
+	_ = [1]struct{}{}[unsafe.Offsetof(freelistHint{}.count)-unsafe.Offsetof(format.FreelistHint{}.Count)]
+	_ = [1]struct{}{}[unsafe.Offsetof(freelistHint{}.checksum)-unsafe.Offsetof(format.FreelistHint{}.Checksum)]
 )
 
-type pgid uint64
+type pgid = format.Pgid
 
 type page struct {
 	id       pgid
@@ -37,16 +93,12 @@ type page struct {
 
 // typ returns a human readable page type string used for debugging.
 func (p *page) typ() string {
-	if (p.flags & branchPageFlag) != 0 {
-		return "branch"
-	} else if (p.flags & leafPageFlag) != 0 {
-		return "leaf"
-	} else if (p.flags & metaPageFlag) != 0 {
-		return "meta"
-	} else if (p.flags & freelistPageFlag) != 0 {
-		return "freelist"
-	}
-	return fmt.Sprintf("unknown<%02x>", p.flags)
+	return p.format().Type()
+}
+
+// format returns the page as its format package equivalent.
+func (p *page) format() *format.Page {
+	return (*format.Page)(unsafe.Pointer(p))
 }
 
 // meta returns a pointer to the metadata section of the page.
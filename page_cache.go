@@ -0,0 +1,141 @@
+package bbolt
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// pageCache is a bounded LRU cache of pages read from the data file. It takes
+// the place of the mmap when the database is opened with AccessModePread.
+//
+// Cached pages are never modified or reused, so transactions may hold on to
+// them after they are evicted. Pages are removed when they are rewritten.
+type pageCache struct {
+	mu    sync.Mutex
+	limit int // maximum number of pages held, counting overflow
+	n     int // number of pages held, counting overflow
+	lru   *list.List
+	items map[pgid]*list.Element
+}
+
+// newPageCache returns an empty page cache that holds up to limit pages.
+func newPageCache(limit int) *pageCache {
+	return &pageCache{
+		limit: limit,
+		lru:   list.New(),
+		items: make(map[pgid]*list.Element),
+	}
+}
+
+// get returns the cached page with the given id, or nil if it is not cached.
+func (c *pageCache) get(id pgid) *page {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*page)
+}
+
+// put adds a page to the cache, evicting the least recently used pages while
+// the cache is over its limit.
+func (c *pageCache) put(p *page) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(p.id)
+	c.items[p.id] = c.lru.PushFront(p)
+	c.n += int(p.overflow) + 1
+	for c.n > c.limit && c.lru.Len() > 1 {
+		c.removeLocked(c.lru.Back().Value.(*page).id)
+	}
+}
+
+// remove drops any cached pages starting within the n pages from id.
+func (c *pageCache) remove(id pgid, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := pgid(0); i < pgid(n); i++ {
+		c.removeLocked(id + i)
+	}
+}
+
+func (c *pageCache) removeLocked(id pgid) {
+	if e, ok := c.items[id]; ok {
+		c.n -= int(e.Value.(*page).overflow) + 1
+		c.lru.Remove(e)
+		delete(c.items, id)
+	}
+}
+
+// readPage returns the page with the given id from the page cache, reading
+// it and any overflow from the data file if it is not cached.
+func (db *DB) readPage(id pgid) *page {
+	if p := db.pageCache.get(id); p != nil {
+		return p
+	}
+
+	offset := int64(id) * int64(db.pageSize)
+	buf := make([]byte, db.pageSize)
+	if _, err := db.file.ReadAt(buf, offset); err != nil {
+		panic(fmt.Sprintf("page %d: read error: %s", id, err))
+	}
+	if overflow := int((*page)(unsafe.Pointer(&buf[0])).overflow); overflow > 0 {
+		if int64(overflow) >= int64(db.datasz/db.pageSize) {
+			panic(fmt.Sprintf("page %d: overflow out of bounds: %d", id, overflow))
+		}
+		buf = append(buf, make([]byte, overflow*db.pageSize)...)
+		if _, err := db.file.ReadAt(buf[db.pageSize:], offset+int64(db.pageSize)); err != nil {
+			panic(fmt.Sprintf("page %d: read error: %s", id, err))
+		}
+	}
+
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	db.pageCache.put(p)
+	return p
+}
+
+// pread stands in for mmap when pages are read through the page cache. It
+// sizes the data region like mmap would and reads in the meta pages, without
+// waiting for open read transactions.
+func (db *DB) pread(minsz int) error {
+	fsize, err := db.file.Size()
+	if err != nil {
+		return fmt.Errorf("pread stat error: %s", err)
+	} else if int(fsize) < db.pageSize*2 {
+		return fmt.Errorf("file size too small")
+	}
+
+	// Ensure the size is at least the minimum size.
+	var size = int(fsize)
+	if size < minsz {
+		size = minsz
+	}
+	if db.datasz, err = db.mmapSize(size); err != nil {
+		return err
+	}
+	db.setSizeStats(db.datasz, int(fsize))
+
+	// Once read, the meta pages are kept current by Tx.writeMeta.
+	if db.meta0 != nil {
+		return nil
+	}
+	buf := make([]byte, db.pageSize*2)
+	if _, err := db.file.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("pread meta error: %s", err)
+	}
+	db.meta0 = db.pageInBuffer(buf, 0).meta()
+	db.meta1 = db.pageInBuffer(buf, 1).meta()
+
+	// Validate the meta pages, as mmap does.
+	err0 := db.meta0.validate()
+	err1 := db.meta1.validate()
+	if err0 != nil && err1 != nil {
+		return err0
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// scanProgressInterval is the number of reachable pages scanned between
+// progress reports.
+const scanProgressInterval = 4096
+
+// pageScan tracks the pages reachable from a set of bucket roots, verifying
+// the structure of each page on the way. The subtrees of child buckets are
+// handed to new goroutines while there is room. It is shared by freelist
+// recovery and Tx.Check.
+type pageScan struct {
+	tx    *Tx
+	limit pgid     // pages from here on are out of bounds
+	seen  []uint32 // bitset of reachable page ids
+	sem   chan struct{}
+	wg    sync.WaitGroup
+
+	// fail reports an inconsistency. It may be called concurrently. The
+	// subtree below the offending page is not walked.
+	fail func(*CheckError)
+
+	// freed holds the ids of free pages, if they should be reported as an
+	// inconsistency when reachable. It must not be modified during the scan.
+	freed map[pgid]bool
+
+	// reachOnly limits the scan to the errors that stop pages being reached:
+	// pages out of bounds, referenced more than once or of an invalid type.
+	// The elements, keys and inline buckets of pages aren't verified, and
+	// elements that lie outside their page are skipped.
+	reachOnly bool
+
+	scanned    int64
+	progressMu sync.Mutex
+	progress   func(scannedN int, done bool)
+}
+
+// branchRef identifies the branch page element that refers to a page.
+type branchRef struct {
+	pgid  pgid
+	index int
+	key   []byte
+}
+
+// newPageScan returns a scan of the pages of tx that uses up to parallelism
+// goroutines, or GOMAXPROCS if parallelism is not positive.
+func newPageScan(tx *Tx, parallelism int) *pageScan {
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	return &pageScan{
+		tx:    tx,
+		limit: tx.meta.pgid,
+		seen:  make([]uint32, (tx.meta.pgid+31)/32),
+		sem:   make(chan struct{}, parallelism-1),
+	}
+}
+
+// errorf reports an inconsistency found at element index of page id, which
+// belongs to the bucket at path.
+func (s *pageScan) errorf(kind CheckErrorKind, id pgid, path [][]byte, index int, format string, a ...interface{}) {
+	e := &CheckError{Kind: kind, PageID: int(id), Index: index}
+	for _, name := range path {
+		e.Bucket = append(e.Bucket, cloneBytes(name))
+	}
+	if format != "" {
+		e.Detail = fmt.Sprintf(format, a...)
+	}
+	s.fail(e)
+}
+
+// walk marks every page of the tree rooted at id, along with the trees of any
+// buckets found on its leaf pages. The tree belongs to the bucket at path.
+// ref is the branch element referring to the page, if any.
+func (s *pageScan) walk(id pgid, path [][]byte, ref *branchRef) {
+	if id >= s.limit {
+		s.errorf(CheckOutOfBounds, id, path, -1, "%d", int(s.limit))
+		return
+	}
+	p := s.tx.page(id)
+	if p.id+pgid(p.overflow) >= s.limit {
+		s.errorf(CheckOutOfBounds, p.id+pgid(p.overflow), path, -1, "%d", int(s.limit))
+		return
+	}
+
+	// Ensure each page is only referenced once. A page seen before is not
+	// walked again, so that cycles end.
+	for i := pgid(0); i <= pgid(p.overflow); i++ {
+		if !s.mark(p.id + i) {
+			s.errorf(CheckMultipleReferences, p.id+i, path, -1, "")
+			return
+		}
+	}
+	if n := atomic.AddInt64(&s.scanned, int64(p.overflow)+1); n/scanProgressInterval != (n-int64(p.overflow)-1)/scanProgressInterval {
+		s.report(false)
+	}
+
+	// We should only encounter un-freed leaf and branch pages.
+	if s.freed[p.id] {
+		s.errorf(CheckReachableFreed, p.id, path, -1, "")
+	}
+	if (p.flags&branchPageFlag) == 0 && (p.flags&leafPageFlag) == 0 {
+		s.errorf(CheckInvalidType, p.id, path, -1, "%s", p.typ())
+		return
+	}
+	count := int(p.count)
+	if s.reachOnly {
+		count, _ = checkElements(p, (int(p.overflow)+1)*s.tx.db.pageSize)
+	} else if !s.checkPage(p, p.id, (int(p.overflow)+1)*s.tx.db.pageSize, path) {
+		return
+	}
+
+	// The branch key referring to a page is the page's first key.
+	if !s.reachOnly && ref != nil && p.count > 0 {
+		var first []byte
+		if (p.flags & branchPageFlag) != 0 {
+			first = p.branchPageElement(0).key()
+		} else {
+			first = p.leafPageElement(0).key()
+		}
+		if !bytes.Equal(first, ref.key) {
+			s.errorf(CheckBranchKeyMismatch, ref.pgid, path, ref.index, "first key of page %d is %x, not %x", int(p.id), first, ref.key)
+		}
+	}
+
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < count; i++ {
+			elem := p.branchPageElement(uint16(i))
+			s.walk(elem.pgid, path, &branchRef{pgid: p.id, index: i, key: elem.key()})
+		}
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		elem := p.leafPageElement(uint16(i))
+		if (elem.flags & bucketLeafFlag) == 0 {
+			continue
+		}
+		child := append(path[:len(path):len(path)], elem.key())
+		value := elem.value()
+		if len(value) < bucketHeaderSize {
+			if s.reachOnly {
+				continue
+			}
+			s.errorf(CheckInvalidBucket, p.id, path, i, "value too short: %d", len(value))
+			continue
+		}
+		if brokenUnaligned {
+			value = cloneBytes(value)
+		}
+		if root := (*bucket)(unsafe.Pointer(&value[0])).root; root != 0 {
+			s.spawn(root, child)
+		} else if !s.reachOnly {
+			s.checkInline(value, p.id, i, path, child)
+		}
+	}
+}
+
+// checkPage verifies that the elements of p lie within its size in bytes and
+// that its keys are sorted, reporting errors against page id. It returns false
+// if the elements can't be read.
+func (s *pageScan) checkPage(p *page, id pgid, size int, path [][]byte) bool {
+	if _, e := checkElements(p, size); e != nil {
+		s.errorf(e.Kind, id, path, e.Index, "%s", e.Detail)
+		return false
+	}
+
+	var prev []byte
+	for i := 0; i < int(p.count); i++ {
+		var key []byte
+		if (p.flags & branchPageFlag) != 0 {
+			key = p.branchPageElement(uint16(i)).key()
+		} else {
+			key = p.leafPageElement(uint16(i)).key()
+		}
+		if i > 0 && bytes.Compare(prev, key) >= 0 {
+			s.errorf(CheckUnsortedKeys, id, path, i, "%x follows %x", key, prev)
+		}
+		prev = key
+	}
+	return true
+}
+
+// checkElements returns the number of leading elements of p that lie within
+// its size in bytes, along with an error describing the first that doesn't.
+// The error's PageID and Bucket are left for the caller to fill in.
+func checkElements(p *page, size int) (int, *CheckError) {
+	n, e := p.format().CheckElements(size)
+	if e != nil {
+		return n, &CheckError{Kind: CheckElementOutOfBounds, Index: e.Index, Detail: e.Detail}
+	}
+	return n, nil
+}
+
+// checkInline verifies the page of an inline bucket, stored in value at
+// element index of page id.
+func (s *pageScan) checkInline(value []byte, id pgid, index int, path, child [][]byte) {
+	if len(value) < bucketHeaderSize+pageHeaderSize {
+		s.errorf(CheckInvalidBucket, id, path, index, "inline value too short: %d", len(value))
+		return
+	}
+	p := (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
+	if (p.flags&leafPageFlag) == 0 || p.overflow != 0 {
+		s.errorf(CheckInvalidBucket, id, path, index, "inline page is %s with %d overflow", p.typ(), p.overflow)
+		return
+	}
+	if !s.checkPage(p, id, len(value)-bucketHeaderSize, child) {
+		return
+	}
+	for i := 0; i < int(p.count); i++ {
+		if (p.leafPageElement(uint16(i)).flags & bucketLeafFlag) != 0 {
+			s.errorf(CheckInvalidBucket, id, path, index, "inline bucket holds bucket at element %d", i)
+			return
+		}
+	}
+}
+
+// spawn walks the tree rooted at id on a new goroutine if one is available,
+// or on the current goroutine otherwise.
+func (s *pageScan) spawn(id pgid, path [][]byte) {
+	select {
+	case s.sem <- struct{}{}:
+		s.wg.Add(1)
+		go func() {
+			defer func() {
+				<-s.sem
+				s.wg.Done()
+			}()
+			s.walk(id, path, nil)
+		}()
+	default:
+		s.walk(id, path, nil)
+	}
+}
+
+// mark records id as reachable. It returns false if it already was.
+func (s *pageScan) mark(id pgid) bool {
+	addr, bit := &s.seen[id/32], uint32(1)<<(id%32)
+	for {
+		old := atomic.LoadUint32(addr)
+		if old&bit != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(addr, old, old|bit) {
+			return true
+		}
+	}
+}
+
+// marked returns whether id has been marked reachable.
+func (s *pageScan) marked(id pgid) bool {
+	return atomic.LoadUint32(&s.seen[id/32])&(uint32(1)<<(id%32)) != 0
+}
+
+// report calls the progress function, if any, one call at a time.
+func (s *pageScan) report(done bool) {
+	if s.progress == nil {
+		return
+	}
+	s.progressMu.Lock()
+	defer s.progressMu.Unlock()
+	s.progress(int(atomic.LoadInt64(&s.scanned)), done)
+}
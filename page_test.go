@@ -21,6 +21,12 @@ func TestPage_typ(t *testing.T) {
 	if typ := (&page{flags: freelistPageFlag}).typ(); typ != "freelist" {
 		t.Fatalf("exp=freelist; got=%v", typ)
 	}
+	if typ := (&page{flags: freelistDeltaPageFlag}).typ(); typ != "freelist-delta" {
+		t.Fatalf("exp=freelist-delta; got=%v", typ)
+	}
+	if typ := (&page{flags: freelistHintPageFlag}).typ(); typ != "freelist-hint" {
+		t.Fatalf("exp=freelist-hint; got=%v", typ)
+	}
 	if typ := (&page{flags: 20000}).typ(); typ != "unknown<4e20>" {
 		t.Fatalf("exp=unknown<4e20>; got=%v", typ)
 	}
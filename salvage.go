@@ -0,0 +1,449 @@
+package bbolt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"unsafe"
+
+	"go.etcd.io/bbolt/internal/format"
+)
+
+// salvageTxMaxSize is the number of bytes of keys and values Salvage writes in
+// each transaction.
+const salvageTxMaxSize = 1 << 20
+
+// SalvageLostFound is the top-level bucket of the destination that Salvage
+// copies unreached leaf pages into.
+const SalvageLostFound = "lost+found"
+
+// SalvageReport describes what Salvage recovered from a damaged database and
+// what it lost.
+type SalvageReport struct {
+	// Txid is the id of the transaction whose meta page was read, or 0 if
+	// neither meta page is valid.
+	Txid int
+
+	// BucketN and KeyN are the number of buckets and key/value pairs
+	// recovered, including those on unreached pages.
+	BucketN int
+	KeyN    int
+
+	// OrphanPageN is the number of unreached leaf pages copied to the
+	// SalvageLostFound bucket.
+	OrphanPageN int
+
+	// Lost describes each part of the database that couldn't be recovered,
+	// along with whatever is below it.
+	Lost []*CheckError
+}
+
+// Salvage copies every bucket and key/value pair that can be read from the
+// database file at path into dst, skipping the pages and elements that are
+// damaged. The file is read directly rather than opened as a DB, so it may
+// be too damaged to open or check. Options.Storage and Options.OpenFile are
+// used to open it read only.
+//
+// The newest valid meta page is used. Keys are written to dst in batches of
+// normal transactions, so dst holds whatever was recovered if an error is
+// returned part way.
+//
+// If anything was lost, or both meta pages are damaged, leaf pages that can't
+// be reached from the root are then copied to the SalvageLostFound bucket of
+// dst, in a bucket per page named by its page id. Their buckets' paths are
+// unknown. Pages on the file's freelist are skipped, but if the freelist
+// can't be read, or wasn't synced, the copied pages may hold old versions of
+// keys.
+func Salvage(path string, dst *DB, options *Options) (*SalvageReport, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+	storage := options.Storage
+	if storage == nil {
+		storage = OSStorage{OpenFile: options.OpenFile}
+	}
+	f, err := storage.Open(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	return SalvageReader(f, size, dst)
+}
+
+// SalvageReader is like Salvage, but reads the database from the first size
+// bytes of r.
+func SalvageReader(r io.ReaderAt, size int64, dst *DB) (*SalvageReport, error) {
+	s := &salvager{
+		r:      r,
+		seen:   make(map[pgid]bool),
+		dst:    dst,
+		report: &SalvageReport{},
+	}
+	m, metaErr := salvageMeta(r)
+	if m != nil {
+		s.pageSize = int(m.PageSize)
+		s.limit = m.Pgid
+		s.report.Txid = int(m.Txid)
+	} else if s.pageSize = salvagePageSize(r, size); s.pageSize == 0 {
+		return nil, metaErr
+	} else {
+		s.limit = pgid(size / int64(s.pageSize))
+	}
+	if n := pgid(size / int64(s.pageSize)); n < s.limit {
+		s.limit = n
+	}
+
+	var err error
+	if s.tx, err = dst.Begin(true); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if s.tx != nil {
+			_ = s.tx.Rollback()
+		}
+	}()
+
+	var freed map[pgid]bool
+	if m != nil {
+		if err := s.tree(m.Root.Root, nil); err != nil {
+			return nil, err
+		}
+		freed = s.freed(m.Freelist)
+	}
+
+	// Unreached pages only hold keys that weren't recovered if part of the
+	// tree was lost. Otherwise they are stale, whether or not they are on a
+	// freelist that was synced.
+	if m == nil || len(s.report.Lost) > 0 {
+		if err := s.orphans(freed); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil && s.report.OrphanPageN == 0 {
+		return nil, metaErr
+	}
+
+	err = s.tx.Commit()
+	s.tx = nil
+	if err != nil {
+		return nil, err
+	}
+	return s.report, nil
+}
+
+// salvageMeta returns the newest valid meta page of r. The page size is read
+// from the first meta page or, if that is damaged, guessed.
+func salvageMeta(r io.ReaderAt) (*format.Meta, error) {
+	best, err := format.ReadMeta(r, defaultPageSize, 0)
+	pageSizes := salvagePageSizes()
+	if best != nil {
+		pageSizes = append([]int{int(best.PageSize)}, pageSizes...)
+	}
+
+	// Look for the second meta page one page in.
+	for _, pageSize := range pageSizes {
+		m, e := format.ReadMeta(r, pageSize, 1)
+		if e != nil || int(m.PageSize) != pageSize {
+			continue
+		}
+		if best == nil || m.Txid > best.Txid {
+			best = m
+		}
+	}
+	if best == nil {
+		return nil, err
+	}
+	return best, nil
+}
+
+// salvagePageSizes returns the page sizes tried when the first meta page is
+// damaged, most likely first.
+func salvagePageSizes() []int {
+	return []int{os.Getpagesize(), 4096, 512, 1024, 2048, 8192, 16384, 32768, 65536}
+}
+
+// salvagePageSize guesses the page size of a database of size bytes in r
+// whose meta pages are both damaged. Each page records its own id, so the
+// page size that finds the most ids in place among the first pages wins. It
+// returns 0 if none are found.
+func salvagePageSize(r io.ReaderAt, size int64) int {
+	var best, bestN int
+	for _, pageSize := range salvagePageSizes() {
+		var n int
+		for id := pgid(2); id < 1024 && int64(id+1)*int64(pageSize) <= size; id++ {
+			var buf [8]byte
+			if _, err := r.ReadAt(buf[:], int64(id)*int64(pageSize)); err != nil {
+				break
+			} else if *(*pgid)(unsafe.Pointer(&buf[0])) == id {
+				n++
+			}
+		}
+		if n > bestN {
+			best, bestN = pageSize, n
+		}
+	}
+	return best
+}
+
+// salvager copies what it can read of a damaged database into another.
+type salvager struct {
+	r        io.ReaderAt
+	pageSize int
+	limit    pgid // pages from here on are out of bounds
+	seen     map[pgid]bool
+
+	// orphan is set while unreached pages are copied. Bucket roots aren't
+	// followed then, as their pages are copied on their own.
+	orphan bool
+
+	dst    *DB
+	tx     *Tx
+	size   int // bytes written by tx
+	report *SalvageReport
+}
+
+// lose records that the part of the bucket at path described by e was lost.
+func (s *salvager) lose(e *CheckError, id pgid, path [][]byte) {
+	e.PageID = int(id)
+	for _, name := range path {
+		e.Bucket = append(e.Bucket, cloneBytes(name))
+	}
+	s.report.Lost = append(s.report.Lost, e)
+}
+
+// page reads the page with the given id, or returns an error describing why
+// it can't be read.
+func (s *salvager) page(id pgid) (*page, *CheckError, error) {
+	if id >= s.limit {
+		return nil, &CheckError{Kind: CheckOutOfBounds, Index: -1, Detail: fmt.Sprintf("%d", int(s.limit))}, nil
+	} else if s.seen[id] {
+		return nil, &CheckError{Kind: CheckMultipleReferences, Index: -1}, nil
+	}
+	s.seen[id] = true
+
+	p, err := s.read(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if (p.flags&branchPageFlag) == 0 && (p.flags&leafPageFlag) == 0 {
+		return nil, &CheckError{Kind: CheckInvalidType, Index: -1, Detail: p.typ()}, nil
+	} else if id+pgid(p.overflow) >= s.limit {
+		return nil, &CheckError{Kind: CheckOutOfBounds, Index: -1, Detail: fmt.Sprintf("%d", int(s.limit))}, nil
+	}
+	return p, nil, nil
+}
+
+// read reads page id along with its overflow pages, unless they reach the
+// limit. Pages are read into new buffers, which are never reused.
+func (s *salvager) read(id pgid) (*page, error) {
+	buf := make([]byte, s.pageSize)
+	if _, err := s.r.ReadAt(buf, int64(id)*int64(s.pageSize)); err != nil {
+		return nil, err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if p.overflow > 0 && id+pgid(p.overflow) < s.limit {
+		buf = make([]byte, (int(p.overflow)+1)*s.pageSize)
+		if _, err := s.r.ReadAt(buf, int64(id)*int64(s.pageSize)); err != nil {
+			return nil, err
+		}
+		p = (*page)(unsafe.Pointer(&buf[0]))
+	}
+	return p, nil
+}
+
+// freed returns the ids on the freelist headed by page id, or nil if it
+// can't be read.
+func (s *salvager) freed(id pgid) map[pgid]bool {
+	if id >= s.limit {
+		return nil
+	}
+	ids, err := format.ReadFreelist(s.r, s.pageSize, id)
+	if err != nil {
+		return nil
+	}
+	freed := make(map[pgid]bool, len(ids))
+	for _, id := range ids {
+		freed[id] = true
+	}
+	return freed
+}
+
+// orphans copies the leaf pages below the limit that weren't reached from
+// the root and aren't freed into the SalvageLostFound bucket. A page is only
+// taken to be a leaf page if it records its own id.
+func (s *salvager) orphans(freed map[pgid]bool) error {
+	s.orphan = true
+	for id := pgid(2); id < s.limit; id++ {
+		if s.seen[id] || freed[id] {
+			continue
+		}
+		p, err := s.read(id)
+		if err != nil {
+			return err
+		} else if p.id != id || p.flags != leafPageFlag || id+pgid(p.overflow) >= s.limit {
+			continue
+		}
+
+		n, lost := checkElements(p, (int(p.overflow)+1)*s.pageSize)
+		if n == 0 && lost == nil {
+			continue
+		}
+		path := [][]byte{[]byte(SalvageLostFound), []byte(strconv.Itoa(int(id)))}
+		if lost != nil {
+			s.lose(lost, id, path)
+		}
+		s.report.OrphanPageN++
+		if err := s.leaf(p, id, n, path); err != nil {
+			return err
+		}
+		id += pgid(p.overflow)
+	}
+	return nil
+}
+
+// tree copies the tree rooted at page id, which belongs to the bucket at path.
+func (s *salvager) tree(id pgid, path [][]byte) error {
+	p, lost, err := s.page(id)
+	if err != nil {
+		return err
+	} else if lost != nil {
+		s.lose(lost, id, path)
+		return nil
+	}
+
+	n, lost := checkElements(p, (int(p.overflow)+1)*s.pageSize)
+	if lost != nil {
+		s.lose(lost, id, path)
+	}
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < n; i++ {
+			if err := s.tree(p.branchPageElement(uint16(i)).pgid, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.leaf(p, id, n, path)
+}
+
+// leaf copies the first n elements of the leaf page p, which is page id or is
+// stored on it, into the bucket at path.
+func (s *salvager) leaf(p *page, id pgid, n int, path [][]byte) error {
+	for i := 0; i < n; i++ {
+		elem := p.leafPageElement(uint16(i))
+		k, v := elem.key(), elem.value()
+		if (elem.flags & bucketLeafFlag) != 0 {
+			if err := s.bucket(v, id, i, append(path[:len(path):len(path)], k)); err != nil {
+				return err
+			}
+			continue
+		} else if len(path) == 0 {
+			s.lose(&CheckError{Kind: CheckInvalidBucket, Index: i, Detail: "value outside of a bucket"}, id, path)
+			continue
+		}
+
+		b, err := s.bucketAt(path)
+		if err == nil {
+			err = b.Put(k, v)
+		}
+		if ok, err := s.written(err, len(k)+len(v), id, i, path); err != nil {
+			return err
+		} else if ok {
+			s.report.KeyN++
+		}
+	}
+	return nil
+}
+
+// bucket creates the bucket at path, stored in value at element index of page
+// id, and copies its contents.
+func (s *salvager) bucket(value []byte, id pgid, index int, path [][]byte) error {
+	if len(value) < bucketHeaderSize {
+		s.lose(&CheckError{Kind: CheckInvalidBucket, Index: index, Detail: fmt.Sprintf("value too short: %d", len(value))}, id, path[:len(path)-1])
+		return nil
+	}
+	if brokenUnaligned {
+		value = cloneBytes(value)
+	}
+	hdr := (*bucket)(unsafe.Pointer(&value[0]))
+	if hdr.root != 0 && s.orphan {
+		return nil
+	}
+
+	b, err := s.bucketAt(path)
+	if err == nil {
+		err = b.SetSequence(hdr.sequence)
+	}
+	if ok, err := s.written(err, len(path[len(path)-1]), id, index, path[:len(path)-1]); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+	s.report.BucketN++
+
+	if hdr.root != 0 {
+		return s.tree(hdr.root, path)
+	}
+
+	// Copy an inline bucket from the page stored after its header.
+	if len(value) < bucketHeaderSize+pageHeaderSize {
+		s.lose(&CheckError{Kind: CheckInvalidBucket, Index: index, Detail: fmt.Sprintf("inline value too short: %d", len(value))}, id, path[:len(path)-1])
+		return nil
+	}
+	p := (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
+	if (p.flags & leafPageFlag) == 0 {
+		s.lose(&CheckError{Kind: CheckInvalidBucket, Index: index, Detail: fmt.Sprintf("inline page is %s", p.typ())}, id, path[:len(path)-1])
+		return nil
+	}
+	n, lost := checkElements(p, len(value)-bucketHeaderSize)
+	if lost != nil {
+		s.lose(lost, id, path)
+	}
+	return s.leaf(p, id, n, path)
+}
+
+// bucketAt returns the bucket at path in the destination, creating it and
+// its parents if necessary.
+func (s *salvager) bucketAt(path [][]byte) (*Bucket, error) {
+	b, err := s.tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			break
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	return b, err
+}
+
+// written handles the result of writing size bytes of element index of page
+// id, in the bucket at path, to the destination. It returns whether the
+// element was written. Elements the destination won't accept are recorded as
+// lost. Transactions are committed once they have written salvageTxMaxSize
+// bytes.
+func (s *salvager) written(err error, size int, id pgid, index int, path [][]byte) (bool, error) {
+	switch err {
+	case nil:
+	case ErrBucketNameRequired, ErrKeyRequired, ErrKeyTooLarge, ErrValueTooLarge, ErrIncompatibleValue:
+		s.lose(&CheckError{Kind: CheckInvalidKey, Index: index, Detail: err.Error()}, id, path)
+		return false, nil
+	default:
+		return false, err
+	}
+
+	if s.size += size; s.size < salvageTxMaxSize {
+		return true, nil
+	}
+	if err := s.tx.Commit(); err != nil {
+		s.tx = nil
+		return true, err
+	}
+	s.size = 0
+	s.tx, err = s.dst.Begin(true)
+	return true, err
+}
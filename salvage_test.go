@@ -0,0 +1,297 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Ensure that Salvage copies what it can read of a damaged database, reporting
+// the damaged page.
+func TestSalvage(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		a, err := tx.CreateBucket([]byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.SetSequence(7); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := a.Put([]byte(fmt.Sprintf("a-%d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b, err := tx.CreateBucket([]byte("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%06d", i)), make([]byte, 50)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, err := b.CreateBucket([]byte("c"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Make meta1 the newest meta page.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("a")).Put([]byte("a-3"), []byte("value"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.Info().PageSize
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the first meta page and the page holding one of the keys.
+	data, err := ioutil.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[16:], make([]byte, 64))
+	i := bytes.Index(data, []byte("key-000500"))
+	if i != -1 && data[i/pageSize*pageSize+8] != 0x02 {
+		// The key is also on a branch page.
+		i += bytes.Index(data[i+1:], []byte("key-000500")) + 1
+	}
+	if i == -1 || data[i/pageSize*pageSize+8] != 0x02 {
+		t.Fatal("leaf key not found")
+	}
+	page := data[i/pageSize*pageSize:]
+	lostN := int(page[10]) | int(page[11])<<8
+	page[8], page[9] = 0, 0
+	if err := ioutil.WriteFile(db.f, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	report, err := bolt.Salvage(db.f, dst.DB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Txid != 3 || report.BucketN != 3 || report.KeyN != 1005-lostN {
+		t.Fatalf("unexpected report: %+v (%d keys lost)", report, lostN)
+	} else if len(report.Lost) != 1 {
+		t.Fatalf("unexpected losses: %v", report.Lost)
+	}
+	if e := report.Lost[0]; e.Kind != bolt.CheckInvalidType || e.PageID != i/pageSize || !reflect.DeepEqual(e.Bucket, [][]byte{[]byte("b")}) {
+		t.Fatalf("unexpected loss: %v", e)
+	}
+
+	if err := dst.View(func(tx *bolt.Tx) error {
+		a := tx.Bucket([]byte("a"))
+		if a.Sequence() != 7 || a.Stats().KeyN != 4 {
+			t.Fatalf("unexpected bucket a: sequence %d, %d keys", a.Sequence(), a.Stats().KeyN)
+		}
+		if v := tx.Bucket([]byte("b")).Bucket([]byte("c")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := tx.Bucket([]byte("b")).Get([]byte("key-000500")); v != nil {
+			t.Fatal("expected key to be lost")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Salvage copies leaf pages that can't be reached from the root
+// to the lost+found bucket.
+func TestSalvage_Orphans(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%06d", i)), make([]byte, 50)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var root int
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int(tx.Bucket([]byte("widgets")).Root())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.Info().PageSize
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the branch page at the root of the bucket.
+	data, err := ioutil.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	} else if data[root*pageSize+8] != 0x01 {
+		t.Fatal("expected a branch page")
+	}
+	data[root*pageSize+8] = 0
+	if err := ioutil.WriteFile(db.f, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	report, err := bolt.Salvage(db.f, dst.DB, &bolt.Options{Storage: bolt.OSStorage{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Txid != 2 || report.KeyN != 1000 || report.OrphanPageN < 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	} else if len(report.Lost) != 1 || report.Lost[0].Kind != bolt.CheckInvalidType || report.Lost[0].PageID != root {
+		t.Fatalf("unexpected losses: %v", report.Lost)
+	}
+	if n := countLostFound(t, dst); n != 1000 {
+		t.Fatalf("unexpected lost+found keys: %d", n)
+	}
+}
+
+// Ensure that Salvage copies the leaf pages of a database whose meta pages
+// are both damaged to the lost+found bucket.
+func TestSalvage_NoMeta(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%06d", i)), make([]byte, 50)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.Info().PageSize
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[16:], make([]byte, 64))
+	copy(data[pageSize+16:], make([]byte, 64))
+
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	report, err := bolt.SalvageReader(bytes.NewReader(data), int64(len(data)), dst.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Txid != 0 || report.KeyN != 1000 || report.OrphanPageN < 2 || len(report.Lost) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if n := countLostFound(t, dst); n != 1000 {
+		t.Fatalf("unexpected lost+found keys: %d", n)
+	}
+}
+
+// Ensure that Salvage doesn't copy the stale leaf pages of a healthy database
+// whose freelist isn't synced to the lost+found bucket.
+func TestSalvage_NoFreelistSync(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer os.Remove(db.f)
+	for round := 0; round < 5; round++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 500; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("key-%06d", i)), []byte(fmt.Sprintf("value-%d", round))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	report, err := bolt.Salvage(db.f, dst.DB, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.KeyN != 500 || report.OrphanPageN != 0 || len(report.Lost) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if err := dst.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bolt.SalvageLostFound)) != nil {
+			t.Fatal("unexpected lost+found bucket")
+		}
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("key-000100")); string(v) != "value-4" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Salvage fails when no meta page is valid and no page can be
+// recovered.
+func TestSalvage_ErrInvalid(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	if err := ioutil.WriteFile(path, make([]byte, 8192), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	if _, err := bolt.Salvage(path, dst.DB, nil); err != bolt.ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// countLostFound returns the number of keys copied to the per-page buckets
+// of the lost+found bucket of db.
+func countLostFound(t *testing.T, db *DB) int {
+	var n int
+	if err := db.View(func(tx *bolt.Tx) error {
+		lf := tx.Bucket([]byte(bolt.SalvageLostFound))
+		if lf == nil {
+			t.Fatal("no lost+found bucket")
+		}
+		return lf.ForEach(func(k, v []byte) error {
+			n += lf.Bucket(k).Stats().KeyN
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,317 @@
+package bbolt_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSimulateCrash_10tx(t *testing.T) { testSimulateCrash(t, nil, 10) }
+func TestSimulateCrash_50tx(t *testing.T) { testSimulateCrash(t, nil, 50) }
+
+func TestSimulateCrashNoFreelistSync_10tx(t *testing.T) {
+	testSimulateCrash(t, &bolt.Options{NoFreelistSync: true}, 10)
+}
+func TestSimulateCrashNoFreelistSync_50tx(t *testing.T) {
+	testSimulateCrash(t, &bolt.Options{NoFreelistSync: true}, 50)
+}
+
+func TestSimulateCrashFreelistDeltas_10tx(t *testing.T) {
+	testSimulateCrash(t, &bolt.Options{FreelistCheckpointInterval: 4}, 10)
+}
+func TestSimulateCrashFreelistDeltas_50tx(t *testing.T) {
+	testSimulateCrash(t, &bolt.Options{FreelistCheckpointInterval: 4}, 50)
+}
+
+func TestSimulateCrashPread_10tx(t *testing.T) {
+	testSimulateCrash(t, &bolt.Options{AccessMode: bolt.AccessModePread}, 10)
+}
+
+// crashSectorSize is the unit in which a torn write reaches the disk.
+const crashSectorSize = 512
+
+// crashVariants is the number of random reorderings of the unsynced writes
+// replayed at each crash point.
+const crashVariants = 4
+
+// Run a workload of txN random transactions while recording every write and
+// sync, then simulate a power loss at every point of the workload. Writes that
+// were not synced may be lost, reordered or torn. Each resulting file must
+// open, pass Tx.Check and hold the data of a committed transaction no older
+// than the last one to return.
+func testSimulateCrash(t *testing.T, openOption *bolt.Options, txN int) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	var opts bolt.Options
+	if openOption != nil {
+		opts = *openOption
+	}
+	rand := rand.New(rand.NewSource(int64(qseed)))
+
+	// Run the workload, keeping the expected contents after each commit.
+	storage := &crashStorage{Storage: bolt.NewMemStorage()}
+	opts.Storage = storage
+	db, err := bolt.Open("crash.db", 0666, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := make(map[string]string)
+	states := []crashState{{opN: storage.opN(), data: copyCrashModel(model)}}
+	for i := 0; i < txN; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return simulateCrashTx(rand, tx, model)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, crashState{opN: storage.opN(), data: copyCrashModel(model)})
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ops := storage.ops
+
+	// Crash after every operation following the initial sync.
+	first := 0
+	for ops[first].kind != crashSync {
+		first++
+	}
+	for n := first + 1; n <= len(ops); n++ {
+		durable := n
+		for ops[durable-1].kind != crashSync {
+			durable--
+		}
+
+		// The oldest acceptable state is the last one whose commit was
+		// synced, the newest is the one in progress.
+		lo, hi := 0, 0
+		for i, s := range states {
+			if s.opN <= durable {
+				lo = i
+			}
+			if i == 0 || states[i-1].opN < n {
+				hi = i
+			}
+		}
+
+		// Everything reached the disk, in order.
+		testSimulateCrashImage(t, openOption, ops[:n], states[lo:hi+1], fmt.Sprintf("op %d", n))
+
+		// The last write was torn.
+		if ops[n-1].kind == crashWrite {
+			image := append(append([]crashOp{}, ops[:n-1]...), tearCrashOp(rand, ops[n-1])...)
+			testSimulateCrashImage(t, openOption, image, states[lo:hi+1], fmt.Sprintf("op %d torn", n))
+		}
+
+		// Some of the unsynced writes were lost, reordered or torn.
+		if n-durable < 2 {
+			continue
+		}
+		for v := 0; v < crashVariants; v++ {
+			image := append([]crashOp{}, ops[:durable]...)
+			for _, i := range rand.Perm(n - durable) {
+				switch op := ops[durable+i]; {
+				case op.kind != crashWrite:
+					image = append(image, op)
+				case rand.Intn(3) == 0:
+					// Lost.
+				case rand.Intn(3) == 0:
+					image = append(image, tearCrashOp(rand, op)...)
+				default:
+					image = append(image, op)
+				}
+			}
+			testSimulateCrashImage(t, openOption, image, states[lo:hi+1], fmt.Sprintf("op %d variant %d", n, v))
+		}
+	}
+}
+
+// testSimulateCrashImage replays ops into a new file and verifies that it
+// holds one of the given states.
+func testSimulateCrashImage(t *testing.T, openOption *bolt.Options, ops []crashOp, states []crashState, name string) {
+	storage := bolt.NewMemStorage()
+	f, err := storage.Open("crash.db", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		switch op.kind {
+		case crashWrite:
+			_, err = f.WriteAt(op.data, op.offset)
+		case crashTruncate:
+			err = f.Truncate(op.offset)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var opts bolt.Options
+	if openOption != nil {
+		opts = *openOption
+	}
+	opts.Storage = storage
+	db, err := bolt.Open("crash.db", 0666, &opts)
+	if err != nil {
+		t.Fatalf("%s: open: %s", name, err)
+	}
+	defer db.Close()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatalf("%s: check: %s", name, err)
+		}
+
+		data := make(map[string]string)
+		if b := tx.Bucket([]byte("widgets")); b != nil {
+			if err := b.ForEach(func(k, v []byte) error {
+				data[string(k)] = string(v)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		for _, s := range states {
+			if reflect.DeepEqual(data, s.data) {
+				return nil
+			}
+		}
+		t.Fatalf("%s: contents match none of %d acceptable states", name, len(states))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// simulateCrashTx puts and deletes random keys, applying the same changes to
+// the model. Values vary in size so that some need overflow pages.
+func simulateCrashTx(rand *rand.Rand, tx *bolt.Tx, model map[string]string) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+	if err != nil {
+		return err
+	}
+	for i, n := 0, rand.Intn(20)+1; i < n; i++ {
+		k := fmt.Sprintf("%04d", rand.Intn(200))
+		if rand.Intn(4) == 0 {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+			delete(model, k)
+			continue
+		}
+		v := string(randByteSlice(rand, 0, 6000))
+		if err := b.Put([]byte(k), []byte(v)); err != nil {
+			return err
+		}
+		model[k] = v
+	}
+	return nil
+}
+
+func copyCrashModel(model map[string]string) map[string]string {
+	m := make(map[string]string, len(model))
+	for k, v := range model {
+		m[k] = v
+	}
+	return m
+}
+
+// crashState is the expected contents of the database once opN operations
+// have been recorded.
+type crashState struct {
+	opN  int
+	data map[string]string
+}
+
+type crashOpKind int
+
+const (
+	crashWrite crashOpKind = iota
+	crashSync
+	crashTruncate
+)
+
+// crashOp is an operation on a file recorded by crashStorage.
+type crashOp struct {
+	kind   crashOpKind
+	offset int64 // write offset, or size for truncate
+	data   []byte
+}
+
+// tearCrashOp splits a write into writes of the sectors that reached the disk,
+// chosen at random.
+func tearCrashOp(rand *rand.Rand, op crashOp) []crashOp {
+	var sectors []crashOp
+	for i := 0; i < len(op.data); i += crashSectorSize {
+		end := i + crashSectorSize
+		if end > len(op.data) {
+			end = len(op.data)
+		}
+		if rand.Intn(2) == 0 {
+			sectors = append(sectors, crashOp{kind: crashWrite, offset: op.offset + int64(i), data: op.data[i:end]})
+		}
+	}
+	return sectors
+}
+
+// crashStorage is a Storage that records every write, sync and truncate on its
+// data file so that crashes can be replayed. The lock file is not recorded.
+type crashStorage struct {
+	bolt.Storage
+
+	mu  sync.Mutex
+	ops []crashOp
+}
+
+func (s *crashStorage) Open(name string, flag int, perm os.FileMode) (bolt.File, error) {
+	f, err := s.Storage.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	} else if strings.HasSuffix(name, ".lock") {
+		return f, nil
+	}
+	return &crashFile{File: f, s: s}, nil
+}
+
+func (s *crashStorage) record(op crashOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, op)
+}
+
+func (s *crashStorage) opN() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ops)
+}
+
+type crashFile struct {
+	bolt.File
+	s *crashStorage
+}
+
+func (f *crashFile) WriteAt(b []byte, off int64) (int, error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	f.s.record(crashOp{kind: crashWrite, offset: off, data: data})
+	return f.File.WriteAt(b, off)
+}
+
+func (f *crashFile) Sync() error {
+	f.s.record(crashOp{kind: crashSync})
+	return f.File.Sync()
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	f.s.record(crashOp{kind: crashTruncate, offset: size})
+	return f.File.Truncate(size)
+}
@@ -27,6 +27,22 @@ func TestSimulate_10000op_100p(t *testing.T) { testSimulate(t, nil, 1, 10000, 10
 
 func TestSimulate_10000op_1000p(t *testing.T) { testSimulate(t, nil, 1, 10000, 1000) }
 
+// Options that only change how pages are stored or read run fewer and shorter
+// simulations, since the transaction code they exercise is the same.
+func TestSimulate_Options(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		options *bolt.Options
+	}{
+		{"FreelistDeltas", &bolt.Options{FreelistCheckpointInterval: 8}},
+		{"Pread", &bolt.Options{AccessMode: bolt.AccessModePread, PageCacheSize: 16}},
+	} {
+		options := c.options
+		t.Run(c.name+"/10op_1p", func(t *testing.T) { testSimulate(t, options, 2, 10, 1) })
+		t.Run(c.name+"/1000op_10p", func(t *testing.T) { testSimulate(t, options, 2, 1000, 10) })
+	}
+}
+
 // Randomly generate operations on a given database with multiple clients to ensure consistency and thread safety.
 func testSimulate(t *testing.T, openOption *bolt.Options, round, threadCount, parallelism int) {
 	if testing.Short() {
@@ -0,0 +1,153 @@
+package bbolt
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Storage opens the files that hold databases. It allows a database to be
+// kept somewhere other than the operating system's file system, or I/O to be
+// intercepted, for example to test crash behaviour.
+type Storage interface {
+	// Open opens the named file with the given os.O_* flags, creating it
+	// with the given permissions if os.O_CREATE is set.
+	Open(name string, flag int, perm os.FileMode) (File, error)
+}
+
+// File is a file opened by a Storage.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	// Name returns the name the file was opened with.
+	Name() string
+
+	// Size returns the size of the file in bytes.
+	Size() (int64, error)
+
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+
+	// Sync flushes written data, and any metadata needed to read it back such
+	// as the file size, to stable storage.
+	Sync() error
+
+	// Lock acquires an advisory lock on the file, shared with other readers
+	// unless exclusive is set. It returns ErrTimeout if the lock cannot be
+	// obtained within timeout, or waits indefinitely if timeout is zero.
+	Lock(exclusive bool, timeout time.Duration) error
+
+	// Unlock releases the lock acquired by Lock.
+	Unlock() error
+
+	// Map returns a read-only view of the first size bytes of the file,
+	// which may be larger than the file. Data written to the file must be
+	// visible through the view until it is passed to Unmap. flags are
+	// platform specific flags such as DB.MmapFlags.
+	Map(size int, flags int) ([]byte, error)
+
+	// Unmap releases a view returned by Map.
+	Unmap(b []byte) error
+}
+
+// vectorWriterAt is implemented by Files that can write several buffers to
+// consecutive offsets with a single call, like pwritev. Storage implementations
+// may add it to their Files to let commits write runs of pages at once.
+type vectorWriterAt interface {
+	// WritevAt writes bufs one after the other starting at off. It returns
+	// the number of bytes written, the number of calls it made to write them,
+	// such as system calls, and a non-nil error if fewer bytes than requested
+	// are written.
+	WritevAt(bufs [][]byte, off int64) (n, calls int, err error)
+}
+
+// OSStorage is the Storage of files in the operating system's file system.
+// It is the default Storage.
+type OSStorage struct {
+	// OpenFile is used to open files. It defaults to os.OpenFile.
+	OpenFile func(string, int, os.FileMode) (*os.File, error)
+}
+
+// Open opens the named file.
+func (s OSStorage) Open(name string, flag int, perm os.FileMode) (File, error) {
+	openFile := s.OpenFile
+	if openFile == nil {
+		openFile = os.OpenFile
+	}
+	f, err := openFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &osFile{File: f, writable: flag&(os.O_WRONLY|os.O_RDWR) != 0}, nil
+}
+
+// osFile is a File in the operating system's file system.
+type osFile struct {
+	*os.File
+	writable bool
+	data     []byte // current memory map, if any
+}
+
+// Size returns the size of the file in bytes.
+func (f *osFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Sync flushes written data to disk.
+func (f *osFile) Sync() error {
+	return fdatasync(f)
+}
+
+// Lock acquires an advisory lock on the file.
+func (f *osFile) Lock(exclusive bool, timeout time.Duration) error {
+	return flock(f, exclusive, timeout)
+}
+
+// Unlock releases the advisory lock on the file.
+func (f *osFile) Unlock() error {
+	return funlock(f)
+}
+
+// Map memory maps the file.
+func (f *osFile) Map(size int, flags int) ([]byte, error) {
+	b, err := mmap(f, size, flags)
+	if err != nil {
+		return nil, err
+	}
+	f.data = b
+	return b, nil
+}
+
+// Unmap unmaps the file from memory.
+func (f *osFile) Unmap(b []byte) error {
+	if len(f.data) > 0 && len(b) > 0 && &f.data[0] == &b[0] {
+		f.data = nil
+	}
+	return munmap(b)
+}
+
+// exclusiveMapper is implemented by Files that can't be mapped again while a
+// view returned by Map is in use. Files on Windows can't, because mapping a
+// file grows it and Windows doesn't allow a file to be resized while a view
+// of it is mapped.
+type exclusiveMapper interface {
+	mapsExclusively()
+}
+
+// fileWriter adapts a File to an io.Writer that appends at offset.
+type fileWriter struct {
+	f      File
+	offset int64
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,265 @@
+package bbolt
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemStorage is a Storage that keeps files in memory. It is safe for
+// concurrent use, and a file opened more than once shares its contents and
+// locks between the handles as it would on disk.
+//
+// Unlike a memory map, views returned by File.Map are not write-protected.
+type MemStorage struct {
+	mu    sync.Mutex
+	files map[string]*memData
+}
+
+// NewMemStorage returns an empty in-memory Storage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{files: make(map[string]*memData)}
+}
+
+// Open opens the named file, creating it if os.O_CREATE is set. perm is
+// ignored.
+func (s *MemStorage) Open(name string, flag int, perm os.FileMode) (File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		d = &memData{}
+		s.files[name] = d
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+
+	f := &memFile{name: name, d: d, writable: flag&(os.O_WRONLY|os.O_RDWR) != 0}
+	if flag&os.O_TRUNC != 0 && f.writable {
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Remove deletes the named file. Open handles keep their contents.
+func (s *MemStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+// memData is the contents of an in-memory file, shared by its handles.
+type memData struct {
+	mu   sync.RWMutex
+	data []byte   // bytes beyond len(data) up to cap(data) are always zero
+	maps [][]byte // views returned by Map and not yet unmapped
+
+	lockmu    sync.Mutex
+	exclusive bool // an exclusive lock is held
+	shared    int  // number of shared locks held
+}
+
+// grow extends the capacity of data to at least size. Views of the old
+// contents are kept up to date by write.
+func (d *memData) grow(size int) {
+	if size <= cap(d.data) {
+		return
+	}
+	c := 2 * cap(d.data)
+	if c < size {
+		c = size
+	}
+	data := make([]byte, len(d.data), c)
+	copy(data, d.data)
+	d.data = data
+}
+
+// write copies b into the file at offset, and into any views that no longer
+// share memory with the file contents.
+func (d *memData) write(b []byte, offset int) {
+	end := offset + len(b)
+	d.grow(end)
+	if end > len(d.data) {
+		d.data = d.data[:end]
+	}
+	copy(d.data[offset:], b)
+
+	for _, m := range d.maps {
+		if len(m) == 0 || offset >= len(m) || &m[0] == &d.data[:1][0] {
+			continue
+		}
+		copy(m[offset:], b)
+	}
+}
+
+// memFile is a handle to an in-memory file.
+type memFile struct {
+	name     string
+	d        *memData
+	writable bool
+	locked   bool
+	closed   bool
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.d.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	} else if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	f.d.write(b, int(off))
+	return len(b), nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+	return int64(len(f.d.data)), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	} else if !f.writable {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	if n := int(size); n < len(f.d.data) {
+		f.d.write(make([]byte, len(f.d.data)-n), n)
+		f.d.data = f.d.data[:n]
+	} else {
+		f.d.grow(n)
+		f.d.data = f.d.data[:n]
+	}
+	return nil
+}
+
+// Sync does nothing; the contents are already as durable as they get.
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Lock(exclusive bool, timeout time.Duration) error {
+	var t time.Time
+	if timeout != 0 {
+		t = time.Now()
+	}
+	for {
+		if f.tryLock(exclusive) {
+			return nil
+		}
+
+		// If we timed out then return an error.
+		if timeout != 0 && time.Since(t) > timeout-flockRetryTimeout {
+			return ErrTimeout
+		}
+
+		// Wait for a bit and try again.
+		time.Sleep(flockRetryTimeout)
+	}
+}
+
+func (f *memFile) tryLock(exclusive bool) bool {
+	f.d.lockmu.Lock()
+	defer f.d.lockmu.Unlock()
+	if f.d.exclusive || (exclusive && f.d.shared > 0) {
+		return false
+	}
+	if exclusive {
+		f.d.exclusive = true
+	} else {
+		f.d.shared++
+	}
+	f.locked = true
+	return true
+}
+
+func (f *memFile) Unlock() error {
+	f.d.lockmu.Lock()
+	defer f.d.lockmu.Unlock()
+	if !f.locked {
+		return nil
+	}
+	if f.d.exclusive {
+		f.d.exclusive = false
+	} else {
+		f.d.shared--
+	}
+	f.locked = false
+	return nil
+}
+
+// Map returns a view that shares memory with the file contents while they
+// have room to grow, and is written to separately after that.
+func (f *memFile) Map(size int, flags int) ([]byte, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	f.d.grow(size)
+	b := f.d.data[:size:size]
+	f.d.maps = append(f.d.maps, b)
+	return b, nil
+}
+
+func (f *memFile) Unmap(b []byte) error {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	for i, m := range f.d.maps {
+		if len(m) > 0 && len(b) > 0 && &m[0] == &b[0] {
+			f.d.maps = append(f.d.maps[:i], f.d.maps[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if err := f.Unlock(); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
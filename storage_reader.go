@@ -0,0 +1,78 @@
+package bbolt
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// errReaderStorage is returned when a database opened with OpenReader would
+// have to write or map its file.
+var errReaderStorage = errors.New("database opened from a reader")
+
+// OpenReader opens the database held in the first size bytes of r, such as a
+// file embedded in a binary or stored in an archive, without copying it to a
+// file first. The database is read only: only View transactions can be begun
+// on it. Pages are read with r.ReadAt through a page cache, as with
+// AccessModePread, rather than mapped, and nothing is locked, as with
+// Options.NoLock, so r must not change while the database is open.
+func OpenReader(r io.ReaderAt, size int64) (*DB, error) {
+	if size == 0 {
+		return nil, ErrInvalid
+	}
+	return Open("", 0, &Options{
+		ReadOnly:     true,
+		NoLock:       true,
+		AccessMode:   AccessModePread,
+		Storage:      &readerStorage{r: io.NewSectionReader(r, 0, size)},
+		FreelistType: FreelistArrayType,
+	})
+}
+
+// readerStorage is the Storage of a database opened with OpenReader. Its one
+// file is the reader, whatever its name.
+type readerStorage struct {
+	r *io.SectionReader
+}
+
+// Open returns the reader as a read only File.
+func (s *readerStorage) Open(name string, flag int, perm os.FileMode) (File, error) {
+	return &readerFile{SectionReader: s.r, name: name}, nil
+}
+
+// readerFile is the File of a readerStorage.
+type readerFile struct {
+	*io.SectionReader
+	name string
+}
+
+// Name returns the name the file was opened with.
+func (f *readerFile) Name() string { return f.name }
+
+// Size returns the size of the reader.
+func (f *readerFile) Size() (int64, error) { return f.SectionReader.Size(), nil }
+
+// Close does nothing; the reader is owned by the caller.
+func (f *readerFile) Close() error { return nil }
+
+// WriteAt returns an error, as the file is read only.
+func (f *readerFile) WriteAt(b []byte, off int64) (int, error) { return 0, errReaderStorage }
+
+// Truncate returns an error, as the file is read only.
+func (f *readerFile) Truncate(size int64) error { return errReaderStorage }
+
+// Sync does nothing, as nothing is written.
+func (f *readerFile) Sync() error { return nil }
+
+// Lock does nothing: the reader is not shared through the file system.
+func (f *readerFile) Lock(exclusive bool, timeout time.Duration) error { return nil }
+
+// Unlock does nothing.
+func (f *readerFile) Unlock() error { return nil }
+
+// Map returns an error; pages are read with ReadAt instead.
+func (f *readerFile) Map(size int, flags int) ([]byte, error) { return nil, errReaderStorage }
+
+// Unmap does nothing, as nothing is mapped.
+func (f *readerFile) Unmap(b []byte) error { return nil }
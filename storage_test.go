@@ -0,0 +1,94 @@
+package bbolt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// exclusiveStorage opens files that behave like files on Windows, failing
+// to be mapped while an earlier view of them is mapped.
+type exclusiveStorage struct {
+	Storage
+}
+
+func (s exclusiveStorage) Open(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := s.Storage.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &exclusiveFile{File: f}, nil
+}
+
+type exclusiveFile struct {
+	File
+	views int
+}
+
+func (f *exclusiveFile) mapsExclusively() {}
+
+func (f *exclusiveFile) Map(size int, flags int) ([]byte, error) {
+	if f.views != 0 {
+		return nil, errors.New("file is mapped")
+	}
+	b, err := f.File.Map(size, flags)
+	if err == nil {
+		f.views++
+	}
+	return b, err
+}
+
+func (f *exclusiveFile) Unmap(b []byte) error {
+	f.views--
+	return f.File.Unmap(b)
+}
+
+// Ensure that files that can't be mapped while they are mapped are unmapped
+// before remapping, once read transactions have closed.
+func TestDB_mmap_Exclusive(t *testing.T) {
+	db, err := Open("db", 0666, &Options{Storage: exclusiveStorage{NewMemStorage()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rtx.Rollback() }()
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), make([]byte, 1<<22))
+		})
+	}()
+	select {
+	case <-done:
+		t.Fatal("remap didn't wait for read transaction")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	} else if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			return ErrBucketNotFound
+		} else if v := b.Get([]byte("foo")); len(v) != 1<<22 {
+			return fmt.Errorf("unexpected value length: %d", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
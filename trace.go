@@ -0,0 +1,81 @@
+package bbolt
+
+import "time"
+
+// Tracer receives the duration, and size where there is one, of each phase
+// of beginning and committing transactions, so that they can be recorded as
+// spans. Set it with Options.Tracer.
+//
+// Methods are called synchronously, once the phase has finished, from the
+// goroutine running the transaction, sometimes with database locks held.
+// They must not use the database, and must be safe for concurrent use since
+// read transactions begin concurrently with each other and with the writer.
+// Embed NopTracer to implement only some of them.
+type Tracer interface {
+	// LockWait is called when a transaction has obtained the lock it waits
+	// for to begin: the writer lock for writable transactions, and the meta
+	// and mmap locks, which remaps and Close hold, for read transactions.
+	LockWait(writable bool, d time.Duration)
+
+	// Begin is called when a transaction has begun, with the time beginning
+	// took, including LockWait.
+	Begin(writable bool, d time.Duration)
+
+	// Rebalance is called by Commit after rebalancing n nodes.
+	Rebalance(n int, d time.Duration)
+
+	// Spill is called by Commit after spilling n nodes to dirty pages.
+	Spill(n int, d time.Duration)
+
+	// FreelistCommit is called by Commit after writing the freelist, or a
+	// delta of it, to size bytes of dirty pages. It isn't called when the
+	// freelist isn't synced.
+	FreelistCommit(size int, d time.Duration)
+
+	// PageWrite is called by Commit after writing each run of n contiguous
+	// dirty pages, size bytes, to the data file.
+	PageWrite(n, size int, d time.Duration)
+
+	// Sync is called after each fdatasync of the data file by Commit, for
+	// its pages or meta page, or by Grow.
+	Sync(d time.Duration)
+
+	// MetaWrite is called by Commit after writing the meta page, with the
+	// time it took including its Sync.
+	MetaWrite(d time.Duration)
+
+	// Remap is called after the data file is mapped to size bytes, when the
+	// database is opened and whenever it outgrows its map.
+	Remap(size int, d time.Duration)
+
+	// Grow is called after the data file is grown to size bytes, with the
+	// time it took including its Sync.
+	Grow(size int, d time.Duration)
+}
+
+// NopTracer is a Tracer that does nothing. It is used when Options.Tracer is
+// not set.
+type NopTracer struct{}
+
+func (NopTracer) LockWait(writable bool, d time.Duration)  {}
+func (NopTracer) Begin(writable bool, d time.Duration)     {}
+func (NopTracer) Rebalance(n int, d time.Duration)         {}
+func (NopTracer) Spill(n int, d time.Duration)             {}
+func (NopTracer) FreelistCommit(size int, d time.Duration) {}
+func (NopTracer) PageWrite(n, size int, d time.Duration)   {}
+func (NopTracer) Sync(d time.Duration)                     {}
+func (NopTracer) MetaWrite(d time.Duration)                {}
+func (NopTracer) Remap(size int, d time.Duration)          {}
+func (NopTracer) Grow(size int, d time.Duration)           {}
+
+// sync syncs the data file, tracing and recording the time it took.
+func (db *DB) sync() error {
+	start := time.Now()
+	err := db.file.Sync()
+	d := time.Since(start)
+	db.tracer.Sync(d)
+	db.statlock.Lock()
+	db.stats.SyncLatency.observe(d)
+	db.statlock.Unlock()
+	return err
+}
@@ -0,0 +1,130 @@
+package bbolt_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// recordingTracer records the calls made to a Tracer.
+type recordingTracer struct {
+	bolt.NopTracer
+
+	mu     sync.Mutex
+	begins map[bool]int // by writable
+	waits  map[bool]int // by writable
+	calls  map[string]int
+	sizes  map[string]int // total sizes, or counts of nodes or pages
+}
+
+func newRecordingTracer() *recordingTracer {
+	return &recordingTracer{
+		begins: make(map[bool]int),
+		waits:  make(map[bool]int),
+		calls:  make(map[string]int),
+		sizes:  make(map[string]int),
+	}
+}
+
+func (r *recordingTracer) record(name string, size int, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d < 0 {
+		panic("negative duration")
+	}
+	r.calls[name]++
+	r.sizes[name] += size
+}
+
+func (r *recordingTracer) LockWait(writable bool, d time.Duration) {
+	r.mu.Lock()
+	r.waits[writable]++
+	r.mu.Unlock()
+}
+
+func (r *recordingTracer) Begin(writable bool, d time.Duration) {
+	r.mu.Lock()
+	r.begins[writable]++
+	r.mu.Unlock()
+}
+
+func (r *recordingTracer) Rebalance(n int, d time.Duration) { r.record("rebalance", n, d) }
+func (r *recordingTracer) Spill(n int, d time.Duration)     { r.record("spill", n, d) }
+func (r *recordingTracer) FreelistCommit(size int, d time.Duration) {
+	r.record("freelist", size, d)
+}
+func (r *recordingTracer) PageWrite(n, size int, d time.Duration) {
+	r.record("pages", n, d)
+	r.record("pagebytes", size, d)
+}
+func (r *recordingTracer) Sync(d time.Duration)            { r.record("sync", 0, d) }
+func (r *recordingTracer) MetaWrite(d time.Duration)       { r.record("meta", 0, d) }
+func (r *recordingTracer) Remap(size int, d time.Duration) { r.record("remap", size, d) }
+func (r *recordingTracer) Grow(size int, d time.Duration)  { r.record("grow", size, d) }
+
+// Ensure that the phases of transactions are traced.
+func TestOptions_Tracer(t *testing.T) {
+	tracer := newRecordingTracer()
+	db := MustOpenWithOption(&bolt.Options{Tracer: tracer})
+	defer db.MustClose()
+	if tracer.calls["remap"] != 1 {
+		t.Fatalf("unexpected remaps on open: %d", tracer.calls["remap"])
+	}
+
+	// Grow the database past its initial map, then delete most of it.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 10; i < 1000; i++ {
+			if err := b.Delete(u64tob(uint64(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if tracer.begins[true] != 2 || tracer.waits[true] != 2 {
+		t.Fatalf("unexpected writable begins: %d, %d", tracer.begins[true], tracer.waits[true])
+	} else if tracer.begins[false] != 1 || tracer.waits[false] != 1 {
+		t.Fatalf("unexpected read begins: %d, %d", tracer.begins[false], tracer.waits[false])
+	}
+	for _, name := range []string{"rebalance", "spill", "freelist", "meta"} {
+		if tracer.calls[name] != 2 {
+			t.Fatalf("%s: unexpected calls: %d", name, tracer.calls[name])
+		}
+	}
+	pageSize := db.Info().PageSize
+	if tracer.sizes["rebalance"] == 0 || tracer.sizes["spill"] == 0 {
+		t.Fatalf("unexpected node counts: %v", tracer.sizes)
+	} else if tracer.sizes["freelist"] < 2*pageSize {
+		t.Fatalf("unexpected freelist size: %d", tracer.sizes["freelist"])
+	} else if tracer.sizes["pages"] < 250 || tracer.sizes["pagebytes"] < tracer.sizes["pages"]*pageSize {
+		t.Fatalf("unexpected page writes: %d pages, %d bytes", tracer.sizes["pages"], tracer.sizes["pagebytes"])
+	} else if tracer.calls["sync"] < 4 {
+		t.Fatalf("unexpected syncs: %d", tracer.calls["sync"])
+	} else if tracer.calls["remap"] < 2 || tracer.calls["grow"] == 0 || tracer.sizes["grow"] < 1000*1000 {
+		t.Fatalf("unexpected remaps and grows: %v, %v", tracer.calls, tracer.sizes)
+	}
+}
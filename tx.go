@@ -8,10 +8,12 @@ import (
 	"strings"
 	"time"
 	"unsafe"
+
+	"go.etcd.io/bbolt/internal/format"
 )
 
 // txid represents the internal transaction identifier.
-type txid uint64
+type txid = format.Txid
 
 // Tx represents a read-only or read/write transaction on the database.
 // Read-only transactions can be used for retrieving values for keys and creating cursors.
@@ -25,12 +27,23 @@ type Tx struct {
 	writable       bool
 	managed        bool
 	db             *DB
+	mapping        *mapping // the mapping read-only transactions read from
 	meta           *meta
 	root           Bucket
 	pages          map[pgid]*page
 	stats          TxStats
 	commitHandlers []func()
 
+	// checkpoint makes the commit write out the whole freelist, rather than
+	// a delta, so that a freelist rebuilt in memory is persisted.
+	checkpoint bool
+
+	// committed is set once the meta page is written, so that closing the
+	// transaction counts it as committed rather than rolled back, along with
+	// the time the commit took.
+	committed  bool
+	commitTime time.Duration
+
 	// WriteFlag specifies the flag for write-related methods like WriteTo().
 	// Tx opens the database file with the specified flag to copy the data.
 	//
@@ -146,38 +159,43 @@ func (tx *Tx) Commit() error {
 		return ErrTxNotWritable
 	}
 
-	// TODO(benbjohnson): Use vectorized I/O to write out dirty pages.
+	commitStart := time.Now()
 
 	// Rebalance nodes which have had deletions.
 	var startTime = time.Now()
+	rebalanceN := tx.stats.Rebalance
 	tx.root.rebalance()
 	if tx.stats.Rebalance > 0 {
 		tx.stats.RebalanceTime += time.Since(startTime)
 	}
+	tx.db.tracer.Rebalance(tx.stats.Rebalance-rebalanceN, time.Since(startTime))
 
 	// spill data onto dirty pages.
 	startTime = time.Now()
+	spillN := tx.stats.Spill
 	if err := tx.root.spill(); err != nil {
 		tx.rollback()
 		return err
 	}
 	tx.stats.SpillTime += time.Since(startTime)
+	tx.db.tracer.Spill(tx.stats.Spill-spillN, time.Since(startTime))
 
 	// Free the old root bucket.
 	tx.meta.root.root = tx.root.root
 
-	// Free the old freelist because commit writes out a fresh freelist.
-	if tx.meta.freelist != pgidNoFreelist {
-		tx.db.freelist.free(tx.meta.txid, tx.db.page(tx.meta.freelist))
-	}
-
 	if !tx.db.NoFreelistSync {
+		startTime = time.Now()
 		err := tx.commitFreelist()
 		if err != nil {
 			return err
 		}
+		p := tx.page(tx.meta.freelist)
+		tx.db.tracer.FreelistCommit((int(p.overflow)+1)*tx.db.pageSize, time.Since(startTime))
 	} else {
+		// Free the old freelist since it is no longer kept on disk.
+		tx.freeFreelist()
 		tx.meta.freelist = pgidNoFreelist
+		tx.meta.flags &^= metaFlagFreelistDelta
 	}
 
 	// Write dirty pages to disk.
@@ -205,11 +223,22 @@ func (tx *Tx) Commit() error {
 	}
 
 	// Write meta to disk.
+	metaStartTime := time.Now()
 	if err := tx.writeMeta(); err != nil {
 		tx.rollback()
 		return err
 	}
+	tx.db.tracer.MetaWrite(time.Since(metaStartTime))
 	tx.stats.WriteTime += time.Since(startTime)
+	tx.committed = true
+	tx.commitTime = time.Since(commitStart)
+
+	// The transaction is durable once the meta page is written, so it is
+	// closed rather than rolled back.
+	if _, err := tx.db.failpoint(FailpointAfterWriteMeta); err != nil {
+		tx.close()
+		return err
+	}
 
 	// Finalize the transaction.
 	tx.close()
@@ -223,6 +252,18 @@ func (tx *Tx) Commit() error {
 }
 
 func (tx *Tx) commitFreelist() error {
+	// Append a delta to the freelist on disk while the chain is shorter than
+	// the checkpoint interval.
+	if tx.meta.freelist != pgidNoFreelist && tx.db.FreelistCheckpointInterval > 0 && !tx.checkpoint {
+		head := tx.db.page(tx.meta.freelist)
+		if (head.flags&freelistDeltaPageFlag) == 0 || int(head.freelistDelta().depth) < tx.db.FreelistCheckpointInterval {
+			return tx.commitFreelistDelta()
+		}
+	}
+
+	// Free the old freelist because commit writes out a fresh freelist.
+	tx.freeFreelist()
+
 	// Allocate new pages for the new free list. This will overestimate
 	// the size of the freelist but not underestimate the size (which would be bad).
 	opgid := tx.meta.pgid
@@ -236,6 +277,7 @@ func (tx *Tx) commitFreelist() error {
 		return err
 	}
 	tx.meta.freelist = p.id
+	tx.meta.flags &^= metaFlagFreelistDelta
 	// If the high water mark has moved up then attempt to grow the database.
 	if tx.meta.pgid > opgid {
 		if err := tx.db.grow(int(tx.meta.pgid+1) * tx.db.pageSize); err != nil {
@@ -247,6 +289,52 @@ func (tx *Tx) commitFreelist() error {
 	return nil
 }
 
+// commitFreelistDelta writes the pages allocated and freed by the transaction
+// onto a freelist delta page that follows the current freelist.
+func (tx *Tx) commitFreelistDelta() error {
+	// Allocating the delta page may itself take pages off the freelist, so
+	// leave room for logging those too.
+	count := (tx.db.freelist.deltaSize(tx.meta.txid, 0) / tx.db.pageSize) + 1
+	if tx.db.freelist.deltaSize(tx.meta.txid, count) > count*tx.db.pageSize {
+		count++
+	}
+
+	opgid := tx.meta.pgid
+	p, err := tx.allocate(count)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	// Look up the head after allocating since allocation can remap the file.
+	head := tx.db.page(tx.meta.freelist)
+	if err := tx.db.freelist.writeDelta(tx.meta.txid, head, p); err != nil {
+		tx.rollback()
+		return err
+	}
+	tx.meta.freelist = p.id
+	tx.meta.flags |= metaFlagFreelistDelta
+	// If the high water mark has moved up then attempt to grow the database.
+	if tx.meta.pgid > opgid {
+		if err := tx.db.grow(int(tx.meta.pgid+1) * tx.db.pageSize); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// freeFreelist frees the pages of the freelist on disk, including every delta
+// page chained to it.
+func (tx *Tx) freeFreelist() {
+	if tx.meta.freelist == pgidNoFreelist {
+		return
+	}
+	for _, p := range freelistChain(tx.meta.freelist, tx.db.page) {
+		tx.db.freelist.free(tx.meta.txid, p)
+	}
+}
+
 // Rollback closes the transaction and ignores all previous updates. Read-only
 // transactions must be rolled back and not committed.
 func (tx *Tx) Rollback() error {
@@ -279,10 +367,10 @@ func (tx *Tx) rollback() {
 		if !tx.db.hasSyncedFreelist() {
 			// Reconstruct free page list by scanning the DB to get the whole free page list.
 			// Note: scaning the whole db is heavy if your db size is large in NoSyncFreeList mode.
-			tx.db.freelist.noSyncReload(tx.db.freepages())
+			tx.db.freelist.noSyncReload(tx.db.freepages(tx.db.recoveryParallelism, nil))
 		} else {
 			// Read free page list from freelist page.
-			tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
+			tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist), tx.db.page)
 		}
 	}
 	tx.close()
@@ -308,6 +396,12 @@ func (tx *Tx) close() {
 		tx.db.stats.PendingPageN = freelistPendingN
 		tx.db.stats.FreeAlloc = (freelistFreeN + freelistPendingN) * tx.db.pageSize
 		tx.db.stats.FreelistInuse = freelistAlloc
+		if tx.committed {
+			tx.db.stats.CommitN++
+			tx.db.stats.CommitLatency.observe(tx.commitTime)
+		} else {
+			tx.db.stats.RollbackN++
+		}
 		tx.db.stats.TxStats.add(&tx.stats)
 		tx.db.statlock.Unlock()
 	} else {
@@ -316,6 +410,7 @@ func (tx *Tx) close() {
 
 	// Clear all references.
 	tx.db = nil
+	tx.mapping = nil
 	tx.meta = nil
 	tx.root = Bucket{tx: tx}
 	tx.pages = nil
@@ -334,7 +429,7 @@ func (tx *Tx) Copy(w io.Writer) error {
 // If err == nil then exactly tx.Size() bytes will be written into the writer.
 func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
 	// Attempt to open reader with WriteFlag
-	f, err := tx.db.openFile(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
+	f, err := tx.db.storage.Open(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
 	if err != nil {
 		return 0, err
 	}
@@ -369,13 +464,9 @@ func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
 		return n, fmt.Errorf("meta 1 copy: %s", err)
 	}
 
-	// Move past the meta pages in the file.
-	if _, err := f.Seek(int64(tx.db.pageSize*2), io.SeekStart); err != nil {
-		return n, fmt.Errorf("seek: %s", err)
-	}
-
-	// Copy data pages.
-	wn, err := io.CopyN(w, f, tx.Size()-int64(tx.db.pageSize*2))
+	// Copy data pages, skipping the meta pages in the file.
+	r := io.NewSectionReader(f, int64(tx.db.pageSize*2), tx.Size()-int64(tx.db.pageSize*2))
+	wn, err := io.Copy(w, r)
 	n += wn
 	if err != nil {
 		return n, err
@@ -384,16 +475,23 @@ func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
 	return n, nil
 }
 
-// CopyFile copies the entire database to file at the given path.
+// CopyFile copies the entire database to file at the given path in the
+// operating system's file system, whatever Storage the database is kept in.
+// This makes it usable to save a database opened with OpenMemory; use WriteTo
+// to copy a database to a file of another Storage.
 // A reader transaction is maintained during the copy so it is safe to continue
 // using the database while a copy is in progress.
 func (tx *Tx) CopyFile(path string, mode os.FileMode) error {
-	f, err := tx.db.openFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	storage, ok := tx.db.storage.(OSStorage)
+	if !ok {
+		storage = OSStorage{}
+	}
+	f, err := storage.Open(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return err
 	}
 
-	err = tx.Copy(f)
+	err = tx.Copy(&fileWriter{f: f})
 	if err != nil {
 		_ = f.Close()
 		return err
@@ -401,98 +499,6 @@ func (tx *Tx) CopyFile(path string, mode os.FileMode) error {
 	return f.Close()
 }
 
-// Check performs several consistency checks on the database for this transaction.
-// An error is returned if any inconsistency is found.
-//
-// It can be safely run concurrently on a writable transaction. However, this
-// incurs a high cost for large databases and databases with a lot of subbuckets
-// because of caching. This overhead can be removed if running on a read-only
-// transaction, however, it is not safe to execute other writer transactions at
-// the same time.
-func (tx *Tx) Check() <-chan error {
-	ch := make(chan error)
-	go tx.check(ch)
-	return ch
-}
-
-func (tx *Tx) check(ch chan error) {
-	// Force loading free list if opened in ReadOnly mode.
-	tx.db.loadFreelist()
-
-	// Check if any pages are double freed.
-	freed := make(map[pgid]bool)
-	all := make([]pgid, tx.db.freelist.count())
-	tx.db.freelist.copyall(all)
-	for _, id := range all {
-		if freed[id] {
-			ch <- fmt.Errorf("page %d: already freed", id)
-		}
-		freed[id] = true
-	}
-
-	// Track every reachable page.
-	reachable := make(map[pgid]*page)
-	reachable[0] = tx.page(0) // meta0
-	reachable[1] = tx.page(1) // meta1
-	if tx.meta.freelist != pgidNoFreelist {
-		for i := uint32(0); i <= tx.page(tx.meta.freelist).overflow; i++ {
-			reachable[tx.meta.freelist+pgid(i)] = tx.page(tx.meta.freelist)
-		}
-	}
-
-	// Recursively check buckets.
-	tx.checkBucket(&tx.root, reachable, freed, ch)
-
-	// Ensure all pages below high water mark are either reachable or freed.
-	for i := pgid(0); i < tx.meta.pgid; i++ {
-		_, isReachable := reachable[i]
-		if !isReachable && !freed[i] {
-			ch <- fmt.Errorf("page %d: unreachable unfreed", int(i))
-		}
-	}
-
-	// Close the channel to signal completion.
-	close(ch)
-}
-
-func (tx *Tx) checkBucket(b *Bucket, reachable map[pgid]*page, freed map[pgid]bool, ch chan error) {
-	// Ignore inline buckets.
-	if b.root == 0 {
-		return
-	}
-
-	// Check every page used by this bucket.
-	b.tx.forEachPage(b.root, 0, func(p *page, _ int) {
-		if p.id > tx.meta.pgid {
-			ch <- fmt.Errorf("page %d: out of bounds: %d", int(p.id), int(b.tx.meta.pgid))
-		}
-
-		// Ensure each page is only referenced once.
-		for i := pgid(0); i <= pgid(p.overflow); i++ {
-			var id = p.id + i
-			if _, ok := reachable[id]; ok {
-				ch <- fmt.Errorf("page %d: multiple references", int(id))
-			}
-			reachable[id] = p
-		}
-
-		// We should only encounter un-freed leaf and branch pages.
-		if freed[p.id] {
-			ch <- fmt.Errorf("page %d: reachable freed", int(p.id))
-		} else if (p.flags&branchPageFlag) == 0 && (p.flags&leafPageFlag) == 0 {
-			ch <- fmt.Errorf("page %d: invalid type: %s", int(p.id), p.typ())
-		}
-	})
-
-	// Check each bucket within this bucket.
-	_ = b.ForEach(func(k, v []byte) error {
-		if child := b.Bucket(k); child != nil {
-			tx.checkBucket(child, reachable, freed, ch)
-		}
-		return nil
-	})
-}
-
 // allocate returns a contiguous block of memory starting at a given page.
 func (tx *Tx) allocate(count int) (*page, error) {
 	p, err := tx.db.allocate(tx.meta.txid, count)
@@ -521,48 +527,41 @@ func (tx *Tx) write() error {
 	tx.pages = make(map[pgid]*page)
 	sort.Sort(pages)
 
-	// Write pages to disk in order.
-	for _, p := range pages {
-		size := (int(p.overflow) + 1) * tx.db.pageSize
-		offset := int64(p.id) * int64(tx.db.pageSize)
-
-		// Write out page in "max allocation" sized chunks.
-		ptr := (*[maxAllocSize]byte)(unsafe.Pointer(p))
-		for {
-			// Limit our write to our max allocation size.
-			sz := size
-			if sz > maxAllocSize-1 {
-				sz = maxAllocSize - 1
-			}
-
-			// Write chunk to disk.
-			buf := ptr[:sz]
-			if _, err := tx.db.ops.writeAt(buf, offset); err != nil {
-				return err
-			}
-
-			// Update statistics.
-			tx.stats.Write++
-
-			// Exit inner for loop if we've written all the chunks.
-			size -= sz
-			if size == 0 {
-				break
-			}
-
-			// Otherwise move offset forward and move pointer to next chunk.
-			offset += int64(sz)
-			ptr = (*[maxAllocSize]byte)(unsafe.Pointer(&ptr[sz]))
+	// Write pages to disk in order, one run of contiguous pages at a time.
+	for i := 0; i < len(pages); {
+		j := i + 1
+		for j < len(pages) && pages[j].id == pages[j-1].id+pgid(pages[j-1].overflow)+1 {
+			j++
+		}
+		startTime, size := time.Now(), 0
+		for _, p := range pages[i:j] {
+			size += (int(p.overflow) + 1) * tx.db.pageSize
+		}
+		if err := tx.writeRun(pages[i:j]); err != nil {
+			return err
 		}
+		tx.db.tracer.PageWrite(j-i, size, time.Since(startTime))
+		i = j
+	}
+
+	if _, err := tx.db.failpoint(FailpointBeforeSync); err != nil {
+		return err
 	}
 
 	// Ignore file sync if flag is set on DB.
 	if !tx.db.NoSync || IgnoreNoSync {
-		if err := fdatasync(tx.db); err != nil {
+		if err := tx.db.sync(); err != nil {
 			return err
 		}
 	}
 
+	// Drop the old contents of the written pages from the page cache.
+	if tx.db.pageCache != nil {
+		for _, p := range pages {
+			tx.db.pageCache.remove(p.id, int(p.overflow)+1)
+		}
+	}
+
 	// Put small pages back to page pool.
 	for _, p := range pages {
 		// Ignore page sizes over 1 page.
@@ -583,6 +582,76 @@ func (tx *Tx) write() error {
 	return nil
 }
 
+// writeRun writes out a run of pages with contiguous ids. The run is written
+// with a single vectored write if the file supports it.
+func (tx *Tx) writeRun(run pages) error {
+	// The page failpoints are reached for each page, so while one is enabled
+	// the pages are written one at a time.
+	if len(run) > 1 && tx.db.failpointEnabled(FailpointBeforeWritePage, FailpointAfterWritePage) {
+		for i := range run {
+			if err := tx.writeRun(run[i : i+1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if short, err := tx.db.failpoint(FailpointBeforeWritePage); err != nil {
+		if short {
+			p := run[0]
+			size := (int(p.overflow) + 1) * tx.db.pageSize
+			_, _ = tx.db.ops.writeAt((*[maxAllocSize]byte)(unsafe.Pointer(p))[:size/2], int64(p.id)*int64(tx.db.pageSize))
+		}
+		return err
+	}
+
+	// Split pages into "max allocation" sized chunks.
+	var bufs [][]byte
+	for _, p := range run {
+		size := (int(p.overflow) + 1) * tx.db.pageSize
+		ptr := (*[maxAllocSize]byte)(unsafe.Pointer(p))
+		for {
+			// Limit our write to our max allocation size.
+			sz := size
+			if sz > maxAllocSize-1 {
+				sz = maxAllocSize - 1
+			}
+			bufs = append(bufs, ptr[:sz])
+
+			// Exit inner for loop if we've split all the chunks.
+			size -= sz
+			if size == 0 {
+				break
+			}
+
+			// Otherwise move pointer to next chunk.
+			ptr = (*[maxAllocSize]byte)(unsafe.Pointer(&ptr[sz]))
+		}
+		tx.stats.WritePage += int(p.overflow) + 1
+	}
+
+	offset := int64(run[0].id) * int64(tx.db.pageSize)
+	if len(bufs) > 1 && tx.db.ops.writevAt != nil {
+		_, calls, err := tx.db.ops.writevAt(bufs, offset)
+		tx.stats.Write += calls
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, buf := range bufs {
+			if _, err := tx.db.ops.writeAt(buf, offset); err != nil {
+				return err
+			}
+			tx.stats.Write++
+			offset += int64(len(buf))
+		}
+	}
+
+	if _, err := tx.db.failpoint(FailpointAfterWritePage); err != nil {
+		return err
+	}
+	return nil
+}
+
 // writeMeta writes the meta to the disk.
 func (tx *Tx) writeMeta() error {
 	// Create a temporary buffer for the meta page.
@@ -590,16 +659,37 @@ func (tx *Tx) writeMeta() error {
 	p := tx.db.pageInBuffer(buf, 0)
 	tx.meta.write(p)
 
+	if short, err := tx.db.failpoint(FailpointBeforeWriteMeta); err != nil {
+		// Tear the meta itself; the rest of the page is unused.
+		if short {
+			n := pageHeaderSize + int(unsafe.Sizeof(meta{}))/2
+			_, _ = tx.db.ops.writeAt(buf[:n], int64(p.id)*int64(tx.db.pageSize))
+		}
+		return err
+	}
+
 	// Write the meta page to file.
 	if _, err := tx.db.ops.writeAt(buf, int64(p.id)*int64(tx.db.pageSize)); err != nil {
 		return err
 	}
 	if !tx.db.NoSync || IgnoreNoSync {
-		if err := fdatasync(tx.db); err != nil {
+		if err := tx.db.sync(); err != nil {
 			return err
 		}
 	}
 
+	// Without an mmap the new meta page has to be swapped in.
+	if tx.db.pageCache != nil {
+		tx.db.pageCache.remove(p.id, 1)
+		tx.db.metalock.Lock()
+		if p.id == 0 {
+			tx.db.meta0 = p.meta()
+		} else {
+			tx.db.meta1 = p.meta()
+		}
+		tx.db.metalock.Unlock()
+	}
+
 	// Update statistics.
 	tx.stats.Write++
 
@@ -617,6 +707,15 @@ func (tx *Tx) page(id pgid) *page {
 	}
 
 	// Otherwise return directly from the mmap.
+	return tx.mappedPage(id)
+}
+
+// mappedPage returns the page with a given id from the data file, read from
+// the mapping the transaction began with if it is read-only.
+func (tx *Tx) mappedPage(id pgid) *page {
+	if tx.mapping != nil {
+		return tx.mapping.page(id, tx.db.pageSize)
+	}
 	return tx.db.page(id)
 }
 
@@ -646,7 +745,7 @@ func (tx *Tx) Page(id int) (*PageInfo, error) {
 	}
 
 	// Build the page info.
-	p := tx.db.page(pgid(id))
+	p := tx.mappedPage(pgid(id))
 	info := &PageInfo{
 		ID:            id,
 		Count:         int(p.count),
@@ -687,6 +786,7 @@ type TxStats struct {
 
 	// Write statistics.
 	Write     int           // number of writes performed
+	WritePage int           // number of pages written
 	WriteTime time.Duration // total time spent writing to disk
 }
 
@@ -702,6 +802,7 @@ func (s *TxStats) add(other *TxStats) {
 	s.Spill += other.Spill
 	s.SpillTime += other.SpillTime
 	s.Write += other.Write
+	s.WritePage += other.WritePage
 	s.WriteTime += other.WriteTime
 }
 
@@ -721,6 +822,7 @@ func (s *TxStats) Sub(other *TxStats) TxStats {
 	diff.Spill = s.Spill - other.Spill
 	diff.SpillTime = s.SpillTime - other.SpillTime
 	diff.Write = s.Write - other.Write
+	diff.WritePage = s.WritePage - other.WritePage
 	diff.WriteTime = s.WriteTime - other.WriteTime
 	return diff
 }
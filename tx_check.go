@@ -0,0 +1,261 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Check performs several consistency checks on the database for this transaction.
+// An error is returned if any inconsistency is found. Inconsistencies are
+// reported as *CheckError.
+//
+// It can be safely run concurrently on a writable transaction. On a read-only
+// transaction, however, it is not safe to execute other writer transactions at
+// the same time.
+//
+// Check is equivalent to CheckWithOptions with the default options.
+func (tx *Tx) Check() <-chan error {
+	return tx.CheckWithOptions(CheckOptions{})
+}
+
+// CheckOptions configures Tx.CheckWithOptions.
+type CheckOptions struct {
+	// Parallelism is the number of goroutines used to check bucket subtrees.
+	// Defaults to GOMAXPROCS.
+	Parallelism int
+
+	// Buckets restricts the check to the bucket at this path of nested bucket
+	// names, along with the buckets within it. Pages outside of the bucket
+	// are not checked, so unreachable pages are not reported. The whole
+	// database is checked if it is empty.
+	Buckets [][]byte
+
+	// SkipFreelist skips checking the freelist, along with whether pages are
+	// both reachable and freed, or neither.
+	SkipFreelist bool
+
+	// Progress, if set, is called periodically while the check runs.
+	Progress func(CheckProgress)
+}
+
+// CheckProgress describes how far Tx.CheckWithOptions has got.
+type CheckProgress struct {
+	CheckedN int  // number of reachable pages checked so far
+	PageN    int  // number of pages below the high water mark
+	Done     bool // true on the final call, once the check has finished
+}
+
+// CheckWithOptions performs the same consistency checks as Check, as
+// configured by opts. Errors may be reported in any order when bucket
+// subtrees are checked in parallel.
+func (tx *Tx) CheckWithOptions(opts CheckOptions) <-chan error {
+	ch := make(chan error)
+	go tx.check(opts, ch)
+	return ch
+}
+
+func (tx *Tx) check(opts CheckOptions, ch chan error) {
+	// Close the channel to signal completion.
+	defer close(ch)
+
+	s := newPageScan(tx, opts.Parallelism)
+	s.fail = func(e *CheckError) { ch <- e }
+	if opts.Progress != nil {
+		s.progress = func(checkedN int, done bool) {
+			opts.Progress(CheckProgress{CheckedN: checkedN, PageN: int(tx.meta.pgid), Done: done})
+		}
+	}
+
+	// Pages beyond the end of the file can't be read.
+	if size, err := tx.db.file.Size(); err != nil {
+		ch <- err
+		return
+	} else if n := pgid(size / int64(tx.db.pageSize)); n < s.limit {
+		ch <- &CheckError{Kind: CheckOutOfBounds, PageID: int(n), Index: -1, Detail: fmt.Sprintf("file ends at page %d of %d", int(n), int(s.limit))}
+		s.limit = n
+	}
+
+	// Pages freed by this transaction may or may not still be reachable,
+	// depending on whether its changes have been written yet.
+	var own map[pgid]bool
+	if !opts.SkipFreelist {
+		// Force loading free list if opened in ReadOnly mode.
+		tx.db.loadFreelist()
+
+		if txp := tx.db.freelist.pending[tx.meta.txid]; tx.writable && txp != nil {
+			own = make(map[pgid]bool, len(txp.ids))
+			for _, id := range txp.ids {
+				own[id] = true
+			}
+		}
+
+		// Check if any pages are double freed.
+		s.freed = make(map[pgid]bool)
+		all := make([]pgid, tx.db.freelist.count())
+		tx.db.freelist.copyall(all)
+		for _, id := range all {
+			if s.freed[id] {
+				ch <- &CheckError{Kind: CheckAlreadyFreed, PageID: int(id), Index: -1}
+			}
+			s.freed[id] = true
+		}
+		for id := range own {
+			delete(s.freed, id)
+		}
+	}
+
+	// Check the requested bucket only.
+	if len(opts.Buckets) > 0 {
+		b := tx.Bucket(opts.Buckets[0])
+		for _, name := range opts.Buckets[1:] {
+			if b == nil {
+				break
+			}
+			b = b.Bucket(name)
+		}
+		if b == nil {
+			ch <- ErrBucketNotFound
+			return
+		}
+		// Ignore inline buckets.
+		if b.root != 0 {
+			s.walk(b.root, opts.Buckets, nil)
+		}
+		s.wg.Wait()
+		s.report(true)
+		return
+	}
+
+	// Track every reachable page.
+	s.mark(0) // meta0
+	s.mark(1) // meta1
+	// The freelist chain is followed by hand so that it stops at the end of
+	// the file.
+	for id := tx.meta.freelist; id != pgidNoFreelist; {
+		if id >= s.limit {
+			ch <- &CheckError{Kind: CheckOutOfBounds, PageID: int(id), Index: -1, Detail: fmt.Sprintf("%d", int(s.limit))}
+			break
+		}
+		p := tx.page(id)
+		for i := pgid(0); i <= pgid(p.overflow) && p.id+i < s.limit; i++ {
+			s.mark(p.id + i)
+		}
+		if (p.flags & freelistDeltaPageFlag) == 0 {
+			break
+		}
+		id = p.freelistDelta().prev
+	}
+
+	// Recursively check buckets.
+	s.walk(tx.meta.root.root, nil, nil)
+	s.wg.Wait()
+	s.report(true)
+
+	// Ensure all pages below high water mark are either reachable or freed.
+	if opts.SkipFreelist {
+		return
+	}
+	// Pages beyond the end of the file were reported above.
+	for i := pgid(0); i < s.limit; i++ {
+		if !s.marked(i) && !s.freed[i] && !own[i] {
+			ch <- &CheckError{Kind: CheckUnreachableUnfreed, PageID: int(i), Index: -1}
+		}
+	}
+}
+
+// CheckErrorKind identifies the kind of inconsistency described by a
+// CheckError.
+type CheckErrorKind int
+
+const (
+	// CheckOutOfBounds means a page is at or beyond the high water mark, or
+	// beyond the end of the file.
+	CheckOutOfBounds CheckErrorKind = iota + 1
+	// CheckMultipleReferences means a page is referred to more than once.
+	CheckMultipleReferences
+	// CheckReachableFreed means a page in use is also in the freelist.
+	CheckReachableFreed
+	// CheckInvalidType means a page in a bucket is not a branch or leaf page.
+	CheckInvalidType
+	// CheckAlreadyFreed means a page is in the freelist more than once.
+	CheckAlreadyFreed
+	// CheckUnreachableUnfreed means a page is neither in use nor free.
+	CheckUnreachableUnfreed
+	// CheckElementOutOfBounds means an element, or its key or value, does
+	// not lie within its page.
+	CheckElementOutOfBounds
+	// CheckUnsortedKeys means a key is not greater than the key before it.
+	CheckUnsortedKeys
+	// CheckBranchKeyMismatch means a branch element's key is not the first
+	// key of the page it refers to.
+	CheckBranchKeyMismatch
+	// CheckInvalidBucket means a bucket value, or the page of an inline
+	// bucket, can't be parsed.
+	CheckInvalidBucket
+	// CheckInvalidKey means a key or value can't be stored, for example
+	// because the key is empty. It is only reported by Salvage.
+	CheckInvalidKey
+)
+
+var checkErrorKinds = map[CheckErrorKind]string{
+	CheckOutOfBounds:        "out of bounds",
+	CheckMultipleReferences: "multiple references",
+	CheckReachableFreed:     "reachable freed",
+	CheckInvalidType:        "invalid type",
+	CheckAlreadyFreed:       "already freed",
+	CheckUnreachableUnfreed: "unreachable unfreed",
+	CheckElementOutOfBounds: "element out of bounds",
+	CheckUnsortedKeys:       "unsorted keys",
+	CheckBranchKeyMismatch:  "branch key mismatch",
+	CheckInvalidBucket:      "invalid bucket",
+	CheckInvalidKey:         "invalid key",
+}
+
+// String returns a short description of the kind of inconsistency.
+func (k CheckErrorKind) String() string {
+	if s, ok := checkErrorKinds[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown<%d>", int(k))
+}
+
+// CheckError is an inconsistency found by Tx.Check.
+type CheckError struct {
+	Kind CheckErrorKind
+
+	// PageID is the id of the page the inconsistency was found on.
+	PageID int
+
+	// Bucket is the path of nested bucket names of the bucket the page
+	// belongs to, or nil if it belongs to the root bucket or none.
+	Bucket [][]byte
+
+	// Index is the index of the offending element on the page, or -1.
+	Index int
+
+	// Detail describes the inconsistency further, if there is more to say.
+	Detail string
+}
+
+// Error returns a description of the inconsistency.
+func (e *CheckError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "page %d: %s", e.PageID, e.Kind)
+	if e.Detail != "" {
+		fmt.Fprintf(&buf, ": %s", e.Detail)
+	}
+	if e.Index >= 0 {
+		fmt.Fprintf(&buf, " (element %d)", e.Index)
+	}
+	if len(e.Bucket) > 0 {
+		buf.WriteString(" (bucket ")
+		for i, name := range e.Bucket {
+			if i > 0 {
+				buf.WriteByte('/')
+			}
+			fmt.Fprintf(&buf, "%q", name)
+		}
+		buf.WriteByte(')')
+	}
+	return buf.String()
+}
@@ -0,0 +1,313 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Ensure that unsorted keys in an inline bucket are reported.
+func TestTx_Check_UnsortedKeys(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"key-aaa", "key-bbb", "key-ccc"} {
+			if err := b.Put([]byte(k), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	corruptDB(t, db, []byte("key-bbb"), []byte("key-zzz"))
+
+	errs := checkErrors(t, db)
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if e := errs[0]; e.Kind != bolt.CheckUnsortedKeys || e.Index != 2 || !reflect.DeepEqual(e.Bucket, [][]byte{[]byte("widgets")}) {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+}
+
+// Ensure that a branch key that doesn't match the first key of its child page
+// is reported.
+func TestTx_Check_BranchKeyMismatch(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%08d", i*10)), make([]byte, 50)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A key that is both on a branch page and a leaf page starts a leaf.
+	data, err := ioutil.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key []byte
+	for i := 1; i < 1000 && key == nil; i++ {
+		if k := []byte(fmt.Sprintf("%08d", i*10)); bytes.Count(data, k) == 2 {
+			key = k
+		}
+	}
+	if key == nil {
+		t.Fatal("no branch key found")
+	}
+
+	// Changing one of them to a key between its neighbours keeps both pages
+	// sorted.
+	i := bytes.Index(data, key)
+	lower := append([]byte{}, key...)
+	lower[len(lower)-1] = '9'
+	lower[len(lower)-2]--
+	corruptDBAt(t, db, int64(i), lower)
+
+	errs := checkErrors(t, db)
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if e := errs[0]; e.Kind != bolt.CheckBranchKeyMismatch || e.Index < 1 || !reflect.DeepEqual(e.Bucket, [][]byte{[]byte("widgets")}) {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+}
+
+// Ensure that an element beyond the end of its page is reported.
+func TestTx_Check_ElementOutOfBounds(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put(u64tob(uint64(i)), bytes.Repeat([]byte("v"), 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the page of the widgets bucket and make its element count too big.
+	var root int
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int(tx.Bucket([]byte("widgets")).Root())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	corruptDBAt(t, db, int64(root*db.Info().PageSize+10), []byte{0xff, 0xff})
+
+	errs := checkErrors(t, db)
+	if len(errs) == 0 {
+		t.Fatal("expected errors")
+	}
+	if e := errs[0]; e.Kind != bolt.CheckElementOutOfBounds || e.PageID != root {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+}
+
+// Ensure that pages beyond the end of a truncated file are reported rather
+// than read.
+func TestTx_Check_FileTruncated(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put(u64tob(uint64(i)), bytes.Repeat([]byte("v"), 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the last pages below the high water mark off the open database.
+	m := mustReadMeta(db.f)
+	end := int(m.Pgid) - 2
+	if err := os.Truncate(db.f, int64(end)*int64(m.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := checkErrors(t, db)
+	if len(errs) < 2 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if e := errs[0]; e.Kind != bolt.CheckOutOfBounds || e.PageID != end || e.Detail != fmt.Sprintf("file ends at page %d of %d", end, int(m.Pgid)) {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+	// Pages referred to from beyond the end of the file are unreachable.
+	var refs int
+	for _, e := range errs[1:] {
+		switch {
+		case e.Kind == bolt.CheckOutOfBounds && e.PageID >= end:
+			refs++
+		case e.Kind == bolt.CheckUnreachableUnfreed && e.PageID < end:
+		default:
+			t.Fatalf("unexpected error: %#v", e)
+		}
+	}
+	if refs == 0 {
+		t.Fatalf("no references beyond the end of the file: %v", errs)
+	}
+}
+
+// Ensure that an inline bucket whose page can't be parsed is reported.
+func TestTx_Check_InvalidInlineBucket(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("key"), []byte("value"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The inline page follows the bucket's key and the bucket header. Make
+	// it a branch page.
+	data, err := ioutil.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Count(data, []byte("widgets")) != 1 {
+		t.Fatal("expected one bucket key")
+	}
+	flags := bytes.Index(data, []byte("widgets")) + len("widgets") + 16 + 8
+	if data[flags] != 0x02 {
+		t.Fatalf("unexpected inline page flags: %#x", data[flags])
+	}
+	corruptDBAt(t, db, int64(flags), []byte{0x01})
+
+	errs := checkErrors(t, db)
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if e := errs[0]; e.Kind != bolt.CheckInvalidBucket || e.Index != 0 || e.Bucket != nil || e.Detail != "inline page is branch with 0 overflow" {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+}
+
+// Ensure that rebuilding the freelist of a NoFreelistSync database only fails
+// on pages that can't be reached, leaving other errors to Tx.Check.
+func TestTx_Check_NoFreelistSync(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%03d", i)), bytes.Repeat([]byte("v"), 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	corruptDB(t, db, []byte("key-001"), []byte("key-999"))
+
+	// Drop the freelist hint written on close so the freelist is rebuilt.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m := mustReadMeta(db.f)
+	if err := os.Truncate(db.f, int64(m.Pgid)*int64(m.PageSize)); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+
+	errs := checkErrors(t, db)
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if e := errs[0]; e.Kind != bolt.CheckUnsortedKeys || e.Index != 2 {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+}
+
+// corruptDB replaces every occurrence of old in the closed database file.
+func corruptDB(t *testing.T, db *DB, old, new []byte) {
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(data, old) {
+		t.Fatalf("%q not found", old)
+	}
+	if err := ioutil.WriteFile(db.f, bytes.Replace(data, old, new, -1), 0666); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+}
+
+// corruptDBAt overwrites the closed database file at offset with b.
+func corruptDBAt(t *testing.T, db *DB, offset int64, b []byte) {
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[offset:], b)
+	if err := ioutil.WriteFile(db.f, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+}
+
+// checkErrors returns the errors reported by Tx.Check, which must all be
+// CheckErrors. The database is closed afterwards.
+func checkErrors(t *testing.T, db *DB) []*bolt.CheckError {
+	var errs []*bolt.CheckError
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			e, ok := err.(*bolt.CheckError)
+			if !ok {
+				t.Fatalf("unexpected error type: %T: %v", err, err)
+			}
+			errs = append(errs, e)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return errs
+}
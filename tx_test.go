@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime"
 	"testing"
 
 	bolt "go.etcd.io/bbolt"
@@ -61,6 +62,118 @@ func TestTx_Check_ReadOnly(t *testing.T) {
 	tx.Rollback()
 }
 
+// Ensure that bucket subtrees can be checked in parallel with progress reports.
+func TestTx_CheckWithOptions(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	fillCheckDB(t, db)
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		var last bolt.CheckProgress
+		var calls int
+		for err := range tx.CheckWithOptions(bolt.CheckOptions{
+			Parallelism: 4,
+			Progress: func(p bolt.CheckProgress) {
+				if last.Done {
+					t.Fatal("progress reported after done")
+				}
+				last = p
+				calls++
+			},
+		}) {
+			t.Fatal(err)
+		}
+		if !last.Done || calls == 0 {
+			t.Fatalf("unexpected final progress: %+v (%d calls)", last, calls)
+		} else if last.CheckedN == 0 || last.CheckedN > last.PageN || last.PageN != int(tx.Size()/int64(db.Info().PageSize)) {
+			t.Fatalf("unexpected page counts: %+v", last)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a check can be restricted to a nested bucket.
+func TestTx_CheckWithOptions_Buckets(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	fillCheckDB(t, db)
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		var whole, part bolt.CheckProgress
+		for err := range tx.CheckWithOptions(bolt.CheckOptions{Progress: func(p bolt.CheckProgress) { whole = p }}) {
+			t.Fatal(err)
+		}
+		for err := range tx.CheckWithOptions(bolt.CheckOptions{
+			Buckets:      [][]byte{[]byte("widgets"), []byte("3")},
+			SkipFreelist: true,
+			Progress:     func(p bolt.CheckProgress) { part = p },
+		}) {
+			t.Fatal(err)
+		}
+		if part.CheckedN == 0 || part.CheckedN >= whole.CheckedN {
+			t.Fatalf("unexpected pages checked: %d of %d", part.CheckedN, whole.CheckedN)
+		}
+
+		var errs []error
+		for err := range tx.CheckWithOptions(bolt.CheckOptions{Buckets: [][]byte{[]byte("widgets"), []byte("no such bucket")}}) {
+			errs = append(errs, err)
+		}
+		if len(errs) != 1 || errs[0] != bolt.ErrBucketNotFound {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a writable transaction passes the check after deleting a bucket,
+// both before and after its changes are written.
+func TestTx_Check_DeleteBucket(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	fillCheckDB(t, db)
+	db.StrictMode = true
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("widgets")).DeleteBucket([]byte("3")); err != nil {
+			t.Fatal(err)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fillCheckDB creates nested buckets spanning many pages.
+func fillCheckDB(t *testing.T, db *DB) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			b, err := root.CreateBucket([]byte(fmt.Sprint(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < 500; j++ {
+				if err := b.Put(u64tob(uint64(j)), make([]byte, 100)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that committing a closed transaction returns an error.
 func TestTx_Commit_ErrTxClosed(t *testing.T) {
 	db := MustOpenDB()
@@ -83,6 +196,57 @@ func TestTx_Commit_ErrTxClosed(t *testing.T) {
 	}
 }
 
+// Ensure that a commit writes runs of contiguous pages with fewer writes where
+// the file supports vectored writes.
+func TestTx_Commit_CoalescedWrites(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// Load enough data that the new pages are allocated at the end of the file.
+	before := db.Stats()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 500)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.Stats()
+	diff := stats.TxStats.Sub(&before.TxStats)
+
+	if diff.WritePage < 100 {
+		t.Fatalf("expected at least 100 pages written, got %d", diff.WritePage)
+	}
+	if runtime.GOOS == "linux" {
+		if diff.Write > 5 {
+			t.Fatalf("expected few writes for %d pages, got %d", diff.WritePage, diff.Write)
+		}
+	} else if diff.Write <= diff.WritePage {
+		t.Fatalf("expected a write per page and the meta, got %d writes for %d pages", diff.Write, diff.WritePage)
+	}
+
+	// The data survives reopening.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that rolling back a closed transaction returns an error.
 func TestTx_Rollback_ErrTxClosed(t *testing.T) {
 	db := MustOpenDB()
@@ -713,7 +877,7 @@ func TestTx_Rollback(t *testing.T) {
 func TestTx_releaseRange(t *testing.T) {
 	// Set initial mmap size well beyond the limit we will hit in this
 	// test, since we are testing with long running read transactions
-	// and will deadlock if db.grow is triggered.
+	// and don't want them to keep old mappings alive.
 	db := MustOpenWithOption(&bolt.Options{InitialMmapSize: os.Getpagesize() * 100})
 	defer db.MustClose()
 